@@ -8,7 +8,10 @@ import (
 	"image/color"
 	"image/draw"
 	"io"
+	"io/fs"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // glyph is a singular bitmap glyph to be used as a mask, assumed to directly
@@ -48,17 +51,62 @@ func (g *glyph) At(x, y int) color.Color {
 
 // Font represents a particular bitmap font.
 type Font struct {
-	Name     string
-	Ascent   int // needn't be present in the font
-	Descent  int // needn't be present in the font
-	glyphs   map[rune]glyph
-	fallback glyph
+	Name        string
+	PointSize   int // nominal size, zero if not present in the font
+	XResolution int // in dots per inch, zero if not present in the font
+	YResolution int // in dots per inch, zero if not present in the font
+	Ascent      int // needn't be present in the font
+	Descent     int // needn't be present in the font
+	glyphs      map[rune]glyph
+	fallback    glyph
+
+	// Strict makes DrawString and BoundString skip runes missing
+	// from the font, rather than substituting the fallback glyph.
+	Strict bool
+
+	// A cache of glyphs for the ASCII range, which is the most common one,
+	// to avoid map lookups. It needs to be updated along with glyphs.
+	ascii    [128]glyph
+	hasASCII [128]bool
+}
+
+// updateCache refreshes the cache of ASCII glyphs from the glyph map.
+func (f *Font) updateCache() {
+	for r := range f.ascii {
+		f.ascii[r], f.hasASCII[r] = f.glyphs[rune(r)]
+	}
+}
+
+// Merge copies glyphs over from another font, keeping their own bounds
+// and advances. Unless overwrite is true, only runes missing in f are copied.
+// Font-wide properties, such as the ascent and descent, remain as they were.
+func (f *Font) Merge(other *Font, overwrite bool) {
+	for r, g := range other.glyphs {
+		if _, ok := f.glyphs[r]; !ok || overwrite {
+			f.glyphs[r] = g
+		}
+	}
+	f.updateCache()
+}
+
+// Runes returns all runes that the font has glyphs for, in ascending order.
+func (f *Font) Runes() []rune {
+	runes := make([]rune, 0, len(f.glyphs))
+	for r := range f.glyphs {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	return runes
 }
 
 // FindGlyph returns the best glyph to use for the given rune.
-// The returned boolean indicates whether a fallback has been used.
+// The returned boolean is false if the fallback had to be used.
 func (f *Font) FindGlyph(r rune) (glyph, bool) {
-	if g, ok := f.glyphs[r]; ok {
+	if r >= 0 && r < rune(len(f.ascii)) {
+		if f.hasASCII[r] {
+			return f.ascii[r], true
+		}
+	} else if g, ok := f.glyphs[r]; ok {
 		return g, true
 	}
 	return f.fallback, false
@@ -70,7 +118,10 @@ func (f *Font) DrawString(dst draw.Image, dp image.Point,
 	color color.Color, s string) {
 	src := image.NewUniform(color)
 	for _, r := range s {
-		g, _ := f.FindGlyph(r)
+		g, ok := f.FindGlyph(r)
+		if !ok && f.Strict {
+			continue
+		}
 		draw.DrawMask(dst, g.bounds.Add(dp),
 			src, image.ZP, &g, g.bounds.Min, draw.Over)
 		dp.X += g.advance
@@ -85,7 +136,10 @@ func (f *Font) BoundString(s string) (image.Rectangle, int) {
 		dot    image.Point
 	)
 	for _, r := range s {
-		g, _ := f.FindGlyph(r)
+		g, ok := f.FindGlyph(r)
+		if !ok && f.Strict {
+			continue
+		}
 		bounds = bounds.Union(g.bounds.Add(dot))
 		dot.X += g.advance
 	}
@@ -104,6 +158,11 @@ func latin1ToUTF8(latin1 []byte) string {
 
 // tokenize splits a BDF line into tokens. Quoted strings may start anywhere
 // on the line. We only enforce that they must end somewhere.
+//
+// Tokens are separated by any run of spaces and tabs. Within quotes,
+// a doubled quote stands for a literal one, and a closing quote that isn't
+// followed by a separator continues the token unquoted, so that `a"b c"d`
+// yields a single token `ab cd`. Quotes are taken literally on COMMENT lines.
 func tokenize(s string) (tokens []string, err error) {
 	token, quotes, escape := []rune{}, false, false
 	for _, r := range s {
@@ -166,6 +225,7 @@ type bdfParser struct {
 	line    int            // current line number
 	tokens  []string       // tokens on the current line
 	font    *Font          // glyph storage
+	opts    *ParseOptions  // parser configuration
 
 	defaultBounds  image.Rectangle
 	defaultAdvance int
@@ -228,6 +288,27 @@ func (p *bdfParser) parseProperties() {
 	}
 }
 
+// readSize reads the nominal size of the font. It is merely informative,
+// so a lenient parser leaves it unset when it is malformed.
+func (p *bdfParser) readSize() {
+	if len(p.tokens) < 4 {
+		if !p.opts.Lenient {
+			panic("insufficient arguments")
+		}
+		return
+	}
+	size, e1 := strconv.Atoi(p.tokens[1])
+	xres, e2 := strconv.Atoi(p.tokens[2])
+	yres, e3 := strconv.Atoi(p.tokens[3])
+	if e1 != nil || e2 != nil || e3 != nil {
+		if !p.opts.Lenient {
+			panic("invalid arguments")
+		}
+		return
+	}
+	p.font.PointSize, p.font.XResolution, p.font.YResolution = size, xres, yres
+}
+
 func (p *bdfParser) readBBX() image.Rectangle {
 	if len(p.tokens) < 5 {
 		panic("insufficient arguments")
@@ -248,17 +329,34 @@ func (p *bdfParser) readBBX() image.Rectangle {
 	}
 }
 
+// readBitmapRow decodes a single row of a glyph's bitmap of the given width.
+func (p *bdfParser) readBitmapRow(width int) ([]byte, error) {
+	row := strings.Join(p.tokens, " ")
+	if len(p.tokens) != 1 {
+		return nil, fmt.Errorf("invalid bitmap row: %q", row)
+	}
+	b, err := hex.DecodeString(row)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bitmap row: %q", row)
+	}
+	if len(b) != (width+7)/8 {
+		return nil, fmt.Errorf("invalid bitmap row: %q, width mismatch", row)
+	}
+	return b, nil
+}
+
+// parseChar reads a glyph. Unless the parser is lenient, invalid bitmap data
+// makes the whole font fail to load, otherwise the glyph is skipped.
 func (p *bdfParser) parseChar() {
 	g := glyph{bounds: p.defaultBounds, advance: p.defaultAdvance}
-	bitmap, rows, encoding := false, 0, -1
+	bitmap, rows, encoding, invalid := false, 0, -1, false
 	for p.readLine() && p.tokens[0] != "ENDCHAR" {
 		if bitmap {
-			b, err := hex.DecodeString(p.tokens[0])
-			if err != nil {
+			b, err := p.readBitmapRow(g.bounds.Dx())
+			if err != nil && !p.opts.Lenient {
 				panic(err)
-			}
-			if len(b) != (g.bounds.Dx()+7)/8 {
-				panic("invalid bitmap data, width mismatch")
+			} else if err != nil {
+				invalid = true
 			}
 			g.bitmap = append(g.bitmap, b...)
 			rows++
@@ -276,7 +374,13 @@ func (p *bdfParser) parseChar() {
 		}
 	}
 	if rows != g.bounds.Dy() {
-		panic("invalid bitmap data, height mismatch")
+		if !p.opts.Lenient {
+			panic("invalid bitmap data, height mismatch")
+		}
+		invalid = true
+	}
+	if invalid {
+		return
 	}
 
 	// XXX: We don't try to convert encodings, since we'd need x/text/encoding
@@ -306,6 +410,8 @@ func (p *bdfParser) parse() {
 				panic("insufficient arguments")
 			}
 			p.font.Name = p.tokens[1]
+		case "SIZE":
+			p.readSize()
 		case "FONTBOUNDINGBOX":
 			// There's no guarantee that this includes all BBXs.
 			p.defaultBounds = p.readBBX()
@@ -332,10 +438,43 @@ func (p *bdfParser) parse() {
 	}
 }
 
+// ParseOptions adjusts how fonts are read.
+type ParseOptions struct {
+	// Lenient makes glyphs with invalid bitmap data get skipped,
+	// and a malformed SIZE ignored, rather than making the whole font
+	// fail to load.
+	Lenient bool
+}
+
+// DefaultParseOptions are used when no options are given.
+var DefaultParseOptions = ParseOptions{}
+
+// NewFromFS loads a font file from a filesystem, such as embed.FS.
+func NewFromFS(fsys fs.FS, name string) (*Font, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewFromBDF(f)
+}
+
 func NewFromBDF(r io.Reader) (f *Font, err error) {
+	return NewFromBDFWithOptions(r, nil)
+}
+
+// NewFromBDFWithOptions reads a font, using DefaultParseOptions
+// if opts is nil.
+func NewFromBDFWithOptions(r io.Reader,
+	opts *ParseOptions) (f *Font, err error) {
+	if opts == nil {
+		opts = &DefaultParseOptions
+	}
+
 	p := bdfParser{
 		scanner:     bufio.NewScanner(r),
 		font:        &Font{glyphs: make(map[rune]glyph)},
+		opts:        opts,
 		defaultChar: -1,
 	}
 	defer func() {
@@ -351,5 +490,6 @@ func NewFromBDF(r io.Reader) (f *Font, err error) {
 	}()
 
 	p.parse()
+	p.font.updateCache()
 	return p.font, nil
 }
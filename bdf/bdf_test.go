@@ -0,0 +1,312 @@
+package bdf
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io/fs"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestTokenize(t *testing.T) {
+	for _, test := range []struct {
+		line   string
+		tokens []string
+	}{
+		{`FONT_ASCENT 14`, []string{"FONT_ASCENT", "14"}},
+		{"  ENCODING\t65 ", []string{"ENCODING", "65"}},
+		{`FAMILY_NAME "Fixed Sans"`, []string{"FAMILY_NAME", "Fixed Sans"}},
+		{`COPYRIGHT "a ""b"" c"`, []string{"COPYRIGHT", `a "b" c`}},
+		{`NOTICE "" x`, []string{"NOTICE", "", "x"}},
+		{`NOTICE ""`, []string{"NOTICE", ""}},
+		{`X a"b c"d`, []string{"X", "ab cd"}},
+		{`COMMENT "quoted" text`, []string{"COMMENT", `"quoted"`, "text"}},
+	} {
+		tokens, err := tokenize(test.line)
+		if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+		} else if !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%q: got %q, want %q", test.line, tokens, test.tokens)
+		}
+	}
+}
+
+func TestTokenizeUnterminated(t *testing.T) {
+	for _, line := range []string{
+		`FAMILY_NAME "Fixed`,
+		`COPYRIGHT "a ""b""`,
+	} {
+		if tokens, err := tokenize(line); err == nil {
+			t.Errorf("%q: unexpectedly succeeded with %q", line, tokens)
+		}
+	}
+}
+
+func TestNewFromFS(t *testing.T) {
+	data, err := os.ReadFile("../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys := fstest.MapFS{"fonts/default.bdf": {Data: data}}
+
+	font, err := NewFromFS(fsys, "fonts/default.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := font.FindGlyph('A'); !ok {
+		t.Error("the font is missing glyphs")
+	}
+	if _, err := NewFromFS(fsys, "fonts/missing.bdf"); !errors.Is(
+		err, fs.ErrNotExist) {
+		t.Errorf("got %v for a missing font, want %v", err, fs.ErrNotExist)
+	}
+}
+
+// testFont loads the font shared by tests, extended with a non-ASCII glyph.
+func testFont(tb testing.TB) *Font {
+	f, err := os.Open("../testdata/test.bdf")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer f.Close()
+
+	font, err := NewFromBDF(f)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	g := font.glyphs['c']
+	g.advance++
+	font.glyphs['č'] = g
+	font.updateCache()
+	return font
+}
+
+// findGlyphUncached is FindGlyph without the ASCII cache.
+func findGlyphUncached(f *Font, r rune) (glyph, bool) {
+	if g, ok := f.glyphs[r]; ok {
+		return g, true
+	}
+	return f.fallback, false
+}
+
+func TestFindGlyphCache(t *testing.T) {
+	font := testFont(t)
+	for _, text := range []string{
+		"Hello, world!",
+		"Příliš žluťoučký kůň úpěl ďábelské ódy",
+		"\x00\t\x7f\u0080\u00ff\u2603\U0001f600\U0010ffff",
+		string([]rune{-1, 128, 0x110000}),
+	} {
+		for _, r := range text {
+			g, ok := font.FindGlyph(r)
+			expected, expectedOK := findGlyphUncached(font, r)
+			if ok != expectedOK || !reflect.DeepEqual(g, expected) {
+				t.Errorf("%U: the cached lookup differs", r)
+			}
+		}
+	}
+}
+
+func BenchmarkFindGlyph(b *testing.B) {
+	font := testFont(b)
+	uncached := func(r rune) (glyph, bool) {
+		return findGlyphUncached(font, r)
+	}
+	for _, bench := range []struct {
+		name string
+		text string
+		find func(rune) (glyph, bool)
+	}{
+		{"ASCII", "Hello, world!", font.FindGlyph},
+		{"ASCII/uncached", "Hello, world!", uncached},
+		{"Unicode", "Příliš žluťoučký kůň", font.FindGlyph},
+		{"Unicode/uncached", "Příliš žluťoučký kůň", uncached},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, r := range bench.text {
+					bench.find(r)
+				}
+			}
+		})
+	}
+}
+
+func TestSize(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		lenient bool
+		fails   bool
+		size    [3]int
+	}{
+		{"SIZE 7 75 100", false, false, [3]int{7, 75, 100}},
+		{"SIZE 7 75 100", true, false, [3]int{7, 75, 100}},
+		{"SIZE 7 75", false, true, [3]int{}},
+		{"SIZE 7 75", true, false, [3]int{}},
+		{"SIZE 7.5 75 75", false, true, [3]int{}},
+		{"SIZE 7.5 75 75", true, false, [3]int{}},
+	} {
+		font, err := NewFromBDFWithOptions(strings.NewReader(
+			"STARTFONT 2.1\nFONT test\n"+test.line+"\n"+
+				"STARTCHAR A\nENCODING 65\nBBX 1 1 0 0\nBITMAP\n80\n"+
+				"ENDCHAR\nENDFONT\n"),
+			&ParseOptions{Lenient: test.lenient})
+		if test.fails {
+			if err == nil {
+				t.Errorf("%q: unexpectedly succeeded", test.line)
+			} else if !strings.HasPrefix(err.Error(), "line 3: ") {
+				t.Errorf("%q: unexpected error: %s", test.line, err)
+			}
+		} else if err != nil {
+			t.Errorf("%q: %s", test.line, err)
+		} else if size := [3]int{font.PointSize, font.XResolution,
+			font.YResolution}; size != test.size {
+			t.Errorf("%q: got %v, want %v", test.line, size, test.size)
+		}
+	}
+}
+
+// testBDF makes a minimal font file out of glyph definitions,
+// which are the contents of STARTCHAR blocks.
+func testBDF(properties string, chars ...string) string {
+	s := "STARTFONT 2.1\nFONT test\nSIZE 7 75 75\nFONTBOUNDINGBOX 5 7 0 -1\n"
+	if properties != "" {
+		s += "STARTPROPERTIES 1\n" + properties + "ENDPROPERTIES\n"
+	}
+	for _, c := range chars {
+		s += "STARTCHAR x\n" + c + "ENDCHAR\n"
+	}
+	return s + "ENDFONT\n"
+}
+
+// blackPixels lists black pixels of an image as strings, for comparisons.
+func blackPixels(img *image.Gray) (result []string) {
+	for y := img.Rect.Min.Y; y < img.Rect.Max.Y; y++ {
+		for x := img.Rect.Min.X; x < img.Rect.Max.X; x++ {
+			if img.GrayAt(x, y).Y == 0 {
+				result = append(result, image.Pt(x, y).String())
+			}
+		}
+	}
+	return
+}
+
+func TestMerge(t *testing.T) {
+	other, err := NewFromBDF(strings.NewReader(testBDF("",
+		"ENCODING 9500\nDWIDTH 4 0\nBBX 3 3 0 0\nBITMAP\n80\nE0\n80\n",
+		"ENCODING 65\nDWIDTH 4 0\nBBX 3 3 0 0\nBITMAP\n80\nE0\n80\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		overwrite bool
+		advanceA  int
+	}{
+		{false, 6},
+		{true, 4},
+	} {
+		font := testFont(t)
+		if _, ok := font.FindGlyph('├'); ok {
+			t.Fatal("the font already contains the glyph")
+		}
+
+		font.Merge(other, test.overwrite)
+		if g, ok := font.FindGlyph('├'); !ok || g.advance != 4 {
+			t.Errorf("%+v: the glyph hasn't been merged", test)
+		}
+		if g, _ := font.FindGlyph('A'); g.advance != test.advanceA {
+			t.Errorf("%+v: got advance %d for A", test, g.advance)
+		}
+
+		img := image.NewGray(image.Rect(0, 0, 4, 3))
+		draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+		font.DrawString(img, image.Pt(0, 3), color.Black, "├")
+		if pixels, want := blackPixels(img), []string{
+			"(0,0)", "(0,1)", "(1,1)", "(2,1)", "(0,2)",
+		}; !reflect.DeepEqual(pixels, want) {
+			t.Errorf("%+v: rendered %v, want %v", test, pixels, want)
+		}
+	}
+}
+
+func TestStrict(t *testing.T) {
+	font, err := NewFromBDF(strings.NewReader(testBDF("DEFAULT_CHAR 63\n",
+		"ENCODING 63\nDWIDTH 2 0\nBBX 1 1 0 0\nBITMAP\n80\n",
+		"ENCODING 65\nDWIDTH 3 0\nBBX 2 1 0 0\nBITMAP\nC0\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		strict  bool
+		text    string
+		advance int
+		pixels  []string
+	}{
+		{false, "A", 3, []string{"(0,0)", "(1,0)"}},
+		{false, "☃A", 5, []string{"(0,0)", "(2,0)", "(3,0)"}},
+		{true, "☃A", 3, []string{"(0,0)", "(1,0)"}},
+		{true, "A☃A", 6, []string{"(0,0)", "(1,0)", "(3,0)", "(4,0)"}},
+		{true, "☃", 0, nil},
+	} {
+		font.Strict = test.strict
+		if _, advance := font.BoundString(test.text); advance != test.advance {
+			t.Errorf("%+v: got advance %d", test, advance)
+		}
+
+		img := image.NewGray(image.Rect(0, 0, 8, 1))
+		draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+		font.DrawString(img, image.Pt(0, 1), color.Black, test.text)
+		if pixels := blackPixels(img); !reflect.DeepEqual(
+			pixels, test.pixels) {
+			t.Errorf("%+v: rendered %v", test, pixels)
+		}
+	}
+}
+
+func TestBitmapRows(t *testing.T) {
+	for _, test := range []struct {
+		row     string
+		lenient bool
+		err     string // the expected error, or empty if it should load
+		loaded  bool   // whether the glyph should then be in the font
+	}{
+		{"80", false, "", true},
+		{"c0 ", false, "", true},
+		{"  C0\t", true, "", true},
+		{"8G", false, `line 9: invalid bitmap row: "8G"`, false},
+		{"8G", true, "", false},
+		{"80 00", false, `line 9: invalid bitmap row: "80 00"`, false},
+		{"80 00", true, "", false},
+		{"8000", false, `line 9: invalid bitmap row: "8000", width mismatch`,
+			false},
+		{"8000", true, "", false},
+	} {
+		font, err := NewFromBDFWithOptions(strings.NewReader(testBDF("",
+			"ENCODING 65\nBBX 2 1 0 0\nBITMAP\n"+test.row+"\n",
+			"ENCODING 66\nBBX 2 1 0 0\nBITMAP\n80\n")),
+			&ParseOptions{Lenient: test.lenient})
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: got error %v, want %s", test.row, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.row, err)
+			continue
+		}
+		if _, ok := font.FindGlyph('A'); ok != test.loaded {
+			t.Errorf("%q: the glyph has been loaded: %t", test.row, ok)
+		}
+		if _, ok := font.FindGlyph('B'); !ok {
+			t.Errorf("%q: other glyphs have been skipped", test.row)
+		}
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 
 	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/logutil"
 )
 
 type fontItem struct {
@@ -26,11 +27,14 @@ var tmpl = template.Must(template.New("list").Parse(`
 <table border='1' cellpadding='3' style='border-collapse: collapse'>
 	<tr>
 		<th>Name</th>
+		<th>Size</th>
 		<th>Preview</th>
 	<tr>
 	{{- range $k, $v := . }}
 	<tr>
 		<td>{{ $k }}</td>
+		<td>{{ with $v.Font }}{{ if .PointSize }}{{ .PointSize }} pt
+			({{ .XResolution }}&times;{{ .YResolution }} dpi){{ end }}{{ end }}</td>
 		<td><img src='?name={{ $k }}'></td>
 	</tr>
 	{{- end }}
@@ -46,7 +50,7 @@ func handle(w http.ResponseWriter, r *http.Request) {
 
 	name := r.FormValue("name")
 	if name == "" {
-		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 		tmpl.Execute(w, fonts)
 		return
 	}
@@ -88,7 +92,7 @@ func main() {
 		fonts[filename] = fontItem{Font: font, Preview: img}
 	}
 
-	log.Println("starting server")
+	logutil.Infof("starting server")
 	http.HandleFunc("/", handle)
 	log.Fatal(http.ListenAndServe(":8080", nil))
 }
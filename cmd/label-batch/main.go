@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"os"
+
+	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/label"
+	"janouch.name/sklad/logutil"
+	"janouch.name/sklad/ql"
+)
+
+var device = flag.String("device", "",
+	"path to the printer device, instead of finding one")
+var scale = flag.Int("scale", 3, "integer upscaling of the font")
+var chain = flag.Bool("chain", false, "do not feed or cut between labels")
+
+var mediaWidth = flag.Int("media-width", 0,
+	"width in millimetres of media to use instead of what is detected")
+var mediaLength = flag.Int("media-length", 0,
+	"length in millimetres of that media, zero for continuous tape")
+
+// genLabel renders a single row, the same way label-tool does.
+func genLabel(font *bdf.Font, mi *ql.MediaInfo,
+	text, kind string) (image.Image, error) {
+	if text == "" {
+		return nil, errors.New("empty text")
+	}
+	switch kind {
+	case "", "text":
+		return label.GenLabelForWidth(
+			font, text, label.InscribedPins(mi), *scale), nil
+	case "qr":
+		img, err := label.GenLabelForHeight(
+			font, text, label.InscribedPins(mi), *scale, nil)
+		if err != nil {
+			return nil, err
+		}
+		return label.Orient(img, mi, label.OrientAlong), nil
+	default:
+		return nil, fmt.Errorf("unknown kind: %s", kind)
+	}
+}
+
+// labelKey identifies a rendered label within a batch, in which the font,
+// scale and media stay the same.
+type labelKey struct {
+	text, kind string
+}
+
+// readRecords reads all records beforehand, so that we don't print
+// half a batch.
+func readRecords(r io.Reader) (records [][]string, err error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		} else if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// printRecords renders and prints all records, returning how many of them
+// have failed. Rows that cannot be rendered are skipped, printer errors
+// abort the batch. Batches tend to repeat labels, so render each one once.
+func printRecords(records [][]string,
+	render func(text, kind string) (image.Image, error),
+	print func(image.Image) error) (failed int, err error) {
+	rendered := map[labelKey]image.Image{}
+	for i, record := range records {
+		text, kind := record[0], ""
+		if len(record) > 1 {
+			kind = record[1]
+		}
+
+		key := labelKey{text, kind}
+		img, ok := rendered[key]
+		if !ok {
+			if img, err = render(text, kind); err != nil {
+				logutil.Warnf("record %d: %s", i+1, err)
+				failed++
+				continue
+			}
+			rendered[key] = img
+		}
+		if err := print(img); err != nil {
+			return failed, fmt.Errorf("record %d: %s", i+1, err)
+		}
+	}
+	return failed, nil
+}
+
+// printBatch prints records on the printer, either as separate jobs,
+// or chained within a single one, so that the media isn't cut in between.
+func printBatch(p *ql.Printer, opts *ql.PrintOptions, chain bool,
+	records [][]string, render func(text, kind string) (image.Image, error)) (
+	failed int, err error) {
+	if !chain {
+		return printRecords(records, render,
+			func(img image.Image) error { return p.Print(img, opts) })
+	}
+
+	if err := p.BeginJob(opts); err != nil {
+		return 0, err
+	}
+	if failed, err = printRecords(records, render, p.AppendImage); err != nil {
+		return failed, err
+	}
+	return failed, p.EndJob()
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s BDF-FILE CSV-FILE\n", os.Args[0])
+		fmt.Fprintln(os.Stderr,
+			"Each CSV record contains the label text and optionally its kind,")
+		fmt.Fprintln(os.Stderr, "either \"text\" (the default) or \"qr\".")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	*scale = label.ClampScale(*scale)
+
+	// Load the font.
+	fi, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	font, err := bdf.NewFromBDF(fi)
+	if err != nil {
+		log.Fatalf("%s: %s\n", flag.Arg(0), err)
+	}
+	if err := fi.Close(); err != nil {
+		log.Fatalln(err)
+	}
+
+	f, err := os.Open(flag.Arg(1))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	records, err := readRecords(f)
+	f.Close()
+	if err != nil {
+		log.Fatalf("%s: %s\n", flag.Arg(1), err)
+	}
+
+	// Open and initialize the printer.
+	var p *ql.Printer
+	if *device != "" {
+		p, err = ql.OpenPath(*device)
+	} else {
+		p, err = ql.Open()
+	}
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if p == nil {
+		log.Fatalln("no suitable printer found")
+	}
+	defer p.Close()
+
+	if err := p.Initialize(); err != nil {
+		log.Fatalln(err)
+	}
+	if err := p.UpdateStatus(); err != nil {
+		log.Fatalln(err)
+	}
+
+	// Printers may not recognize third-party tape, let the user override it.
+	opts := ql.DefaultPrintOptions
+	if *mediaWidth != 0 {
+		opts.Media = ql.MediaSize{WidthMM: *mediaWidth, LengthMM: *mediaLength}
+	} else {
+		status := p.Status()
+		opts.Media = ql.MediaSize{
+			WidthMM:  status.MediaWidthMM(),
+			LengthMM: status.MediaLengthMM(),
+		}
+	}
+
+	mi := ql.GetMediaInfo(opts.Media.WidthMM, opts.Media.LengthMM)
+	if mi == nil {
+		log.Fatalln("unknown media")
+	}
+
+	failed, err := printBatch(p, &opts, *chain, records,
+		func(text, kind string) (image.Image, error) {
+			return genLabel(font, mi, text, kind)
+		})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d records failed\n", failed, len(records))
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/label"
+	"janouch.name/sklad/ql"
+)
+
+// sameImages reports whether two images have the same bounds and pixels.
+func sameImages(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// testFont loads the font shared by tests.
+func testFont(t testing.TB) *bdf.Font {
+	f, err := os.Open("../../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	font, err := bdf.NewFromBDF(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return font
+}
+
+func TestPrintRecords(t *testing.T) {
+	font, mi := testFont(t), ql.GetMediaInfo(62, 0)
+	render := func(text, kind string) (image.Image, error) {
+		return genLabel(font, mi, text, kind)
+	}
+
+	records, err := readRecords(strings.NewReader(
+		"Screws\nXA1,qr\n\"Nails, small\",text\nBolts,barcode\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 4 {
+		t.Fatalf("got %d records", len(records))
+	}
+
+	// The unknown kind is skipped, without affecting the rest.
+	var printed []image.Image
+	failed, err := printRecords(records, render, func(img image.Image) error {
+		printed = append(printed, img)
+		return nil
+	})
+	if err != nil || failed != 1 {
+		t.Fatalf("got %d failed, %v", failed, err)
+	}
+	if len(printed) != 3 {
+		t.Fatalf("got %d jobs, want 3", len(printed))
+	}
+
+	qr, err := label.GenLabelForHeight(
+		font, "XA1", label.InscribedPins(mi), *scale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []image.Image{
+		label.GenLabelForWidth(
+			font, "Screws", label.InscribedPins(mi), *scale),
+		label.Orient(qr, mi, label.OrientAlong),
+		label.GenLabelForWidth(
+			font, "Nails, small", label.InscribedPins(mi), *scale),
+	} {
+		if !sameImages(printed[i], want) {
+			t.Errorf("job %d doesn't match its record", i+1)
+		}
+	}
+
+	// Printer faults abort the batch.
+	jobs := 0
+	_, err = printRecords(records, render, func(img image.Image) error {
+		if jobs++; jobs == 2 {
+			return errors.New("cover open")
+		}
+		return nil
+	})
+	if err == nil || jobs != 2 {
+		t.Errorf("the batch hasn't been aborted: %d jobs, %v", jobs, err)
+	}
+}
+
+// fakeDevice stands in for the device file of a printer with continuous tape
+// loaded, which answers status requests and successfully prints everything.
+type fakeDevice struct {
+	writes  [][]byte // all data written, as separate writes
+	pending []byte   // responses yet to be read
+}
+
+func (d *fakeDevice) status(typ ql.StatusType) {
+	var s ql.Status
+	s[10], s[18] = 62, byte(typ)
+	d.pending = append(d.pending, s[:]...)
+}
+
+func (d *fakeDevice) Write(data []byte) (int, error) {
+	d.writes = append(d.writes, append([]byte(nil), data...))
+	switch {
+	case bytes.Equal(data, []byte{0x1b, 0x69, 0x53}):
+		d.status(ql.StatusTypeReplyToRequest)
+	case isPrintData(data):
+		d.status(ql.StatusTypePhaseChange)
+		d.status(ql.StatusTypePrintingCompleted)
+	}
+	return len(data), nil
+}
+
+func (d *fakeDevice) Read(buf []byte) (int, error) {
+	if len(d.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *fakeDevice) Close() error { return nil }
+
+func isPrintData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1b, 0x69, 0x61})
+}
+
+func TestPrintBatch(t *testing.T) {
+	font, mi := testFont(t), ql.GetMediaInfo(62, 0)
+	render := func(text, kind string) (image.Image, error) {
+		return genLabel(font, mi, text, kind)
+	}
+	records, err := readRecords(strings.NewReader(
+		"Screws\nXA1,qr\nBolts,barcode\nNails\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chain := range []bool{false, true} {
+		d := &fakeDevice{}
+		p := &ql.Printer{File: d}
+		if err := p.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.UpdateStatus(); err != nil {
+			t.Fatal(err)
+		}
+
+		opts := ql.DefaultPrintOptions
+		opts.Media = ql.MediaSize{WidthMM: 62}
+		failed, err := printBatch(p, &opts, chain, records, render)
+		if err != nil || failed != 1 {
+			t.Fatalf("chain %t: got %d failed, %v", chain, failed, err)
+		}
+
+		// Separate jobs each start anew and get cut, chained images
+		// only get cut after the last one.
+		var pages []string
+		for _, data := range d.writes {
+			if !isPrintData(data) {
+				continue
+			}
+			page := "continued"
+			if i := bytes.Index(data, []byte{0x1b, 0x69, 0x7a}); i >= 0 &&
+				data[i+11] == 0 {
+				page = "new"
+			}
+			if bytes.Contains(data, []byte{0x1b, 0x69, 0x4d, 0x40}) {
+				page += ", cut"
+			}
+			pages = append(pages, page)
+		}
+		want := []string{"new, cut", "new, cut", "new, cut"}
+		if chain {
+			want = []string{"new", "continued", "continued, cut"}
+		}
+		if strings.Join(pages, "|") != strings.Join(want, "|") {
+			t.Errorf("chain %t: got pages %q, want %q", chain, pages, want)
+		}
+	}
+}
+
+func TestPrintRecordsOnce(t *testing.T) {
+	records := [][]string{{"XA1", "qr"}, {"XA1"}, {"XA1", "qr"}, {"XA1", ""}}
+
+	rendered := map[labelKey]int{}
+	render := func(text, kind string) (image.Image, error) {
+		rendered[labelKey{text, kind}]++
+		return image.NewGray(image.Rect(0, 0, 1, 1)), nil
+	}
+	var printed []image.Image
+	if _, err := printRecords(records, render, func(img image.Image) error {
+		printed = append(printed, img)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(printed) != 4 || len(rendered) != 2 ||
+		rendered[labelKey{"XA1", "qr"}] != 1 ||
+		rendered[labelKey{"XA1", ""}] != 1 {
+		t.Fatalf("got %d jobs, rendered %v", len(printed), rendered)
+	}
+	if printed[0] != printed[2] || printed[1] != printed[3] {
+		t.Errorf("identical labels don't share the rendered image")
+	}
+	if printed[0] == printed[1] {
+		t.Errorf("different labels share the rendered image")
+	}
+}
+
+func BenchmarkPrintRecords(b *testing.B) {
+	font, mi := testFont(b), ql.GetMediaInfo(62, 0)
+	render := func(text, kind string) (image.Image, error) {
+		return genLabel(font, mi, text, kind)
+	}
+
+	// A subtree's worth of labels, mostly alike.
+	var records [][]string
+	for i := 0; i < 100; i++ {
+		records = append(records, []string{"Screws", "text"})
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := printRecords(records, render,
+			func(image.Image) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"errors"
+	"flag"
+	"fmt"
 	"html/template"
 	"image"
 	"image/color"
@@ -11,11 +13,15 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 
 	"janouch.name/sklad/bdf"
 	"janouch.name/sklad/imgutil"
 	"janouch.name/sklad/label"
+	"janouch.name/sklad/logutil"
 	"janouch.name/sklad/ql"
+
+	"github.com/boombuler/barcode/qr"
 )
 
 var tmplFont = template.Must(template.New("font").Parse(`
@@ -36,8 +42,27 @@ var tmplForm = template.Must(template.New("form").Parse(`
 <h1>PT-CBP label printing tool</h1>
 <table><tr>
 <td valign=top>
+	{{ if .LabelErr }}
+	<p>Error: {{ .LabelErr }}
+	{{ else }}
 	<img border=1 src='?font={{ .FontIndex }}&amp;scale={{ .Scale }}{{/*
-	*/}}&amp;text={{ .Text }}&amp;render'>
+	*/}}&amp;text={{ .Text }}&amp;kind={{ .Kind }}&amp;gap={{ .Gap }}{{/*
+	*/}}&amp;ratio={{ .Ratio }}{{/*
+	*/}}&amp;orient={{ .Orient }}&amp;media={{ .Media }}&amp;render'>
+	{{ end }}
+	{{ if and (eq .Kind "qr") (not .LabelErr) }}
+	<p><a href='?font={{ .FontIndex }}&amp;scale={{ .Scale }}{{/*
+	*/}}&amp;text={{ .Text }}&amp;kind=qr&amp;gap={{ .Gap }}{{/*
+	*/}}&amp;ratio={{ .Ratio }}{{/*
+	*/}}&amp;render&amp;format=svg'>SVG</a>
+	{{ end }}
+	{{ if not .LabelErr }}
+	<p><a href='?font={{ .FontIndex }}&amp;scale={{ .Scale }}{{/*
+	*/}}&amp;text={{ .Text }}&amp;kind={{ .Kind }}&amp;gap={{ .Gap }}{{/*
+	*/}}&amp;ratio={{ .Ratio }}{{/*
+	*/}}&amp;orient={{ .Orient }}&amp;media={{ .Media }}{{/*
+	*/}}&amp;render&amp;raster'>Raster</a>
+	{{ end }}
 </td>
 <td valign=top><form>
 	<fieldset>
@@ -45,19 +70,25 @@ var tmplForm = template.Must(template.New("form").Parse(`
 
 		<p>Printer: {{ .Printer.Manufacturer }} {{ .Printer.Model }}
 		<p>Tape:
-		{{ if .Printer.LastStatus }}
-		{{ .Printer.LastStatus.MediaWidthMM }} mm &times;
-		{{ .Printer.LastStatus.MediaLengthMM }} mm
+		{{ if .Printer.Status }}
+		{{ .Printer.Status.MediaWidthMM }} mm &times;
+		{{ .Printer.Status.MediaLengthMM }} mm
 
-		{{ if .MediaInfo }}
+		{{ if and .MediaInfo (not .DefaultMedia) }}
 		(offset: {{ .MediaInfo.SideMarginPins }} pt,
 		print area: {{ .MediaInfo.PrintAreaPins }} pt)
 		{{ else }}
 		(unknown media)
 		{{ end }}
 
-		{{ if .Printer.LastStatus.Errors }}
-		{{ range .Printer.LastStatus.Errors }}
+		{{ if .Printer.Status.MediaEmpty }}
+		<p>Warning: the media has run out
+		{{ else if .Printer.Status.MediaLow }}
+		<p>Warning: the media should be replaced soon
+		{{ end }}
+
+		{{ if .Printer.Status.Errors }}
+		{{ range .Printer.Status.Errors }}
 		<p>Error: {{ . }}
 		{{ end }}
 		{{ end }}
@@ -70,6 +101,21 @@ var tmplForm = template.Must(template.New("form").Parse(`
 		{{ else }}
 		<p>Error: {{ .PrinterErr }}
 		{{ end }}
+		{{ if .DefaultMedia }}
+		<p>Previewing for default media
+		(print area: {{ .MediaInfo.PrintAreaPins }} pt)
+		{{ end }}
+		<p><label for=media>Media:</label>
+			<select id=media name=media>
+				<option value="">as detected</option>
+				{{ range .MediaList }}
+				{{ $value := printf "%dx%d" .WidthMM .LengthMM }}
+				<option value="{{ $value }}"
+					{{ if eq $.Media $value }}selected{{ end -}}
+					>{{ .WidthMM }} mm{{ if .LengthMM }} &times;
+					{{ .LengthMM }} mm{{ end }}</option>
+				{{ end }}
+			</select>
 	</fieldset>
 	<fieldset>
 		<legend>Font</legend>
@@ -84,12 +130,41 @@ var tmplForm = template.Must(template.New("form").Parse(`
 		<p>Kind:
 			<input type=radio id=kind-text name=kind value=text
 				{{ if eq .Kind "text" }} checked{{ end }}>
-			<label for=kind-text>plain text (horizontal)</label>
+			<label for=kind-text>plain text</label>
+			<select name=orient>
+				<option value="">fitting automatically</option>
+				<option value="across"
+					{{ if eq .Orient "across" }}selected{{ end -}}
+					>across the tape</option>
+				<option value="along"
+					{{ if eq .Orient "along" }}selected{{ end -}}
+					>along the tape</option>
+				<option value="flipped"
+					{{ if eq .Orient "flipped" }}selected{{ end -}}
+					>along the tape, flipped</option>
+			</select>
 			<input type=radio id=kind-qr name=kind value=qr
 				{{ if eq .Kind "qr" }} checked{{ end }}>
 			<label for=kind-qr>QR code (vertical)</label>
+			<input type=radio id=kind-grid name=kind value=grid
+				{{ if eq .Kind "grid" }} checked{{ end }}>
+			<label for=kind-grid>calibration grid</label>
+			<input type=radio id=kind-glyphs name=kind value=glyphs
+				{{ if eq .Kind "glyphs" }} checked{{ end }}>
+			<label for=kind-glyphs>all glyphs</label>
+			<input type=radio id=kind-captioned name=kind value=captioned
+				{{ if eq .Kind "captioned" }} checked{{ end }}>
+			<label for=kind-captioned>QR code between
+				the first and last line (die-cut)</label>
+		<p><label for=gap>QR code gap:</label>
+			<input id=gap name=gap value='{{.Gap}}' size=1> pt
+		<p><label for=ratio>QR code share:</label>
+			<input id=ratio name=ratio value='{{.Ratio}}' size=1> %
+			(zero to fit the text at the given scale)
 		<p><input type=submit value='Update'>
+			{{ if .Printer }}
 			<input type=submit name=print value='Update and Print'>
+			{{ end }}
 	</fieldset>
 </form></td>
 </tr></table>
@@ -104,8 +179,20 @@ type fontItem struct {
 
 var fonts = []*fontItem{}
 
-func getPrinter() (*ql.Printer, error) {
-	printer, err := ql.Open()
+// orientations maps form values to how text labels should be read.
+var orientations = map[string]label.Orientation{
+	"":        label.OrientAuto,
+	"across":  label.OrientAcross,
+	"along":   label.OrientAlong,
+	"flipped": label.OrientAlongFlipped,
+}
+
+func getPrinter() (printer *ql.Printer, err error) {
+	if *device != "" {
+		printer, err = ql.OpenPath(*device)
+	} else {
+		printer, err = ql.Open()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -161,58 +248,120 @@ func handle(w http.ResponseWriter, r *http.Request) {
 	if printerErr == nil {
 		defer printer.Close()
 		printer.StatusNotify = func(status *ql.Status) {
-			log.Printf("\x1b[1mreceived status\x1b[m\n%s", status)
+			logutil.Debugf("\x1b[1mreceived status\x1b[m\n%s", status)
 		}
 
 		if initErr = getStatus(printer); initErr == nil {
+			status := printer.Status()
 			mediaInfo = ql.GetMediaInfo(
-				printer.LastStatus.MediaWidthMM(),
-				printer.LastStatus.MediaLengthMM(),
+				status.MediaWidthMM(),
+				status.MediaLengthMM(),
 			)
 		}
 	}
 
+	// Printers may not recognize third-party tape, let the user override it.
+	var media ql.MediaSize
+	if _, err := fmt.Sscanf(r.FormValue("media"), "%dx%d",
+		&media.WidthMM, &media.LengthMM); err == nil {
+		if mi := ql.GetMediaInfo(media.WidthMM, media.LengthMM); mi != nil {
+			mediaInfo = mi
+		} else {
+			media = ql.MediaSize{}
+		}
+	}
+
+	// Fall back to the default media, so that at least previews work.
+	defaultMedia := false
+	if mediaInfo == nil && *defaultMediaWidth != 0 {
+		mediaInfo = ql.GetMediaInfo(*defaultMediaWidth, *defaultMediaLength)
+		defaultMedia = true
+	}
+
 	var params = struct {
-		Printer    *ql.Printer
-		PrinterErr error
-		InitErr    error
-		MediaInfo  *ql.MediaInfo
-		Font       *bdf.Font
-		FontIndex  int
-		Text       string
-		Scale      int
-		Kind       string
+		Printer      *ql.Printer
+		PrinterErr   error
+		InitErr      error
+		LabelErr     error
+		MediaInfo    *ql.MediaInfo
+		DefaultMedia bool
+		Font         *bdf.Font
+		FontIndex    int
+		Text         string
+		Scale        int
+		Gap          int
+		Ratio        int
+		Kind         string
+		Orient       string
+		Media        string
+		MediaList    []ql.MediaSize
 	}{
-		Printer:    printer,
-		PrinterErr: printerErr,
-		InitErr:    initErr,
-		MediaInfo:  mediaInfo,
-		Font:       font.Font,
-		FontIndex:  fontIndex,
-		Text:       r.FormValue("text"),
-		Kind:       r.FormValue("kind"),
+		Printer:      printer,
+		PrinterErr:   printerErr,
+		InitErr:      initErr,
+		MediaInfo:    mediaInfo,
+		DefaultMedia: defaultMedia,
+		Font:         font.Font,
+		FontIndex:    fontIndex,
+		Text:         r.FormValue("text"),
+		Kind:         r.FormValue("kind"),
+		Orient:       r.FormValue("orient"),
+		MediaList:    ql.ListMedia(),
+	}
+	if media != (ql.MediaSize{}) {
+		params.Media = fmt.Sprintf("%dx%d", media.WidthMM, media.LengthMM)
 	}
 
 	params.Scale, err = strconv.Atoi(r.FormValue("scale"))
 	if err != nil {
 		params.Scale = 3
 	}
+	params.Scale = label.ClampScale(params.Scale)
+	params.Gap, err = strconv.Atoi(r.FormValue("gap"))
+	if err != nil {
+		params.Gap = label.DefaultQRLabelOptions.Gap
+	}
+	params.Ratio, _ = strconv.Atoi(r.FormValue("ratio"))
+	qrOpts := &label.QRLabelOptions{
+		Gap:     params.Gap,
+		QRRatio: float64(params.Ratio) / 100,
+	}
 	if params.Kind == "" {
 		params.Kind = "text"
 	}
 
 	var img image.Image
 	if mediaInfo != nil {
+		pins := label.InscribedPins(mediaInfo)
 		if params.Kind == "qr" {
-			img = &imgutil.LeftRotate{Image: label.GenLabelForHeight(
-				font.Font, params.Text, mediaInfo.PrintAreaPins, params.Scale)}
+			img, params.LabelErr = label.GenLabelForHeight(
+				font.Font, params.Text, pins, params.Scale, qrOpts)
+			if img != nil {
+				img = label.Orient(img, mediaInfo, label.OrientAlong)
+			}
+		} else if params.Kind == "grid" {
+			img = label.GenCalibrationGrid(font.Font, mediaInfo)
+		} else if params.Kind == "glyphs" {
+			img = label.GenGlyphSheet(font.Font, pins, params.Scale)
+		} else if params.Kind == "captioned" {
+			img, params.LabelErr = genCaptioned(
+				font.Font, params.Text, params.Scale, mediaInfo)
 		} else {
-			img = label.GenLabelForWidth(
-				font.Font, params.Text, mediaInfo.PrintAreaPins, params.Scale)
+			img = label.Orient(label.GenLabelForWidth(
+				font.Font, params.Text, pins, params.Scale),
+				mediaInfo, orientations[params.Orient])
 		}
-		if r.FormValue("print") != "" {
-			if err := printer.Print(img, false); err != nil {
-				log.Println("print error:", err)
+		if img != nil && r.FormValue("print") != "" {
+			opts := ql.DefaultPrintOptions
+			opts.MarginAdjust = *marginAdjust
+			opts.Media = media
+			if printer == nil {
+				logutil.Errorf("print error: %s", printerErr)
+			} else {
+				archiveLabel(params.Kind, img)
+				if err := printer.Print(img, &opts); err != nil {
+					logutil.Errorf("print error: %s", err)
+				}
 			}
 		}
 	}
@@ -229,20 +378,102 @@ func handle(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unknown media", 500)
 		return
 	}
+	if params.LabelErr != nil {
+		http.Error(w, params.LabelErr.Error(), 400)
+		return
+	}
+
+	if r.FormValue("format") == "svg" {
+		if params.Kind != "qr" {
+			http.Error(w, "SVG is only supported for QR codes", 400)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		if err := label.WriteQRLabelSVG(w, font.Font, params.Text,
+			label.InscribedPins(mediaInfo), params.Scale,
+			qrOpts); err != nil {
+			http.Error(w, err.Error(), 500)
+		}
+		return
+	}
+
+	// Show exactly what the printer would receive, for debugging.
+	opts := ql.DefaultPrintOptions
+	opts.MarginAdjust = *marginAdjust
+	preview := label.GenPreview(img, mediaInfo, &opts)
+	if _, ok := r.Form["raster"]; ok {
+		preview = ql.RasterPreview(img, mediaInfo, &opts)
+	}
 
 	w.Header().Set("Content-Type", "image/png")
-	if err := png.Encode(w, img); err != nil {
+	if err := png.Encode(w, preview); err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 }
 
+// genCaptioned puts a QR code of the whole text, with modules of the given
+// size, between its first and last line.
+func genCaptioned(font *bdf.Font, text string, scale int,
+	mi *ql.MediaInfo) (image.Image, error) {
+	qrImg, err := qr.Encode(text, qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.Split(text, "\n")
+	header, footer := lines[0], ""
+	if len(lines) > 1 {
+		footer = lines[len(lines)-1]
+	}
+	return label.GenCaptionedLabel(font, header, footer,
+		&imgutil.Scale{Image: qrImg, Scale: scale}, mi)
+}
+
+// archiveLabel keeps a timestamped copy of a printed label, if configured.
+func archiveLabel(name string, img image.Image) {
+	if *archiveDir == "" {
+		return
+	}
+	if _, err := label.Archive(*archiveDir, name, img); err != nil {
+		logutil.Warnf("cannot archive label: %s", err)
+	}
+}
+
+var (
+	device = flag.String("device", "",
+		"path to the printer device, instead of finding one")
+	defaultMediaWidth = flag.Int("media-width", 0,
+		"width in millimetres of media to use when none is detected")
+	defaultMediaLength = flag.Int("media-length", 0,
+		"length in millimetres of that media, zero for continuous tape")
+	marginAdjust = flag.Int("margin-adjust", 0,
+		"move labels by this many pins to compensate for printer deviations")
+	archiveDir = flag.String("archive-dir", "",
+		"keep a copy of every printed label in this directory")
+)
+
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatalf("usage: %s ADDRESS BDF-FILE...\n", os.Args[0])
+	flag.Var(&logutil.Default.Level, "log-level",
+		"minimum level of messages to log: debug, info, warn, or error")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [OPTION]... ADDRESS BDF-FILE...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *defaultMediaWidth != 0 &&
+		ql.GetMediaInfo(*defaultMediaWidth, *defaultMediaLength) == nil {
+		log.Fatalln("unknown default media")
 	}
 
-	address, bdfPaths := os.Args[1], os.Args[2:]
+	address, bdfPaths := flag.Arg(0), flag.Args()[1:]
 	for _, path := range bdfPaths {
 		fi, err := os.Open(path)
 		if err != nil {
@@ -266,7 +497,7 @@ func main() {
 		fonts = append(fonts, &fontItem{Path: path, Font: font, Preview: img})
 	}
 
-	log.Println("starting server")
+	logutil.Infof("starting server")
 	http.HandleFunc("/", handle)
 	log.Fatalln(http.ListenAndServe(address, nil))
 }
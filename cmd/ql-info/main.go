@@ -1,14 +1,46 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"os"
 
+	"janouch.name/sklad/logutil"
 	"janouch.name/sklad/ql"
 )
 
+var color = logutil.WantsColor(os.Stdout)
+
+// bold emphasizes a heading, if the output supports it.
+func bold(s string) string {
+	if !color {
+		return s
+	}
+	return "\x1b[1m" + s + "\x1b[m"
+}
+
+var device = flag.String("device", "",
+	"path to the printer device, instead of finding one")
+
 func main() {
-	printer, err := ql.Open()
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [OPTION]...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var printer *ql.Printer
+	var err error
+	if *device != "" {
+		printer, err = ql.OpenPath(*device)
+	} else {
+		printer, err = ql.Open()
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -18,7 +50,7 @@ func main() {
 
 	defer printer.Close()
 
-	fmt.Printf("\x1b[1m%s %s\x1b[m\n", printer.Manufacturer, printer.Model)
+	fmt.Println(bold(printer.Manufacturer + " " + printer.Model))
 	if err := printer.Initialize(); err != nil {
 		log.Fatalln(err)
 	}
@@ -26,10 +58,16 @@ func main() {
 		log.Fatalln(err)
 	}
 
-	status := printer.LastStatus
+	status := printer.Status()
 	fmt.Print(status)
 
-	fmt.Println("\x1b[1mMedia information\x1b[m")
+	if status.MediaEmpty() {
+		fmt.Println(bold("Warning: the media has run out"))
+	} else if status.MediaLow() {
+		fmt.Println(bold("Warning: the media should be replaced soon"))
+	}
+
+	fmt.Println(bold("Media information"))
 	if mi := ql.GetMediaInfo(
 		status.MediaWidthMM(), status.MediaLengthMM()); mi != nil {
 		fmt.Println("side margin pins:", mi.SideMarginPins)
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestBold(t *testing.T) {
+	defer func(saved bool) { color = saved }(color)
+	for _, test := range []struct {
+		color bool
+		want  string
+	}{
+		{false, "Media information"},
+		{true, "\x1b[1mMedia information\x1b[m"},
+	} {
+		color = test.color
+		if got := bold("Media information"); got != test.want {
+			t.Errorf("color %t: got %q, want %q", test.color, got, test.want)
+		}
+	}
+}
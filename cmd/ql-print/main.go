@@ -12,12 +12,25 @@ import (
 	"os"
 
 	"janouch.name/sklad/imgutil"
+	"janouch.name/sklad/logutil"
 	"janouch.name/sklad/ql"
 )
 
+var device = flag.String("device", "",
+	"path to the printer device, instead of finding one")
 var scale = flag.Int("scale", 1, "integer upscaling")
 var rotate = flag.Bool("rotate", false, "print sideways")
 var redblack = flag.Bool("redblack", false, "red and black print")
+var center = flag.Bool("center", false, "center the image on continuous tape")
+var fast = flag.Bool("fast", false, "give priority to print speed over quality")
+var marginAdjust = flag.Int("margin-adjust", 0,
+	"move the image by this many pins to compensate for printer deviations")
+var tearOff = flag.Int("tear-off", 0,
+	"feed this many extra dots of continuous tape, to tear the label off")
+var maxLength = flag.Int("max-length", ql.DefaultMaxLengthMM,
+	"refuse images longer than this many millimetres, negative for no limit")
+var retries = flag.Int("retries", 0,
+	"retry this many times after transient errors")
 
 func main() {
 	flag.Usage = func() {
@@ -43,6 +56,11 @@ func main() {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	// Only arbitrary images can lose details to the threshold,
+	// labels are generated from bitmap fonts and QR codes in black and white.
+	if err := imgutil.CheckContrast(img); err != nil {
+		logutil.Warnf("%s: %s", flag.Arg(0), err)
+	}
 	if *scale > 1 {
 		img = &imgutil.Scale{Image: img, Scale: *scale}
 	}
@@ -51,7 +69,12 @@ func main() {
 	}
 
 	// Open and initialize the printer.
-	p, err := ql.Open()
+	var p *ql.Printer
+	if *device != "" {
+		p, err = ql.OpenPath(*device)
+	} else {
+		p, err = ql.Open()
+	}
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -66,24 +89,36 @@ func main() {
 	}
 
 	// Check the picture against the media in the printer.
+	status := p.Status()
 	mi := ql.GetMediaInfo(
-		p.LastStatus.MediaWidthMM(),
-		p.LastStatus.MediaLengthMM(),
+		status.MediaWidthMM(),
+		status.MediaLengthMM(),
 	)
 	if mi == nil {
 		log.Fatalln("unknown media")
 	}
 
-	bounds := img.Bounds()
+	bounds, canvas := img.Bounds(), mi.Canvas()
 	dx, dy := bounds.Dx(), bounds.Dy()
-	if dx > mi.PrintAreaPins {
-		log.Fatalln("the image is too wide,", dx, ">", mi.PrintAreaPins, "pt")
+	if dx > canvas.Dx() {
+		log.Fatalln("the image is too wide,", dx, ">", canvas.Dx(), "pt")
+	}
+	if dy > canvas.Dy() && canvas.Dy() != 0 {
+		log.Fatalln("the image is too high,", dy, ">", canvas.Dy(), "pt")
 	}
-	if dy > mi.PrintAreaLength && mi.PrintAreaLength != 0 {
-		log.Fatalln("the image is too high,", dy, ">", mi.PrintAreaLength, "pt")
+	if *redblack && !mi.RedBlackCapable {
+		log.Fatalln("the media doesn't support red-black printing")
 	}
 
-	if err := p.Print(img, *redblack); err != nil {
+	opts := ql.DefaultPrintOptions
+	opts.RedBlack = *redblack
+	opts.Center = *center
+	opts.Fast = *fast
+	opts.MarginAdjust = *marginAdjust
+	opts.TearOffFeedDots = *tearOff
+	opts.MaxLengthMM = *maxLength
+	opts.Retries = *retries
+	if err := p.Print(img, &opts); err != nil {
 		log.Fatalln(err)
 	}
 }
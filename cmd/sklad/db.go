@@ -1,20 +1,30 @@
 package main
 
 import (
+	"embed"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/label"
+	"janouch.name/sklad/ql"
 )
 
 type Series struct {
 	Prefix      string // PK: prefix
 	Description string // what kind of containers this is for
 	Counter     uint   // last used container number
+
+	AutoPrintLabel bool   // print labels of new containers right away
+	LabelKind      string // default kind of labels, empty to fit the media
 }
 
 func (s *Series) Containers() []*Container {
@@ -28,10 +38,16 @@ type Container struct {
 	Number      uint        // PK: order within the series
 	Parent      ContainerId // the container we're in, if any, otherwise ""
 	Description string      // description and/or contents of this container
+	Kind        string      // what kind of a thing this is, free-form
+	Location    string      // where to physically find it, free-form
+
+	// When its label was last printed and confirmed, see LabelConfirm.
+	LabelConfirmed *time.Time
 }
 
 func (c *Container) Id() ContainerId {
-	return ContainerId(fmt.Sprintf("%s%s%d", db.Prefix, c.Series, c.Number))
+	return ContainerId(fmt.Sprintf("%s%s%0*d",
+		db.Prefix, c.Series, db.NumberWidth, c.Number))
 }
 
 func (c *Container) Children() []*Container {
@@ -40,6 +56,11 @@ func (c *Container) Children() []*Container {
 	return indexChildren[c.Id()]
 }
 
+// IsLeaf tells whether the container contains no other containers.
+func (c *Container) IsLeaf() bool {
+	return len(c.Children()) == 0
+}
+
 func (c *Container) Path() (result []ContainerId) {
 	for c != nil && c.Parent != "" {
 		c = indexContainer[c.Parent]
@@ -48,14 +69,70 @@ func (c *Container) Path() (result []ContainerId) {
 	return
 }
 
+// dbVersion is the current version of the database format.
+const dbVersion = 1
+
+// dbMigrations upgrade the database from the version given by the index
+// to the next one.
+var dbMigrations = []func(){
+	// Version 0 merely didn't have the version field.
+	0: func() {},
+}
+
 type Database struct {
+	Version    int          // format version, see dbVersion
 	Password   string       // password for web users
 	Prefix     string       // prefix for all container IDs
 	Series     []*Series    // all known series
 	Containers []*Container // all known containers
 
-	BDFPath  string // path to bitmap font file
-	BDFScale int    // integer scaling for the bitmap font
+	Language string // of labels, and the default of the UI; Czech if empty
+
+	// Descriptions in listings are cut to this many characters,
+	// and expand on demand. Zero means no limit.
+	ListDescriptionRunes int
+
+	// Shared secret for signing requests to /webhook/print,
+	// which is disabled while this is empty.
+	WebhookSecret string
+
+	// Zero-padding of container numbers within IDs. Since parents are
+	// referred to by their IDs, only change it with dbSetNumberWidth.
+	NumberWidth int
+
+	// Path to a bitmap font file. It may only be left empty if a font
+	// has been built in, see fonts/README.
+	BDFPath  string
+	BDFScale int // integer scaling for the bitmap font
+
+	// Share of the height of QR labels for the code, or zero to only
+	// leave it whatever the text at BDFScale doesn't take.
+	QRRatio float64
+
+	PrinterPath string // printer device to use, or empty to find one
+
+	DefaultMediaWidthMM  int // media to use without a printer, if non-zero
+	DefaultMediaLengthMM int // zero for continuous tape
+
+	MarginAdjust    int // calibration of the printer's side margin in pins
+	TearOffFeedDots int // extra feed on continuous tape, for tearing off
+
+	LabelChildCount bool // add the number of children to container labels
+	LabelLocation   bool // add the location to container labels
+	LabelFrame      bool // draw a frame around labels, for visual separation
+
+	// Show a preview of container labels, and only print them
+	// once the operator confirms that it matches.
+	LabelConfirm bool
+}
+
+// dbDefaultMedia returns the media that labels should be generated for
+// when no printer is available, which is 62mm tape unless configured.
+func dbDefaultMedia() *ql.MediaInfo {
+	if db.DefaultMediaWidthMM == 0 {
+		return ql.GetMediaInfo(62, 0)
+	}
+	return ql.GetMediaInfo(db.DefaultMediaWidthMM, db.DefaultMediaLengthMM)
 }
 
 var (
@@ -72,39 +149,147 @@ var (
 	labelFont *bdf.Font
 )
 
+// embeddedFonts may contain a default label font, for self-contained binaries.
+//
+//go:embed fonts
+var embeddedFonts embed.FS
+
+var foldSpecialCases = strings.NewReplacer("ß", "ss", "ẞ", "ss")
+
+// foldCase brings text to a form suitable for case-insensitive comparison.
+// Round-tripping through upper case also unifies characters that have several
+// lower case forms, such as the Greek final sigma. Full case folding would
+// need golang.org/x/text, which is not worth the dependency.
+func foldCase(s string) string {
+	return foldSpecialCases.Replace(strings.ToLower(strings.ToUpper(s)))
+}
+
+// searchContainer is a copy of a container, made for searching without
+// access to the live database, with everything needed for display resolved.
+type searchContainer struct {
+	Id          ContainerId
+	Path        []ContainerId
+	Description string
+	Kind        string
+	Location    string
+}
+
+// searchSnapshot is a read-only copy of what can be searched for.
+type searchSnapshot struct {
+	series     []*Series
+	containers []*searchContainer
+	kinds      []string
+}
+
+// dbSnapshot holds the current *searchSnapshot, so that searches don't need
+// to take the global lock, and thus don't hold up any changes.
+var dbSnapshot atomic.Value
+
+// dbSnapshotUpdate replaces the search snapshot with a fresh copy
+// of the database. The caller must hold the global lock.
+func dbSnapshotUpdate() {
+	snapshot := &searchSnapshot{kinds: dbKinds()}
+	for _, s := range db.Series {
+		copied := *s
+		snapshot.series = append(snapshot.series, &copied)
+	}
+	for _, c := range db.Containers {
+		snapshot.containers = append(snapshot.containers, &searchContainer{
+			Id:          c.Id(),
+			Path:        c.Path(),
+			Description: c.Description,
+			Kind:        c.Kind,
+			Location:    c.Location,
+		})
+	}
+	dbSnapshot.Store(snapshot)
+}
+
+// dbSearchSeries finds series matching the query, either in their prefix
+// or their description. It works on a snapshot, without the global lock.
 func dbSearchSeries(query string) (result []*Series) {
-	query = strings.ToLower(query)
+	snapshot := dbSnapshot.Load().(*searchSnapshot)
+	query = foldCase(query)
 	added := map[string]bool{}
-	for _, s := range db.Series {
-		if query == strings.ToLower(s.Prefix) {
+	for _, s := range snapshot.series {
+		if query == foldCase(s.Prefix) {
 			result = append(result, s)
 			added[s.Prefix] = true
 		}
 	}
-	for _, s := range db.Series {
+	for _, s := range snapshot.series {
 		if strings.Contains(
-			strings.ToLower(s.Description), query) && !added[s.Prefix] {
+			foldCase(s.Description), query) && !added[s.Prefix] {
 			result = append(result, s)
 		}
 	}
 	return
 }
 
-func dbSearchContainers(query string) (result []*Container) {
-	query = strings.ToLower(query)
-	added := map[ContainerId]bool{}
-	for id, c := range indexContainer {
-		if query == strings.ToLower(string(id)) {
-			result = append(result, c)
-			added[id] = true
+// trimNumberPadding strips any zeros padding the number at the end of an ID,
+// so that IDs can be looked up regardless of NumberWidth.
+func trimNumberPadding(id string) string {
+	rest := strings.TrimRight(id, "0123456789")
+	number := strings.TrimLeft(id[len(rest):], "0")
+	if number == "" && len(rest) < len(id) {
+		number = "0"
+	}
+	return rest + number
+}
+
+// dbSearchContainers finds containers matching the query, either in their ID,
+// description, or location. When kind is non-empty, only containers of that
+// kind are returned. It works on a snapshot, without the global lock.
+func dbSearchContainers(query, kind string) (result []*searchContainer) {
+	snapshot := dbSnapshot.Load().(*searchSnapshot)
+
+	// Matches on IDs go first, starting with the closest ones.
+	query = foldCase(query)
+	trimmed := trimNumberPadding(query)
+	var exact, prefix, substring, description, location []*searchContainer
+	for _, c := range snapshot.containers {
+		lowerID := foldCase(string(c.Id))
+		switch {
+		case kind != "" && !strings.EqualFold(c.Kind, kind):
+		case query == lowerID || trimmed == trimNumberPadding(lowerID):
+			exact = append(exact, c)
+		case strings.HasPrefix(lowerID, query):
+			prefix = append(prefix, c)
+		case strings.Contains(lowerID, query):
+			substring = append(substring, c)
+		case strings.Contains(foldCase(c.Description), query):
+			description = append(description, c)
+		case strings.Contains(foldCase(c.Location), query):
+			location = append(location, c)
 		}
 	}
-	for id, c := range indexContainer {
-		if strings.Contains(
-			strings.ToLower(c.Description), query) && !added[id] {
-			result = append(result, c)
+	for _, matches := range [][]*searchContainer{prefix, substring} {
+		sort.Slice(matches, func(i, j int) bool {
+			return matches[i].Id < matches[j].Id
+		})
+	}
+	result = append(result, exact...)
+	result = append(result, prefix...)
+	result = append(result, substring...)
+	result = append(result, description...)
+	return append(result, location...)
+}
+
+// dbSearchKinds returns all container kinds in use, sorted, from a snapshot.
+func dbSearchKinds() []string {
+	return dbSnapshot.Load().(*searchSnapshot).kinds
+}
+
+// dbKinds returns all container kinds in use, sorted.
+func dbKinds() (result []string) {
+	seen := map[string]bool{}
+	for _, c := range db.Containers {
+		if c.Kind != "" && !seen[c.Kind] {
+			seen[c.Kind] = true
+			result = append(result, c.Kind)
 		}
 	}
+	sort.Strings(result)
 	return
 }
 
@@ -158,6 +343,152 @@ func dbSeriesRemove(s *Series) error {
 	return dbCommit()
 }
 
+// dbSeriesClone creates a copy of a series under a new prefix, optionally
+// along with copies of all its containers, which keep their numbers.
+// Copies are placed within copies of their parents, parents from other
+// series are not carried over.
+func dbSeriesClone(s *Series, prefix string, containers bool) error {
+	if prefix == "" {
+		return errInvalidPrefix
+	}
+	if _, ok := indexSeries[prefix]; ok {
+		return errSeriesAlreadyExists
+	}
+
+	// Prepare everything first, so that nothing should need to be rolled back.
+	clone := *s
+	clone.Prefix = prefix
+
+	var copies []*Container
+	renamed := map[ContainerId]ContainerId{}
+	if containers {
+		for _, c := range s.Containers() {
+			copied := *c
+			copied.Series = prefix
+			if dbWouldCollide(&copied) {
+				return errContainerAlreadyExists
+			}
+			copies = append(copies, &copied)
+			renamed[c.Id()] = copied.Id()
+		}
+	} else {
+		clone.Counter = 0
+	}
+	for _, c := range copies {
+		c.Parent = renamed[c.Parent]
+	}
+
+	oldSeries, oldContainers := db.Series, db.Containers
+	db.Series = append(db.Series, &clone)
+	db.Containers = append(db.Containers, copies...)
+	if err := dbReindex(); err != nil {
+		db.Series, db.Containers = oldSeries, oldContainers
+		if err := dbReindex(); err != nil {
+			panic(err)
+		}
+		return err
+	}
+	return dbCommit()
+}
+
+var errCannotMergeIntoItself = errors.New("cannot merge a series into itself")
+
+// normalizeSeriesDescription reduces a description so that near-duplicates,
+// differing only in case, spacing or a plural suffix, compare equal.
+func normalizeSeriesDescription(description string) string {
+	s := strings.Join(strings.Fields(foldCase(description)), " ")
+	if strings.HasSuffix(s, "es") {
+		return strings.TrimSuffix(s, "es")
+	}
+	return strings.TrimSuffix(s, "s")
+}
+
+// dbSeriesDuplicates clusters series by their normalized description,
+// returning only clusters with more than one member.
+func dbSeriesDuplicates() (result [][]*Series) {
+	clusters := map[string][]*Series{}
+	var order []string
+	for _, s := range db.Series {
+		key := normalizeSeriesDescription(s.Description)
+		if key == "" {
+			continue
+		}
+		if _, ok := clusters[key]; !ok {
+			order = append(order, key)
+		}
+		clusters[key] = append(clusters[key], s)
+	}
+	for _, key := range order {
+		if len(clusters[key]) > 1 {
+			result = append(result, clusters[key])
+		}
+	}
+	return
+}
+
+// dbSeriesMerge moves all containers of one series into another one and
+// removes the emptied series. Numbers are kept where possible, containers
+// that would collide with existing ones get renumbered.
+func dbSeriesMerge(into, from *Series) error {
+	if into == from {
+		return errCannotMergeIntoItself
+	}
+
+	// Assign new numbers first, so that nothing should need to be rolled back.
+	taken := map[ContainerId]bool{}
+	for id, c := range indexContainer {
+		if c.Series != from.Prefix {
+			taken[id] = true
+		}
+	}
+
+	numbers := map[*Container]uint{}
+	renamed := map[ContainerId]ContainerId{}
+	counter := into.Counter
+	for _, c := range from.Containers() {
+		moved := *c
+		moved.Series = into.Prefix
+		if taken[moved.Id()] {
+			for moved.Number = counter + 1; taken[moved.Id()]; {
+				moved.Number++
+			}
+		}
+		if moved.Number > counter {
+			counter = moved.Number
+		}
+
+		taken[moved.Id()] = true
+		numbers[c] = moved.Number
+		renamed[c.Id()] = moved.Id()
+	}
+
+	oldSeries, oldCounter := db.Series, into.Counter
+	oldContainers := map[*Container]Container{}
+	for _, c := range db.Containers {
+		oldContainers[c] = *c
+		if id, ok := renamed[c.Parent]; ok {
+			c.Parent = id
+		}
+	}
+	for c, number := range numbers {
+		c.Series, c.Number = into.Prefix, number
+	}
+
+	into.Counter = counter
+	db.Series = filterSeries(db.Series, from)
+	if err := dbReindex(); err != nil {
+		db.Series, into.Counter = oldSeries, oldCounter
+		for c, old := range oldContainers {
+			*c = old
+		}
+		if err := dbReindex(); err != nil {
+			panic(err)
+		}
+		return err
+	}
+	return dbCommit()
+}
+
 var errContainerAlreadyExists = errors.New("container already exists")
 var errNoSuchContainer = errors.New("no such container")
 var errCannotChangeSeriesNotEmpty = errors.New(
@@ -165,6 +496,8 @@ var errCannotChangeSeriesNotEmpty = errors.New(
 var errCannotChangeNumber = errors.New("cannot change the number")
 var errWouldContainItself = errors.New("container would contain itself")
 var errContainerInUse = errors.New("container is in use")
+var errRemovalNotConfirmed = errors.New("removal has not been confirmed")
+var errMergeNotConfirmed = errors.New("merge has not been confirmed")
 
 // Find and filter out the container in O(n).
 func filterContainer(slice []*Container, c *Container) (filtered []*Container) {
@@ -176,6 +509,13 @@ func filterContainer(slice []*Container, c *Container) (filtered []*Container) {
 	return
 }
 
+// dbWouldCollide reports whether the ID of c, in the current formatting,
+// is already taken by another container.
+func dbWouldCollide(c *Container) bool {
+	other, ok := indexContainer[c.Id()]
+	return ok && other != c
+}
+
 func dbContainerCreate(c *Container) error {
 	if series, ok := indexSeries[c.Series]; !ok {
 		return errNoSuchSeries
@@ -183,13 +523,13 @@ func dbContainerCreate(c *Container) error {
 		c.Number = series.Counter
 		for {
 			c.Number++
-			if _, ok := indexContainer[c.Id()]; !ok {
+			if !dbWouldCollide(c) {
 				break
 			}
 		}
 		series.Counter = c.Number
 	}
-	if _, ok := indexContainer[c.Id()]; ok {
+	if dbWouldCollide(c) {
 		return errContainerAlreadyExists
 	}
 	if c.Parent != "" && indexContainer[c.Parent] == nil {
@@ -204,6 +544,14 @@ func dbContainerCreate(c *Container) error {
 	return dbCommit()
 }
 
+// dbContainerConfirmLabel records that the label of c has just been printed
+// after its preview has been confirmed.
+func dbContainerConfirmLabel(c *Container) error {
+	now := time.Now()
+	c.LabelConfirmed = &now
+	return dbCommit()
+}
+
 func dbContainerUpdate(c *Container, updated Container) error {
 	if _, ok := indexSeries[updated.Series]; !ok {
 		return errNoSuchSeries
@@ -219,7 +567,7 @@ func dbContainerUpdate(c *Container, updated Container) error {
 	if updated.Number != c.Number {
 		return errCannotChangeNumber
 	}
-	if _, ok := indexContainer[newID]; ok && newID != c.Id() {
+	if newID != c.Id() && dbWouldCollide(&updated) {
 		return errContainerAlreadyExists
 	}
 	if updated.Parent != c.Parent {
@@ -238,6 +586,39 @@ func dbContainerUpdate(c *Container, updated Container) error {
 	return dbCommit()
 }
 
+// dbReparentChildren moves all direct children of one container into another,
+// either of which may be empty to denote the top level.
+func dbReparentChildren(from, to ContainerId) error {
+	if from != "" && indexContainer[from] == nil {
+		return errNoSuchContainer
+	}
+	if to != "" && indexContainer[to] == nil {
+		return errNoSuchContainer
+	}
+	if from == to {
+		return nil
+	}
+
+	// Validate everything first, so that nothing needs to be rolled back.
+	children := indexChildren[from]
+	moved := map[ContainerId]bool{}
+	for _, c := range children {
+		moved[c.Id()] = true
+	}
+	for id := to; id != ""; id = indexContainer[id].Parent {
+		if moved[id] {
+			return errWouldContainItself
+		}
+	}
+
+	for _, c := range children {
+		c.Parent = to
+	}
+	indexChildren[to] = append(indexChildren[to], children...)
+	delete(indexChildren, from)
+	return dbCommit()
+}
+
 func dbContainerRemove(c *Container) error {
 	if len(indexChildren[c.Id()]) > 0 {
 		return errContainerInUse
@@ -252,7 +633,86 @@ func dbContainerRemove(c *Container) error {
 	return dbCommit()
 }
 
+// dbContainerRemoveRecursive removes a container along with everything
+// it contains, all at once. Series counters are left as they are.
+func dbContainerRemoveRecursive(c *Container) error {
+	var subtree []*Container
+	var collect func(c *Container)
+	collect = func(c *Container) {
+		for _, child := range indexChildren[c.Id()] {
+			collect(child)
+		}
+		subtree = append(subtree, c)
+	}
+	collect(c)
+
+	removed := map[*Container]bool{}
+	for _, c := range subtree {
+		removed[c] = true
+	}
+	filtered := []*Container{}
+	for _, container := range db.Containers {
+		if !removed[container] {
+			filtered = append(filtered, container)
+		}
+	}
+	db.Containers = filtered
+
+	// Going bottom-up, children are gone by the time we get to their parent.
+	for _, c := range subtree {
+		indexMembers[c.Series] = filterContainer(indexMembers[c.Series], c)
+		indexChildren[c.Parent] = filterContainer(indexChildren[c.Parent], c)
+
+		delete(indexContainer, c.Id())
+		delete(indexChildren, c.Id())
+	}
+	return dbCommit()
+}
+
+var errInvalidNumberWidth = errors.New("invalid number width")
+
+// maxNumberWidth is how wide a uint can get in decimal.
+const maxNumberWidth = 20
+
+// dbSetNumberWidth changes the zero-padding of container numbers,
+// updating all references to the affected container IDs.
+func dbSetNumberWidth(width int) error {
+	if width < 0 || width > maxNumberWidth {
+		return errInvalidNumberWidth
+	}
+
+	oldWidth, oldParents := db.NumberWidth, map[*Container]ContainerId{}
+	renamed := map[ContainerId]*Container{}
+	for _, c := range db.Containers {
+		oldParents[c] = c.Parent
+		renamed[c.Id()] = c
+	}
+
+	db.NumberWidth = width
+	for _, c := range db.Containers {
+		if c.Parent != "" {
+			c.Parent = renamed[c.Parent].Id()
+		}
+	}
+
+	// Different series may end up with colliding IDs.
+	if err := dbReindex(); err != nil {
+		db.NumberWidth = oldWidth
+		for c, parent := range oldParents {
+			c.Parent = parent
+		}
+		if err := dbReindex(); err != nil {
+			panic(err)
+		}
+		return err
+	}
+	return dbCommit()
+}
+
 func dbCommit() error {
+	// Searches should reflect the changes even if they fail to be saved.
+	dbSnapshotUpdate()
+
 	// Write a timestamp.
 	e := json.NewEncoder(dbLog)
 	e.SetIndent("", "  ")
@@ -290,23 +750,12 @@ func dbCommit() error {
 	return nil
 }
 
-// loadDatabase loads the database from a simple JSON file. We do not use
-// any SQL stuff or even external KV storage because there is no real need
-// for our trivial use case, with our general amount of data.
-func loadDatabase() error {
-	dbFile, err := os.Open(dbPath)
-	if err != nil {
-		return err
-	}
-	defer dbFile.Close()
-	if err := json.NewDecoder(dbFile).Decode(&db); err != nil {
-		return err
-	}
-
-	// Further validate the database.
-	if db.Prefix == "" {
-		return errors.New("misconfigured prefix")
-	}
+// dbReindex reconstructs all indexes from scratch, validating the database.
+func dbReindex() error {
+	indexSeries = map[string]*Series{}
+	indexMembers = map[string][]*Container{}
+	indexContainer = map[ContainerId]*Container{}
+	indexChildren = map[ContainerId][]*Container{}
 
 	// Construct indexes for primary keys, validate against duplicates.
 	for _, pv := range db.Series {
@@ -316,11 +765,10 @@ func loadDatabase() error {
 		indexSeries[pv.Prefix] = pv
 	}
 	for _, pv := range db.Containers {
-		id := pv.Id()
-		if _, ok := indexContainer[id]; ok {
-			return fmt.Errorf("duplicate container: %s", id)
+		if dbWouldCollide(pv) {
+			return fmt.Errorf("duplicate container: %s", pv.Id())
 		}
-		indexContainer[id] = pv
+		indexContainer[pv.Id()] = pv
 	}
 
 	// Construct an index that goes from parent containers to their children.
@@ -347,13 +795,87 @@ func loadDatabase() error {
 			pv = indexContainer[pv.Parent]
 		}
 	}
+	return nil
+}
+
+// dbBackup copies the database file to a timestamped file next to it,
+// and removes the oldest such copies, so that at most keep of them remain.
+func dbBackup(keep int) error {
+	data, err := os.ReadFile(dbPath)
+	if err != nil {
+		return err
+	}
+	backupPath := dbPath + "." + time.Now().Format("20060102-150405") + ".bak"
+	if err := os.WriteFile(backupPath, data, 0644); err != nil {
+		return err
+	}
+
+	// The timestamps sort chronologically.
+	backups, err := filepath.Glob(dbPath + ".*.bak")
+	if err != nil {
+		return err
+	}
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// loadDatabase loads the database from a simple JSON file. We do not use
+// any SQL stuff or even external KV storage because there is no real need
+// for our trivial use case, with our general amount of data.
+func loadDatabase() error {
+	dbFile, err := os.Open(dbPath)
+	if err != nil {
+		return err
+	}
+	defer dbFile.Close()
+	if err := json.NewDecoder(dbFile).Decode(&db); err != nil {
+		return err
+	}
+
+	// Bring older databases up to date, the changes get saved on next commit.
+	if db.Version < 0 || db.Version > dbVersion {
+		return fmt.Errorf("unsupported database version: %d", db.Version)
+	}
+	for ; db.Version < dbVersion; db.Version++ {
+		dbMigrations[db.Version]()
+	}
+
+	// Further validate the database.
+	if db.Prefix == "" {
+		return errors.New("misconfigured prefix")
+	}
+	if db.NumberWidth < 0 || db.NumberWidth > maxNumberWidth {
+		return errInvalidNumberWidth
+	}
+
+	if err := dbReindex(); err != nil {
+		return err
+	}
+	dbSnapshotUpdate()
 
 	// Prepare label printing.
-	if db.BDFScale <= 0 {
-		db.BDFScale = 1
+	db.BDFScale = label.ClampScale(db.BDFScale)
+	if dbDefaultMedia() == nil {
+		return errors.New("unknown default media")
+	}
+	if db.TearOffFeedDots < 0 || db.TearOffFeedDots > ql.MaxTearOffFeedDots {
+		return errors.New("tear-off feed out of range")
 	}
 
-	if f, err := os.Open(db.BDFPath); err != nil {
+	if db.BDFPath == "" {
+		labelFont, err = bdf.NewFromFS(embeddedFonts, "fonts/default.bdf")
+		if errors.Is(err, fs.ErrNotExist) {
+			return errors.New("no label font has been built in, set BDFPath")
+		} else if err != nil {
+			return fmt.Errorf("cannot load built-in label font: %s", err)
+		}
+	} else if f, err := os.Open(dataPath(db.BDFPath)); err != nil {
 		return fmt.Errorf("cannot load label font: %s", err)
 	} else {
 		defer f.Close()
@@ -0,0 +1,819 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// testDatabase replaces the global database with the given one,
+// backed by files in a temporary directory, so that it can be committed.
+func testDatabase(t *testing.T, d Database) {
+	dbPath = filepath.Join(t.TempDir(), "db.json")
+	var err error
+	if dbLog, err = os.Create(dbPath + ".log"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbLog.Close() })
+
+	db, dbLast = d, d
+	if err := dbReindex(); err != nil {
+		t.Fatal(err)
+	}
+	dbSnapshotUpdate()
+}
+
+// testCommitted reads back the database as last committed.
+func testCommitted(t *testing.T) (d Database) {
+	f, err := os.Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&d); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// searchIDs returns the IDs of containers found by a search, in order.
+func searchIDs(query, kind string) (ids []ContainerId) {
+	for _, c := range dbSearchContainers(query, kind) {
+		ids = append(ids, c.Id)
+	}
+	return
+}
+
+func TestSearchContainersByKind(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A"}},
+		Containers: []*Container{
+			{Series: "A", Number: 1, Kind: "bin", Description: "screws"},
+			{Series: "A", Number: 2, Kind: "Shelf", Description: "screws"},
+			{Series: "A", Number: 3, Description: "screws"},
+		},
+	})
+	for _, test := range []struct {
+		kind   string
+		result []ContainerId
+	}{
+		{"", []ContainerId{"XA1", "XA2", "XA3"}},
+		{"bin", []ContainerId{"XA1"}},
+		{"shelf", []ContainerId{"XA2"}},
+		{"drawer", nil},
+	} {
+		ids := searchIDs("screws", test.kind)
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		if !reflect.DeepEqual(ids, test.result) {
+			t.Errorf("%q: got %v, want %v", test.kind, ids, test.result)
+		}
+	}
+}
+
+func TestContainerKindPersists(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix:     "X",
+		Series:     []*Series{{Prefix: "A"}},
+		Containers: []*Container{{Series: "A", Number: 1, Kind: "bin"}},
+	})
+
+	c := indexContainer["XA1"]
+	updated := *c
+	updated.Kind = "drawer"
+	if err := dbContainerUpdate(c, updated); err != nil {
+		t.Fatal(err)
+	}
+	if kind := testCommitted(t).Containers[0].Kind; kind != "drawer" {
+		t.Errorf("got kind %q after an update, want %q", kind, "drawer")
+	}
+}
+
+func TestSearchContainersRanking(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A"}, {Prefix: "B"}, {Prefix: "CXA"}},
+		Containers: []*Container{
+			{Series: "B", Number: 1, Description: "Víko od xa1"},
+			{Series: "CXA", Number: 1},
+			{Series: "A", Number: 12},
+			{Series: "A", Number: 10},
+			{Series: "A", Number: 2},
+			{Series: "A", Number: 1},
+		},
+	})
+	for _, test := range []struct {
+		query  string
+		result []ContainerId
+	}{
+		{"xa1", []ContainerId{"XA1", "XA10", "XA12", "XCXA1", "XB1"}},
+		{"XA1", []ContainerId{"XA1", "XA10", "XA12", "XCXA1", "XB1"}},
+		{"a2", []ContainerId{"XA2"}},
+		{"víko", []ContainerId{"XB1"}},
+		{"nothing", nil},
+	} {
+		if ids := searchIDs(test.query, ""); !reflect.DeepEqual(
+			ids, test.result) {
+			t.Errorf("%q: got %v, want %v", test.query, ids, test.result)
+		}
+	}
+}
+
+func TestSearchFoldsCase(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{
+			{Prefix: "A", Description: "Nářadí"},
+			{Prefix: "B", Description: "Straße"},
+		},
+		Containers: []*Container{
+			{Series: "A", Number: 1, Description: "Müller"},
+			{Series: "A", Number: 2, Description: "Straße"},
+			{Series: "A", Number: 3, Description: "ΟΔΟΣ"},
+			{Series: "A", Number: 4, Description: "Москва"},
+		},
+	})
+	for _, test := range []struct {
+		query  string
+		result []ContainerId
+	}{
+		{"müller", []ContainerId{"XA1"}},
+		{"MÜLLER", []ContainerId{"XA1"}},
+		{"STRASSE", []ContainerId{"XA2"}},
+		{"strasse", []ContainerId{"XA2"}},
+		{"STRAẞE", []ContainerId{"XA2"}},
+		{"οδος", []ContainerId{"XA3"}},
+		{"МОСКВА", []ContainerId{"XA4"}},
+	} {
+		if ids := searchIDs(test.query, ""); !reflect.DeepEqual(
+			ids, test.result) {
+			t.Errorf("%q: got %v, want %v", test.query, ids, test.result)
+		}
+	}
+
+	for _, test := range []struct {
+		query  string
+		result []string
+	}{
+		{"NÁŘADÍ", []string{"A"}},
+		{"strasse", []string{"B"}},
+		{"a", []string{"A", "B"}},
+	} {
+		var prefixes []string
+		for _, s := range dbSearchSeries(test.query) {
+			prefixes = append(prefixes, s.Prefix)
+		}
+		if !reflect.DeepEqual(prefixes, test.result) {
+			t.Errorf("%q: got %v, want %v", test.query, prefixes, test.result)
+		}
+	}
+}
+
+func TestSearchContainersByLocation(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A"}},
+		Containers: []*Container{
+			{Series: "A", Number: 1,
+				Description: "Šrouby", Location: "Regál 3"},
+			{Series: "A", Number: 2, Description: "Na regál"},
+			{Series: "A", Number: 3, Location: "Sklep"},
+		},
+	})
+	for _, test := range []struct {
+		query  string
+		result []ContainerId
+	}{
+		{"regál", []ContainerId{"XA2", "XA1"}},
+		{"SKLEP", []ContainerId{"XA3"}},
+		{"šrouby", []ContainerId{"XA1"}},
+	} {
+		if ids := searchIDs(test.query, ""); !reflect.DeepEqual(
+			ids, test.result) {
+			t.Errorf("%q: got %v, want %v", test.query, ids, test.result)
+		}
+	}
+
+	c := indexContainer["XA1"]
+	updated := *c
+	updated.Description = "Hřebíky"
+	if err := dbContainerUpdate(c, updated); err != nil {
+		t.Fatal(err)
+	}
+	if location := testCommitted(t).Containers[0].Location; location !=
+		"Regál 3" {
+		t.Errorf("got location %q after an update", location)
+	}
+}
+
+// TestSearchConcurrently searches while containers are being created
+// and changed, which is meant to be run with the race detector.
+// Each search must see a consistent state of the database.
+func TestSearchConcurrently(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	testDatabase(t, Database{Prefix: "X", Series: []*Series{{Prefix: "A"}}})
+	mutex.Unlock()
+
+	sessionID := sessionGenId()
+	sessions[sessionID] = &Session{LoggedIn: true}
+	defer delete(sessions, sessionID)
+
+	const containers = 50
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			found := 0
+			for {
+				select {
+				case <-done:
+					errs <- nil
+					return
+				default:
+				}
+
+				// Containers only ever get added, each one inside the last.
+				seen := map[ContainerId]bool{}
+				result := dbSearchContainers("item", "")
+				for _, c := range result {
+					seen[c.Id] = true
+				}
+				for _, c := range result {
+					for _, id := range c.Path {
+						if !seen[id] {
+							errs <- fmt.Errorf("%s: %s is missing", c.Id, id)
+							return
+						}
+					}
+				}
+				if len(result) < found {
+					errs <- fmt.Errorf("%d containers found after %d",
+						len(result), found)
+					return
+				}
+				found = len(result)
+
+				// Also go through the whole request handling path.
+				r := httptest.NewRequest("GET", "/search?q=item", nil)
+				r.AddCookie(&http.Cookie{Name: "sessionid", Value: sessionID})
+				w := httptest.NewRecorder()
+				handle(w, r)
+				if w.Code != http.StatusOK {
+					errs <- fmt.Errorf("search failed with %d", w.Code)
+					return
+				}
+			}
+		}()
+	}
+
+	var parent ContainerId
+	for i := 0; i < containers; i++ {
+		mutex.Lock()
+		c := &Container{Series: "A", Parent: parent, Description: "item"}
+		err := dbContainerCreate(c)
+		if err == nil {
+			updated := *c
+			updated.Description = "item, updated"
+			err = dbContainerUpdate(c, updated)
+		}
+		mutex.Unlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent = c.Id()
+	}
+	close(done)
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+
+	if ids := searchIDs("updated", ""); len(ids) != containers {
+		t.Errorf("%d containers found, want %d", len(ids), containers)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dbPath = filepath.Join(t.TempDir(), "db.json")
+	data := []byte(`{"Prefix": "X"}`)
+	if err := os.WriteFile(dbPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// These sort before anything made today.
+	for _, old := range []string{"20000101-000000", "20000102-000000"} {
+		if err := os.WriteFile(dbPath+"."+old+".bak", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		keep    int
+		remains []string
+	}{
+		{3, []string{"20000101-000000", "20000102-000000", ""}},
+		{2, []string{"20000102-000000", ""}},
+		{1, []string{""}},
+	} {
+		if err := dbBackup(test.keep); err != nil {
+			t.Fatal(err)
+		}
+
+		backups, err := filepath.Glob(dbPath + ".*.bak")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(backups)
+		if len(backups) != len(test.remains) {
+			t.Fatalf("keep %d: got %q", test.keep, backups)
+		}
+		for i, old := range test.remains {
+			if old != "" && backups[i] != dbPath+"."+old+".bak" {
+				t.Errorf("keep %d: got %q", test.keep, backups)
+			}
+		}
+
+		// The newest backup needs to be an identical copy.
+		newest, err := os.ReadFile(backups[len(backups)-1])
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(newest, data) {
+			t.Errorf("keep %d: the backup differs: %q", test.keep, newest)
+		}
+	}
+}
+
+// testIndexes describes the indexes by container IDs, for comparisons.
+func testIndexes() map[string][]ContainerId {
+	result := map[string][]ContainerId{}
+	add := func(key string, containers []*Container) {
+		for _, c := range containers {
+			result[key] = append(result[key], c.Id())
+		}
+		sort.Slice(result[key], func(i, j int) bool {
+			return result[key][i] < result[key][j]
+		})
+	}
+	for prefix, members := range indexMembers {
+		add("members:"+prefix, members)
+	}
+	for parent, children := range indexChildren {
+		add("children:"+string(parent), children)
+	}
+	for id, c := range indexContainer {
+		if c.Id() != id {
+			result["mismatch"] = append(result["mismatch"], id)
+		}
+		add("all", []*Container{c})
+	}
+	return result
+}
+
+func TestContainerRemoveRecursive(t *testing.T) {
+	for _, test := range []struct {
+		remove  ContainerId
+		remains []ContainerId
+	}{
+		{"XA1", []ContainerId{"XB1"}},
+		{"XA2", []ContainerId{"XA1", "XB1"}},
+		{"XA3", []ContainerId{"XA1", "XA2", "XB1", "XB2"}},
+		{"XB1", []ContainerId{"XA1", "XA2", "XA3", "XB2"}},
+	} {
+		// XA1 contains XA2, which contains XA3 and XB2.
+		testDatabase(t, Database{
+			Prefix: "X",
+			Series: []*Series{{Prefix: "A", Counter: 3},
+				{Prefix: "B", Counter: 2}},
+			Containers: []*Container{
+				{Series: "A", Number: 1},
+				{Series: "A", Number: 2, Parent: "XA1"},
+				{Series: "A", Number: 3, Parent: "XA2"},
+				{Series: "B", Number: 1},
+				{Series: "B", Number: 2, Parent: "XA2"},
+			},
+		})
+
+		if err := dbContainerRemoveRecursive(
+			indexContainer[test.remove]); err != nil {
+			t.Fatal(err)
+		}
+
+		// The indexes must be the same as if built from scratch.
+		indexes := testIndexes()
+		if err := dbReindex(); err != nil {
+			t.Fatal(err)
+		}
+		if rebuilt := testIndexes(); !reflect.DeepEqual(indexes, rebuilt) {
+			t.Errorf("%s: inconsistent indexes %v, want %v",
+				test.remove, indexes, rebuilt)
+		}
+
+		d := testCommitted(t)
+		var remains []ContainerId
+		for _, c := range d.Containers {
+			remains = append(remains, ContainerId(
+				d.Prefix+c.Series+strconv.FormatUint(uint64(c.Number), 10)))
+		}
+		sort.Slice(remains, func(i, j int) bool {
+			return remains[i] < remains[j]
+		})
+		if !reflect.DeepEqual(remains, test.remains) {
+			t.Errorf("%s: got %v, want %v", test.remove, remains, test.remains)
+		}
+		if d.Series[0].Counter != 3 || d.Series[1].Counter != 2 {
+			t.Errorf("%s: series counters have changed", test.remove)
+		}
+	}
+}
+
+// testContainers describes containers by their series, number and parent,
+// in a sorted list, for comparisons.
+func testContainers(containers []*Container) (result []string) {
+	for _, c := range containers {
+		result = append(result, c.Series+
+			strconv.FormatUint(uint64(c.Number), 10)+"<"+string(c.Parent))
+	}
+	sort.Strings(result)
+	return
+}
+
+func TestSeriesClone(t *testing.T) {
+	for _, test := range []struct {
+		prefix     string
+		containers bool
+		err        error
+		counter    uint
+		result     []string
+	}{
+		{"C", true, nil, 11, []string{
+			"A11<", "A1<", "A2<XA1", "A3<XB1", "B1<",
+			"C11<", "C1<", "C2<XC1", "C3<"}},
+		{"C", false, nil, 0, []string{
+			"A11<", "A1<", "A2<XA1", "A3<XB1", "B1<"}},
+		{"B", true, errSeriesAlreadyExists, 0, nil},
+		{"", false, errInvalidPrefix, 0, nil},
+		{"A1", true, errContainerAlreadyExists, 0, nil},
+	} {
+		// With the prefix A1, the clone of XA1 would collide with XA11.
+		testDatabase(t, Database{
+			Prefix: "X",
+			Series: []*Series{
+				{Prefix: "A", Counter: 11, Description: "Screws"},
+				{Prefix: "B", Counter: 1},
+			},
+			Containers: []*Container{
+				{Series: "A", Number: 1},
+				{Series: "A", Number: 2, Parent: "XA1"},
+				{Series: "A", Number: 3, Parent: "XB1"},
+				{Series: "A", Number: 11},
+				{Series: "B", Number: 1},
+			},
+		})
+		indexes := testIndexes()
+
+		err := dbSeriesClone(indexSeries["A"], test.prefix, test.containers)
+		if err != test.err {
+			t.Errorf("%+v: got %v", test, err)
+		}
+		if test.err != nil {
+			if len(db.Series) != 2 || len(db.Containers) != 5 {
+				t.Errorf("%+v: the database has changed", test)
+			}
+			if !reflect.DeepEqual(testIndexes(), indexes) {
+				t.Errorf("%+v: the indexes have changed", test)
+			}
+			continue
+		}
+
+		d := testCommitted(t)
+		if len(d.Series) != 3 || d.Series[2].Prefix != test.prefix ||
+			d.Series[2].Description != "Screws" ||
+			d.Series[2].Counter != test.counter {
+			t.Errorf("%+v: unexpected series %+v", test, d.Series)
+		}
+		if result := testContainers(d.Containers); !reflect.DeepEqual(
+			result, test.result) {
+			t.Errorf("%+v: got containers %v", test, result)
+		}
+
+		// The copy must be independent of the original.
+		indexSeries[test.prefix].Description = "Nails"
+		if indexSeries["A"].Description != "Screws" {
+			t.Errorf("%+v: the copy shares the original series", test)
+		}
+	}
+}
+
+func TestReparentChildren(t *testing.T) {
+	for _, test := range []struct {
+		from, to ContainerId
+		err      error
+		children []ContainerId
+	}{
+		{"XA1", "XB1", nil, []ContainerId{"XB2", "XA2", "XA3"}},
+		{"XA1", "", nil, []ContainerId{"XA1", "XB1", "XA2", "XA3"}},
+		{"XB1", "XA1", nil, []ContainerId{"XA2", "XA3", "XB2"}},
+		{"XA1", "XA1", nil, []ContainerId{"XA2", "XA3"}},
+		{"XA1", "XA2", errWouldContainItself, nil},
+		{"XA1", "XA4", errWouldContainItself, nil},
+		{"", "XB2", errWouldContainItself, nil},
+		{"XA1", "XC1", errNoSuchContainer, nil},
+	} {
+		// XA1 contains XA2 and XA3, XA2 contains XA4, XB1 contains XB2.
+		testDatabase(t, Database{
+			Prefix: "X",
+			Series: []*Series{{Prefix: "A", Counter: 4},
+				{Prefix: "B", Counter: 2}},
+			Containers: []*Container{
+				{Series: "A", Number: 1},
+				{Series: "A", Number: 2, Parent: "XA1"},
+				{Series: "A", Number: 3, Parent: "XA1"},
+				{Series: "A", Number: 4, Parent: "XA2"},
+				{Series: "B", Number: 1},
+				{Series: "B", Number: 2, Parent: "XB1"},
+			},
+		})
+		indexes := testIndexes()
+
+		err := dbReparentChildren(test.from, test.to)
+		if err != test.err {
+			t.Errorf("%s -> %s: got %v, want %v",
+				test.from, test.to, err, test.err)
+		}
+		if err != nil {
+			if !reflect.DeepEqual(testIndexes(), indexes) {
+				t.Errorf("%s -> %s: the indexes have changed",
+					test.from, test.to)
+			}
+			continue
+		}
+
+		var children []ContainerId
+		for _, c := range indexChildren[test.to] {
+			children = append(children, c.Id())
+		}
+		if !reflect.DeepEqual(children, test.children) {
+			t.Errorf("%s -> %s: got %v, want %v",
+				test.from, test.to, children, test.children)
+		}
+		if test.from != test.to && len(indexChildren[test.from]) > 0 {
+			t.Errorf("%s -> %s: children remain", test.from, test.to)
+		}
+
+		// Whatever has been moved must have been committed.
+		if test.from == test.to {
+			continue
+		}
+		d := testCommitted(t)
+		for _, c := range d.Containers {
+			id := ContainerId(
+				d.Prefix + c.Series + strconv.FormatUint(uint64(c.Number), 10))
+			if c.Parent == test.from && id != test.to {
+				t.Errorf("%s -> %s: %s has not been moved",
+					test.from, test.to, id)
+			}
+		}
+	}
+}
+
+func TestLoadUnversioned(t *testing.T) {
+	font, err := filepath.Abs("../../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		version string
+		err     bool
+	}{
+		{"", false},
+		{`"Version": 0,`, false},
+		{`"Version": 1,`, false},
+		{`"Version": 2,`, true},
+		{`"Version": -1,`, true},
+	} {
+		dbPath = filepath.Join(t.TempDir(), "db.json")
+		data := []byte(`{` + test.version + `"Prefix": "X", "BDFPath": ` +
+			strconv.Quote(font) + `, "Series": [{"Prefix": "A", "Counter": 1}],
+			"Containers": [{"Series": "A", "Number": 1,
+				"Description": "Screws"}]}`)
+		if err := os.WriteFile(dbPath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		db = Database{}
+		err := loadDatabase()
+		if dbLog != nil {
+			dbLog.Close()
+			dbLog = nil
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: unsupported version accepted", test.version)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %s", test.version, err)
+		}
+		if db.Version != dbVersion {
+			t.Errorf("%q: got version %d", test.version, db.Version)
+		}
+
+		// The data must survive, now with the current version.
+		if dbLog, err = os.Create(dbPath + ".log"); err != nil {
+			t.Fatal(err)
+		}
+		err = dbCommit()
+		dbLog.Close()
+		dbLog = nil
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := testCommitted(t)
+		if d.Version != dbVersion {
+			t.Errorf("%q: committed version %d", test.version, d.Version)
+		}
+		if len(d.Containers) != 1 || d.Containers[0].Description != "Screws" ||
+			len(d.Series) != 1 || d.Series[0].Counter != 1 {
+			t.Errorf("%q: got %+v", test.version, d)
+		}
+	}
+}
+
+func TestNumberWidth(t *testing.T) {
+	// XA7 contains XA12, XB1 contains XA7.
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A", Counter: 12},
+			{Prefix: "B", Counter: 1}},
+		Containers: []*Container{
+			{Series: "A", Number: 7, Parent: "XB1"},
+			{Series: "A", Number: 12, Parent: "XA7"},
+			{Series: "B", Number: 1},
+		},
+	})
+
+	for _, test := range []struct {
+		width   int
+		ids     []ContainerId
+		parents []ContainerId
+	}{
+		{3, []ContainerId{"XA007", "XA012", "XB001"},
+			[]ContainerId{"XB001", "XA007", ""}},
+		{0, []ContainerId{"XA7", "XA12", "XB1"},
+			[]ContainerId{"XB1", "XA7", ""}},
+	} {
+		if err := dbSetNumberWidth(test.width); err != nil {
+			t.Fatal(err)
+		}
+		dbSnapshotUpdate()
+
+		for i, c := range db.Containers {
+			if c.Id() != test.ids[i] || c.Parent != test.parents[i] {
+				t.Errorf("width %d: got %s in %q, want %s in %q", test.width,
+					c.Id(), c.Parent, test.ids[i], test.parents[i])
+			}
+			if indexContainer[test.ids[i]] != c {
+				t.Errorf("width %d: %s is not indexed", test.width, c.Id())
+			}
+		}
+		if d := testCommitted(t); d.NumberWidth != test.width ||
+			d.Containers[0].Parent != test.parents[0] {
+			t.Errorf("width %d: not committed", test.width)
+		}
+
+		// Both padded and unpadded input must find the container.
+		for _, query := range []string{"XA7", "xa007", "XA0007"} {
+			if ids := searchIDs(query, ""); len(ids) == 0 ||
+				ids[0] != test.ids[0] {
+				t.Errorf("width %d: %q found %v", test.width, query, ids)
+			}
+		}
+	}
+
+	err := dbSetNumberWidth(maxNumberWidth + 1)
+	if err != errInvalidNumberWidth {
+		t.Errorf("excessive width: got %v", err)
+	}
+}
+
+func TestNumberWidthCollision(t *testing.T) {
+	// Without padding, XA11 would be both A11 and A1-1.
+	testDatabase(t, Database{
+		Prefix:      "X",
+		NumberWidth: 3,
+		Series: []*Series{{Prefix: "A", Counter: 11},
+			{Prefix: "A1", Counter: 1}},
+		Containers: []*Container{
+			{Series: "A", Number: 11},
+			{Series: "A1", Number: 1, Parent: "XA011"},
+		},
+	})
+	indexes := testIndexes()
+
+	if err := dbSetNumberWidth(0); err == nil {
+		t.Fatal("colliding IDs accepted")
+	}
+	if db.NumberWidth != 3 || db.Containers[1].Parent != "XA011" {
+		t.Errorf("not rolled back: width %d, parent %q",
+			db.NumberWidth, db.Containers[1].Parent)
+	}
+	if !reflect.DeepEqual(testIndexes(), indexes) {
+		t.Errorf("the indexes have changed")
+	}
+}
+
+func TestContainerCollision(t *testing.T) {
+	for _, width := range []int{0, 3} {
+		testDatabase(t, Database{
+			Prefix:      "X",
+			NumberWidth: width,
+			Series:      []*Series{{Prefix: "A", Counter: 11}},
+			Containers:  []*Container{{Series: "A", Number: 11}},
+		})
+
+		// A new series is fine by itself, XA1 is still free.
+		if err := dbSeriesCreate(&Series{Prefix: "A1"}); err != nil {
+			t.Fatalf("width %d: %s", width, err)
+		}
+
+		// Without padding, A1-1 would be the same XA11 as A11.
+		explicit := &Container{Series: "A1", Number: 1}
+		err := dbContainerCreate(explicit)
+		if width == 0 && err != errContainerAlreadyExists {
+			t.Errorf("width %d: explicit: got %v", width, err)
+		} else if width != 0 && err != nil {
+			t.Errorf("width %d: explicit: got %v", width, err)
+		}
+
+		// Automatic numbering must skip over taken IDs,
+		// which is XA11 without padding, and A1-1 itself with it.
+		automatic := &Container{Series: "A1"}
+		if err := dbContainerCreate(automatic); err != nil {
+			t.Fatalf("width %d: automatic: %s", width, err)
+		}
+		if automatic.Number != 2 {
+			t.Errorf("width %d: automatic: got %s", width, automatic.Id())
+		}
+
+		// Now XA12 is taken by A1-2 without padding, which A must skip.
+		next := &Container{Series: "A"}
+		if err := dbContainerCreate(next); err != nil {
+			t.Fatalf("width %d: next: %s", width, err)
+		}
+		if want := map[int]uint{0: 13, 3: 12}[width]; next.Number != want {
+			t.Errorf("width %d: next: got %s", width, next.Id())
+		}
+
+		if len(testIndexes()["mismatch"]) > 0 {
+			t.Errorf("width %d: inconsistent indexes", width)
+		}
+		if got := len(indexContainer); got != len(db.Containers) {
+			t.Errorf("width %d: %d IDs for %d containers",
+				width, got, len(db.Containers))
+		}
+	}
+}
+
+func TestContainerIsLeaf(t *testing.T) {
+	// XA1 contains XA2, which contains XA3.
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A", Counter: 4}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2, Parent: "XA1"},
+			{Series: "A", Number: 3, Parent: "XA2"},
+			{Series: "A", Number: 4},
+		},
+	})
+	for id, leaf := range map[ContainerId]bool{
+		"XA1": false, "XA2": false, "XA3": true, "XA4": true,
+	} {
+		if indexContainer[id].IsLeaf() != leaf {
+			t.Errorf("%s: leaf: %t", id, !leaf)
+		}
+	}
+
+	// Emptying a container makes it a leaf.
+	if err := dbContainerRemove(indexContainer["XA3"]); err != nil {
+		t.Fatal(err)
+	}
+	if !indexContainer["XA2"].IsLeaf() {
+		t.Errorf("XA2: not a leaf after removing its child")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// gzipAccepted checks whether the client is willing to receive gzip.
+func gzipAccepted(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(coding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); q == "q=0" || q == "q=0.0" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipCompressible tells whether it makes sense to compress content
+// of the given type. Images such as PNG are already compressed,
+// whereas JSON dumps of the inventory can get rather large.
+func gzipCompressible(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") ||
+		strings.HasPrefix(contentType, "image/svg+xml") ||
+		strings.HasPrefix(contentType, "application/json")
+}
+
+// gzipResponseWriter decides on compression once the headers are known
+// and there is a body to compress, so that empty responses stay empty.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	code        int
+	wroteHeader bool
+	sentHeader  bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.code = code
+}
+
+// sendHeader passes the status code on, having set up compression
+// if there is going to be a body worth compressing.
+func (w *gzipResponseWriter) sendHeader(body bool) {
+	if w.sentHeader {
+		return
+	}
+	w.sentHeader = true
+
+	// Redirects only carry a short note, if anything.
+	h := w.Header()
+	if body && w.code >= 200 && w.code < 300 &&
+		w.code != http.StatusNoContent &&
+		h.Get("Content-Encoding") == "" &&
+		gzipCompressible(h.Get("Content-Type")) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(w.code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	w.sendHeader(true)
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *gzipResponseWriter) close() error {
+	if w.wroteHeader {
+		w.sendHeader(false)
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
+
+func gzipWrap(inner func(http.ResponseWriter, *http.Request)) func(
+	http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !gzipAccepted(r) {
+			inner(w, r)
+			return
+		}
+
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		inner(gw, r)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGzipWrap(t *testing.T) {
+	html := []byte("<!DOCTYPE html><p>Hello, world!</p>")
+	for _, test := range []struct {
+		name       string
+		compressed bool
+		handler    func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"html", true, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(html)
+		}},
+		{"detected", true, func(w http.ResponseWriter, r *http.Request) {
+			w.Write(html)
+		}},
+		{"json", true, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"Id": "XA1", "Children": []}]`))
+		}},
+		{"png", false, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG\r\n\x1a\n"))
+		}},
+		{"zip", false, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/zip")
+			w.Write([]byte("PK\x03\x04"))
+		}},
+		{"redirect", false, func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/container?id=XA1", http.StatusSeeOther)
+		}},
+		{"empty", false, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(http.StatusOK)
+		}},
+		{"nothing", false, func(w http.ResponseWriter, r *http.Request) {}},
+	} {
+		plain := httptest.NewRecorder()
+		test.handler(plain, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip, deflate")
+		w := httptest.NewRecorder()
+		gzipWrap(test.handler)(w, r)
+
+		if w.Code != plain.Code {
+			t.Errorf("%s: got status %d, want %d",
+				test.name, w.Code, plain.Code)
+		}
+		if location := w.Header().Get("Location"); location !=
+			plain.Header().Get("Location") {
+			t.Errorf("%s: got location %q", test.name, location)
+		}
+
+		body := w.Body.Bytes()
+		encoding := w.Header().Get("Content-Encoding")
+		if !test.compressed {
+			if encoding != "" {
+				t.Errorf("%s: got encoding %q", test.name, encoding)
+			}
+			if !bytes.Equal(body, plain.Body.Bytes()) {
+				t.Errorf("%s: got body %q, want %q",
+					test.name, body, plain.Body.Bytes())
+			}
+			continue
+		}
+		if encoding != "gzip" {
+			t.Errorf("%s: got encoding %q", test.name, encoding)
+			continue
+		}
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if body, err = io.ReadAll(gz); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !bytes.Equal(body, plain.Body.Bytes()) {
+			t.Errorf("%s: got body %q, want %q",
+				test.name, body, plain.Body.Bytes())
+		}
+	}
+
+	// Clients that do not ask for gzip must not get it.
+	w := httptest.NewRecorder()
+	gzipWrap(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(html)
+	})(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		t.Errorf("unrequested encoding %q", encoding)
+	}
+	if !bytes.Equal(w.Body.Bytes(), html) {
+		t.Errorf("got body %q", w.Body.Bytes())
+	}
+}
+
+func TestGzipTreeJSON(t *testing.T) {
+	testDatabase(t, testTree)
+
+	r := testRequest(t, &Session{LoggedIn: true}, "GET", "/tree.json", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	gzipWrap(handleTreeJSON)(w, r)
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("got encoding %q", encoding)
+	}
+
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var roots []testTreeNode
+	if err := json.NewDecoder(gz).Decode(&roots); err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 2 {
+		t.Errorf("got %d roots", len(roots))
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// sourceLanguage is the language that user interface strings are written in.
+const sourceLanguage = "cs"
+
+// catalog translates user interface strings from the source language,
+// by language and then by the original string. Untranslated strings
+// are shown as they are.
+var catalog = map[string]map[string]string{
+	"en": {
+		"Obaly":                   "Containers",
+		"Řady":                    "Series",
+		"Strom":                   "Tree",
+		"Tisk":                    "Printing",
+		"Hledat":                  "Search",
+		"Odhlásit":                "Log out",
+		"Chyba":                   "Error",
+		"Nahoru":                  "Up",
+		"Obsahový list":           "Contents sheet",
+		"Štítek":                  "Label",
+		"Automaticky":             "Automatic",
+		"QR kód":                  "QR code",
+		"Text":                    "Text",
+		"Vytisknout štítek":       "Print label",
+		"Odstranit":               "Remove",
+		"Odstranit včetně obsahu": "Remove with contents",
+		"Pro potvrzení zadejte ID obalu": "Enter the container ID " +
+			"to confirm",
+		"Nadřazený obal":              "Parent container",
+		"Prázdné pro nejvyšší úroveň": "Empty for the top level",
+		"Přesunout obsah":             "Move contents",
+		"Popis obalu nebo jeho obsahu": "Description of the container " +
+			"or its contents",
+		"Řada":                  "Series",
+		"Nadobal":               "Parent",
+		"Druh":                  "Kind",
+		"Umístění":              "Location",
+		"Štítek potvrzen":       "Label confirmed",
+		"Uložit":                "Save",
+		"Podobaly":              "Subcontainers",
+		"Nový obal":             "New container",
+		"Jiný štítek":           "Other label",
+		"Obaly nejvyšší úrovně": "Top-level containers",
+		"Obal je prázdný.":      "The container is empty.",
+		"Kompaktní výpis":       "Compact listing",
+		"Podrobný výpis":        "Detailed listing",
+		"podobalů: %d":          "subcontainers: %d",
+		"Strom obalů":           "Container tree",
+		"Nejsou žádné obaly.":   "There are no containers.",
+		"Text štítku, například název police": "Label text, " +
+			"such as the name of a shelf",
+		"Opravdu odstranit obal %s?": "Really remove container %s?",
+		"Opravdu odstranit obal %s včetně obsahu?": "Really remove " +
+			"container %s with its contents?",
+		"Obal byl vytvořen, ale štítek se nepodařilo vytisknout:": "The " +
+			"container has been created, but its label failed to print:",
+
+		"Tisk štítku":   "Label printing",
+		"Neznámý obal.": "Unknown container.",
+		"Náhled štítku": "Label preview",
+		"Zkontrolujte náhled štítku a potvrďte jeho tisk.": "Check the label " +
+			"preview and confirm printing it.",
+		"Potvrdit a vytisknout": "Confirm and print",
+		"Tisk selhal: %s":       "Printing has failed: %s",
+		"Tisk proběhl úspěšně.": "Printing has succeeded.",
+
+		"Tisková fronta": "Print queue",
+		"Počet štítků čekajících na tisk: %d": "Labels waiting to be " +
+			"printed: %d",
+		"Zrušit":                     "Cancel",
+		"Na tisk nic nečeká.":        "Nothing is waiting to be printed.",
+		"Nevytištěné před restartem": "Not printed before a restart",
+		"Vytisknout":                 "Print",
+		"Zahodit":                    "Discard",
+		"Nedávno tištěné":            "Recently printed",
+		"tisk selhal: %s":            "printing has failed: %s",
+		"vytištěno":                  "printed",
+		"Vytisknout znovu":           "Print again",
+		"Nevytištěné štítky":         "Labels not printed",
+		"Přetisk štítků":             "Label reprinting",
+		"Přetisk štítků řady":        "Reprinting labels of series",
+		"Do tiskové fronty byly zařazeny štítky:": "Labels added to the " +
+			"print queue:",
+		"Řada neobsahuje žádné obaly.": "The series contains no containers.",
+
+		"Přihlášení":                   "Login",
+		"Heslo":                        "Password",
+		"Přihlásit":                    "Log in",
+		"Bylo zadáno nesprávné heslo.": "The password is incorrect.",
+		"Vyhledávání":                  "Search",
+		"všechny":                      "all",
+		"Filtrovat":                    "Filter",
+		"Neodpovídají žádné řady.":     "No series match.",
+		"Neodpovídají žádné obaly.":    "No containers match.",
+
+		"Neplatný prefix.": "Invalid prefix.",
+		"Řada s tímto prefixem už existuje.": "A series with this prefix " +
+			"already exists.",
+		"Prefix nelze měnit.": "The prefix cannot be changed.",
+		"Řada se používá.":    "The series is in use.",
+		"Řadu nelze sloučit samu se sebou.": "A series cannot be merged into " +
+			"itself.",
+		"Opravdu odstranit řadu %s?": "Really remove series %s?",
+		"Přetisknout všechny štítky": "Reprint all labels",
+		"Vyhradit obal a vytisknout štítek": "Reserve a container and print " +
+			"its label",
+		"Štítky v ZIP":         "Labels in a ZIP",
+		"Prefix kopie":         "Prefix of the copy",
+		"Včetně obalů":         "Including containers",
+		"Zkopírovat řadu":      "Copy series",
+		"Nová řada":            "New series",
+		"Prefix řady":          "Series prefix",
+		"Popis řady":           "Series description",
+		"Hned tisknout štítky": "Print labels immediately",
+		"Nejsou žádné řady.":   "There are no series.",
+		"Možné duplicity":      "Possible duplicates",
+		"Sloučit do %s":        "Merge into %s",
+		"Sloučit":              "Merge",
+		"Pro potvrzení zadejte prefix řady": "Retype the series prefix " +
+			"to confirm",
+		"Opravdu sloučit řadu %s do %s?": "Really merge series %s into %s?",
+
+		"Řada neexistuje.": "The series doesn't exist.",
+		"Obal s tímto ID už existuje.": "A container with this ID " +
+			"already exists.",
+		"Obal neexistuje.": "The container doesn't exist.",
+		"Řadu u neprázdných obalů nelze měnit.": "The series of " +
+			"non-empty containers cannot be changed.",
+		"Číslo obalu v řadě nelze měnit.": "The number of a container " +
+			"cannot be changed.",
+		"Obal by obsahoval sám sebe.": "The container would " +
+			"contain itself.",
+		"Obal se používá.": "The container is in use.",
+		"Odstranění včetně obsahu nebylo potvrzeno.": "Removal " +
+			"with contents has not been confirmed.",
+		"Sloučení řad nebylo potvrzeno.": "Merging series has not been " +
+			"confirmed.",
+	},
+}
+
+// pluralCatalog translates user interface strings that vary with a number,
+// by language and then by the original string, which is the singular form.
+// Forms are listed in the order in which pluralForm numbers them.
+var pluralCatalog = map[string]map[string][]string{
+	"cs": {
+		"%d obal": {"%d obal", "%d obaly", "%d obalů"},
+	},
+	"en": {
+		"%d obal": {"%d container", "%d containers"},
+	},
+}
+
+// pluralForm picks the plural form to use for n in the given language.
+func pluralForm(language string, n int) int {
+	switch language {
+	case "cs":
+		switch {
+		case n == 1:
+			return 0
+		case n >= 2 && n <= 4:
+			return 1
+		default:
+			return 2
+		}
+	default:
+		if n == 1 {
+			return 0
+		}
+		return 1
+	}
+}
+
+// translatePlural looks up the user interface string s, which contains
+// a number format verb, in the form for n in the given language,
+// and formats n into it.
+func translatePlural(language, s string, n int) string {
+	forms, ok := pluralCatalog[language][s]
+	if !ok {
+		language, forms = sourceLanguage, pluralCatalog[sourceLanguage][s]
+	}
+	if form := pluralForm(language, n); form < len(forms) {
+		s = forms[form]
+	}
+	return fmt.Sprintf(s, n)
+}
+
+// errorMessages describe errors of the database layer to users,
+// in the source language.
+var errorMessages = map[error]string{
+	errNoSuchSeries:               "Řada neexistuje.",
+	errContainerAlreadyExists:     "Obal s tímto ID už existuje.",
+	errNoSuchContainer:            "Obal neexistuje.",
+	errCannotChangeSeriesNotEmpty: "Řadu u neprázdných obalů nelze měnit.",
+	errCannotChangeNumber:         "Číslo obalu v řadě nelze měnit.",
+	errWouldContainItself:         "Obal by obsahoval sám sebe.",
+	errContainerInUse:             "Obal se používá.",
+	errRemovalNotConfirmed:        "Odstranění včetně obsahu nebylo potvrzeno.",
+	errMergeNotConfirmed:          "Sloučení řad nebylo potvrzeno.",
+}
+
+// translate looks up the user interface string s in the given language.
+func translate(language, s string) string {
+	if translated, ok := catalog[language][s]; ok {
+		return translated
+	}
+	return s
+}
+
+// languages lists all languages that the user interface can be shown in.
+func languages() []string {
+	result := []string{sourceLanguage}
+	for language := range catalog {
+		result = append(result, language)
+	}
+	return result
+}
+
+// languageFuncs returns template functions for the given language.
+func languageFuncs(language string) template.FuncMap {
+	return template.FuncMap{
+		"lang": func() string { return language },
+		"t": func(s string, args ...interface{}) string {
+			if len(args) == 0 {
+				return translate(language, s)
+			}
+			return fmt.Sprintf(translate(language, s), args...)
+		},
+		"tn": func(s string, n int) string {
+			return translatePlural(language, s, n)
+		},
+		"errorText": func(err error) string {
+			if message, ok := errorMessages[err]; ok {
+				return translate(language, message)
+			}
+			return err.Error()
+		},
+	}
+}
+
+// supportedLanguage reports whether the user interface can be shown
+// in the given language.
+func supportedLanguage(language string) bool {
+	_, ok := catalog[language]
+	return ok || language == sourceLanguage
+}
+
+// labelLanguage is the language of printed labels, which are shared by all.
+func labelLanguage() string {
+	if supportedLanguage(db.Language) {
+		return db.Language
+	}
+	return sourceLanguage
+}
+
+// negotiateLanguage picks the language most preferred by the client
+// that the user interface can be shown in, or the configured default.
+func negotiateLanguage(r *http.Request) string {
+	type preference struct {
+		language string
+		q        float64
+	}
+
+	var preferences []preference
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(part, ";")
+		p := preference{q: 1}
+		p.language = strings.ToLower(strings.TrimSpace(params[0]))
+		if i := strings.IndexByte(p.language, '-'); i >= 0 {
+			p.language = p.language[:i]
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				p.q, _ = strconv.ParseFloat(param[2:], 64)
+			}
+		}
+		if p.q > 0 && supportedLanguage(p.language) {
+			preferences = append(preferences, p)
+		}
+	}
+
+	sort.SliceStable(preferences, func(i, j int) bool {
+		return preferences[i].q > preferences[j].q
+	})
+	if len(preferences) > 0 {
+		return preferences[0].language
+	}
+	if supportedLanguage(db.Language) {
+		return db.Language
+	}
+	return sourceLanguage
+}
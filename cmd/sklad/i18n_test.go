@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTranslatePlural(t *testing.T) {
+	for _, test := range []struct {
+		language string
+		n        int
+		result   string
+	}{
+		{"cs", 0, "0 obalů"},
+		{"cs", 1, "1 obal"},
+		{"cs", 3, "3 obaly"},
+		{"cs", 5, "5 obalů"},
+		{"en", 1, "1 container"},
+		{"en", 2, "2 containers"},
+		{"xx", 2, "2 obaly"},
+	} {
+		if result := translatePlural(test.language, "%d obal",
+			test.n); result != test.result {
+			t.Errorf("%s, %d: got %q, want %q",
+				test.language, test.n, result, test.result)
+		}
+	}
+}
+
+func TestTemplateLanguages(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A"}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2},
+		},
+	})
+	for _, test := range []struct {
+		language string
+		contains []string
+	}{
+		{"cs", []string{`lang="cs"`, "Nová řada", "2 obaly"}},
+		{"en", []string{`lang="en"`, "New series", "2 containers"}},
+	} {
+		r := httptest.NewRequest("GET", "/series", nil)
+		r.Header.Set("Accept-Language", test.language)
+		w := httptest.NewRecorder()
+		handleSeries(w, r)
+		for _, s := range test.contains {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("%s: %q is missing", test.language, s)
+			}
+		}
+	}
+}
+
+func TestErrorMessagesTranslated(t *testing.T) {
+	for err, message := range errorMessages {
+		for language := range catalog {
+			if _, ok := catalog[language][message]; !ok {
+				t.Errorf("%s: %q is missing a translation", language, err)
+			}
+		}
+	}
+}
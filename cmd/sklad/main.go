@@ -1,13 +1,18 @@
 package main
 
 import (
+	"archive/zip"
 	"context"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
 	"html"
 	"html/template"
-	"io"
+	"image"
+	"image/png"
 	"log"
-	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,20 +20,33 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"janouch.name/sklad/imgutil"
 	"janouch.name/sklad/label"
+	"janouch.name/sklad/logutil"
 	"janouch.name/sklad/ql"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/qr"
 )
 
-var templates = map[string]*template.Template{}
+// templates contains parsed templates by language and then by name.
+var templates = map[string]map[string]*template.Template{}
+
+// executeTemplate renders a template in the language preferred by the client.
+func executeTemplate(name string, w http.ResponseWriter, r *http.Request,
+	data interface{}) {
+	language := negotiateLanguage(r)
+	t := templates[language][name]
 
-func executeTemplate(name string, w io.Writer, data interface{}) {
-	if err := templates[name].Execute(w, data); err != nil {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", language)
+	if err := t.Execute(w, data); err != nil {
 		panic(err)
 	}
 }
@@ -64,7 +82,7 @@ func handleLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	executeTemplate("login.tmpl", w, &params)
+	executeTemplate("login.tmpl", w, r, &params)
 }
 
 func handleLogout(w http.ResponseWriter, r *http.Request) {
@@ -78,19 +96,60 @@ func handleLogout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "login", http.StatusSeeOther)
 }
 
+// autoPrintError is returned when a container has been created,
+// but its label has failed to print.
+type autoPrintError struct {
+	container *Container
+	err       error
+}
+
+func (e *autoPrintError) Error() string { return e.err.Error() }
+func (e *autoPrintError) Unwrap() error { return e.err }
+
+// errConfirmRemoval is returned when a removal request lacks a valid token,
+// and the user needs to be asked whether they really mean it.
+var errConfirmRemoval = errors.New("removal needs to be confirmed")
+
+// errConfirmMerge is the errConfirmRemoval of merging series.
+var errConfirmMerge = errors.New("merge needs to be confirmed")
+
 func handleContainerPost(r *http.Request) error {
 	id := ContainerId(r.FormValue("id"))
 	description := strings.TrimSpace(r.FormValue("description"))
+	kind := strings.TrimSpace(r.FormValue("kind"))
+	location := strings.TrimSpace(r.FormValue("location"))
 	series := r.FormValue("series")
 	parent := ContainerId(strings.TrimSpace(r.FormValue("parent")))
 	_, remove := r.Form["remove"]
+	_, recursive := r.Form["recursive"]
+	into, reparent := r.Form["into"]
 
 	if container, ok := indexContainer[id]; ok {
-		if remove {
+		session := r.Context().Value(sessionContextKey{}).(*Session)
+		if reparent {
+			return dbReparentChildren(
+				container.Id(), ContainerId(strings.TrimSpace(into[0])))
+		} else if remove && recursive {
+			// Require the ID to be retyped, this is hard to undo.
+			if ContainerId(r.FormValue("confirm")) != container.Id() {
+				return errRemovalNotConfirmed
+			}
+			if !session.confirmRemoval(
+				"container:"+string(id), r.FormValue("token")) {
+				return errConfirmRemoval
+			}
+			return dbContainerRemoveRecursive(container)
+		} else if remove {
+			if !session.confirmRemoval(
+				"container:"+string(id), r.FormValue("token")) {
+				return errConfirmRemoval
+			}
 			return dbContainerRemove(container)
 		} else {
 			c := *container
 			c.Description = description
+			c.Kind = kind
+			c.Location = location
 			c.Series = series
 			c.Parent = parent
 			return dbContainerUpdate(container, c)
@@ -98,11 +157,22 @@ func handleContainerPost(r *http.Request) error {
 	} else if remove {
 		return errNoSuchContainer
 	} else {
-		return dbContainerCreate(&Container{
+		c := &Container{
 			Series:      series,
 			Parent:      parent,
 			Description: description,
-		})
+			Kind:        kind,
+			Location:    location,
+		}
+		if err := dbContainerCreate(c); err != nil {
+			return err
+		}
+		if indexSeries[c.Series].AutoPrintLabel {
+			if err := printLabel(c, ""); err != nil {
+				return &autoPrintError{container: c, err: err}
+			}
+		}
+		return nil
 	}
 }
 
@@ -114,6 +184,7 @@ func handleContainer(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var err error
+	var printErr *autoPrintError
 	if r.Method == http.MethodPost {
 		if err = handleContainerPost(r); err == nil {
 			redirect := r.URL.EscapedPath()
@@ -123,6 +194,11 @@ func handleContainer(w http.ResponseWriter, r *http.Request) {
 			http.Redirect(w, r, redirect, http.StatusSeeOther)
 			return
 		}
+
+		// The container exists now, so show it rather than the form.
+		if errors.As(err, &printErr) {
+			shownId = string(printErr.container.Id())
+		}
 	} else if r.Method != http.MethodGet {
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -142,12 +218,24 @@ func handleContainer(w http.ResponseWriter, r *http.Request) {
 		ErrorCannotChangeNumber         bool
 		ErrorWouldContainItself         bool
 		ErrorContainerInUse             bool
+		ErrorRemovalNotConfirmed        bool
+		ErrorAutoPrintFailed            bool
+		RemovalToken                    string
+		Removal                         *Container
+		RemovalRecursive                bool
+		RemovalContext                  string
 		Container                       *Container
+		Parent                          *Container
 		NewDescription                  *string
+		NewKind                         *string
+		NewLocation                     *string
 		NewSeries                       string
 		NewParent                       *string
 		Children                        []*Container
 		AllSeries                       map[string]string
+		AllKinds                        []string
+		DescriptionRunes                int
+		Compact                         bool
 	}{
 		Error:                           err,
 		ErrorNoSuchSeries:               err == errNoSuchSeries,
@@ -157,16 +245,37 @@ func handleContainer(w http.ResponseWriter, r *http.Request) {
 		ErrorCannotChangeNumber:         err == errCannotChangeNumber,
 		ErrorWouldContainItself:         err == errWouldContainItself,
 		ErrorContainerInUse:             err == errContainerInUse,
+		ErrorRemovalNotConfirmed:        err == errRemovalNotConfirmed,
+		ErrorAutoPrintFailed:            printErr != nil,
 		Children:                        indexChildren[""],
 		AllSeries:                       allSeries,
+		AllKinds:                        dbKinds(),
+		DescriptionRunes:                db.ListDescriptionRunes,
+	}
+	id := r.FormValue("id")
+	if c, ok := indexContainer[ContainerId(id)]; ok &&
+		err == errConfirmRemoval {
+		session := r.Context().Value(sessionContextKey{}).(*Session)
+		params.RemovalToken = session.removalToken("container:" + id)
+		params.Removal = c
+		_, params.RemovalRecursive = r.Form["recursive"]
+		params.RemovalContext = r.FormValue("context")
 	}
+	_, params.Compact = r.Form["compact"]
 	if c, ok := indexContainer[ContainerId(shownId)]; ok {
 		params.Children = c.Children()
 		params.Container = c
+		params.Parent = indexContainer[c.Parent]
 	}
 	if description, ok := r.Form["description"]; ok {
 		params.NewDescription = &description[0]
 	}
+	if kind, ok := r.Form["kind"]; ok {
+		params.NewKind = &kind[0]
+	}
+	if location, ok := r.Form["location"]; ok {
+		params.NewLocation = &location[0]
+	}
 	if series, ok := r.Form["series"]; ok {
 		// It seems impossible to dereference strings in text/template so that
 		// `eq` can be used, and we don't actually need a null value here.
@@ -176,39 +285,82 @@ func handleContainer(w http.ResponseWriter, r *http.Request) {
 		params.NewParent = &parent[0]
 	}
 
-	executeTemplate("container.tmpl", w, &params)
+	executeTemplate("container.tmpl", w, r, &params)
 }
 
 func handleSeriesPost(r *http.Request) error {
 	prefix := strings.TrimSpace(r.FormValue("prefix"))
 	description := strings.TrimSpace(r.FormValue("description"))
+	_, autoPrint := r.Form["autoprint"]
+	labelKind := r.FormValue("labelkind")
+	if labelKind != "" && labelKind != labelKindQR &&
+		labelKind != labelKindText {
+		return errUnknownLabelKind
+	}
 	_, remove := r.Form["remove"]
+	into, merge := r.Form["into"]
+	clone, cloning := r.Form["clone"]
+	_, cloneContainers := r.Form["containers"]
 
 	if series, ok := indexSeries[prefix]; ok {
-		if remove {
+		session := r.Context().Value(sessionContextKey{}).(*Session)
+		if cloning {
+			return dbSeriesClone(
+				series, strings.TrimSpace(clone[0]), cloneContainers)
+		} else if merge {
+			target, ok := indexSeries[into[0]]
+			if !ok {
+				return errNoSuchSeries
+			}
+			// Require the prefix to be retyped, this is hard to undo.
+			if r.FormValue("confirm") != series.Prefix {
+				return errMergeNotConfirmed
+			}
+			if !session.confirmRemoval("merge:"+series.Prefix+":"+
+				target.Prefix, r.FormValue("token")) {
+				return errConfirmMerge
+			}
+			return dbSeriesMerge(target, series)
+		} else if remove {
+			if !session.confirmRemoval(
+				"series:"+prefix, r.FormValue("token")) {
+				return errConfirmRemoval
+			}
 			return dbSeriesRemove(series)
 		} else {
 			s := *series
 			s.Description = description
+			s.AutoPrintLabel = autoPrint
+			s.LabelKind = labelKind
 			return dbSeriesUpdate(series, s)
 		}
 	} else if remove {
 		return errNoSuchSeries
 	} else {
 		return dbSeriesCreate(&Series{
-			Prefix:      prefix,
-			Description: description,
+			Prefix:         prefix,
+			Description:    description,
+			AutoPrintLabel: autoPrint,
+			LabelKind:      labelKind,
 		})
 	}
 }
 
 func handleSeries(w http.ResponseWriter, r *http.Request) {
 	var err error
+	var removal, merge, mergeInto *Series
 	if r.Method == http.MethodPost {
 		if err = handleSeriesPost(r); err == nil {
 			http.Redirect(w, r, r.URL.EscapedPath(), http.StatusSeeOther)
 			return
 		}
+		if err == errConfirmRemoval {
+			removal = indexSeries[strings.TrimSpace(r.FormValue("prefix"))]
+		}
+		if err == errConfirmMerge {
+			merge = indexSeries[strings.TrimSpace(r.FormValue("prefix"))]
+			mergeInto = indexSeries[r.FormValue("into")]
+		}
 		// XXX: This is rather ugly.
 		r.Form = url.Values{}
 	} else if r.Method != http.MethodGet {
@@ -232,28 +384,48 @@ func handleSeries(w http.ResponseWriter, r *http.Request) {
 	}
 
 	params := struct {
-		Error                    error
-		ErrorInvalidPrefix       bool
-		ErrorSeriesAlreadyExists bool
-		ErrorCannotChangePrefix  bool
-		ErrorNoSuchSeries        bool
-		ErrorSeriesInUse         bool
-		Prefix                   string
-		Description              string
-		AllSeries                map[string]*Series
+		Error                      error
+		ErrorInvalidPrefix         bool
+		ErrorSeriesAlreadyExists   bool
+		ErrorCannotChangePrefix    bool
+		ErrorNoSuchSeries          bool
+		ErrorSeriesInUse           bool
+		ErrorCannotMergeIntoItself bool
+		RemovalToken               string
+		Removal                    *Series
+		MergeToken                 string
+		Merge                      *Series
+		MergeInto                  *Series
+		Prefix                     string
+		Description                string
+		AllSeries                  map[string]*Series
+		Duplicates                 [][]*Series
 	}{
-		Error:                    err,
-		ErrorInvalidPrefix:       err == errInvalidPrefix,
-		ErrorSeriesAlreadyExists: err == errSeriesAlreadyExists,
-		ErrorCannotChangePrefix:  err == errCannotChangePrefix,
-		ErrorNoSuchSeries:        err == errNoSuchSeries,
-		ErrorSeriesInUse:         err == errSeriesInUse,
-		Prefix:                   prefix,
-		Description:              description,
-		AllSeries:                allSeries,
+		Error:                      err,
+		ErrorInvalidPrefix:         err == errInvalidPrefix,
+		ErrorSeriesAlreadyExists:   err == errSeriesAlreadyExists,
+		ErrorCannotChangePrefix:    err == errCannotChangePrefix,
+		ErrorNoSuchSeries:          err == errNoSuchSeries,
+		ErrorSeriesInUse:           err == errSeriesInUse,
+		ErrorCannotMergeIntoItself: err == errCannotMergeIntoItself,
+		Prefix:                     prefix,
+		Description:                description,
+		AllSeries:                  allSeries,
+		Duplicates:                 dbSeriesDuplicates(),
+	}
+	if removal != nil {
+		session := r.Context().Value(sessionContextKey{}).(*Session)
+		params.RemovalToken = session.removalToken("series:" + removal.Prefix)
+		params.Removal = removal
+	}
+	if merge != nil && mergeInto != nil {
+		session := r.Context().Value(sessionContextKey{}).(*Session)
+		params.MergeToken = session.removalToken(
+			"merge:" + merge.Prefix + ":" + mergeInto.Prefix)
+		params.Merge, params.MergeInto = merge, mergeInto
 	}
 
-	executeTemplate("series.tmpl", w, &params)
+	executeTemplate("series.tmpl", w, r, &params)
 }
 
 func handleSearch(w http.ResponseWriter, r *http.Request) {
@@ -262,54 +434,288 @@ func handleSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := r.FormValue("q")
+	query, kind := r.FormValue("q"), r.FormValue("kind")
 	params := struct {
 		Query      string
+		Kind       string
+		AllKinds   []string
 		Series     []*Series
-		Containers []*Container
+		Containers []*searchContainer
 	}{
 		Query:      query,
+		Kind:       kind,
+		AllKinds:   dbSearchKinds(),
 		Series:     dbSearchSeries(query),
-		Containers: dbSearchContainers(query),
+		Containers: dbSearchContainers(query, kind),
+	}
+
+	executeTemplate("search.tmpl", w, r, &params)
+}
+
+// Kinds of labels that can be printed for containers.
+const (
+	labelKindQR   = "qr"   // the ID as a QR code along with text, rotated
+	labelKindText = "text" // the ID and the description as horizontal text
+)
+
+var errUnknownLabelKind = errors.New("unknown label kind")
+
+// defaultLabelKind picks the kind of label that suits the media best:
+// horizontal text for wide media, and QR codes for narrow or squarish ones.
+func defaultLabelKind(mediaInfo *ql.MediaInfo) string {
+	switch {
+	case mediaInfo.Round:
+		return labelKindQR
+	case mediaInfo.PrintAreaLength == 0:
+		// That is, continuous tape at least about 35 mm wide.
+		if mediaInfo.PrintAreaPins >= 400 {
+			return labelKindText
+		}
+		return labelKindQR
+	case mediaInfo.PrintAreaPins > mediaInfo.PrintAreaLength*3/2:
+		return labelKindText
+	default:
+		return labelKindQR
+	}
+}
+
+// labelFrameThickness is the width of the optional frame around labels.
+const labelFrameThickness = 2
+
+// genTextLabel renders a label of the given kind for arbitrary text,
+// with an optional footer. Unless specified, the kind is determined
+// by the media.
+func genTextLabel(text, kind, footer string,
+	mediaInfo *ql.MediaInfo) (image.Image, error) {
+	if kind == "" {
+		kind = defaultLabelKind(mediaInfo)
+	}
+
+	// Make space for the frame, and keep it out of the QR code's quiet zone.
+	pins, padding := label.InscribedPins(mediaInfo), labelFrameThickness
+	qrOpts := label.DefaultQRLabelOptions
+	qrOpts.QRRatio = db.QRRatio
+	if kind == labelKindQR {
+		quietZone := label.QRQuietZone(
+			labelFont, text, pins, db.BDFScale, &qrOpts)
+		if quietZone > padding {
+			padding = quietZone
+		}
+	}
+	framed := db.LabelFrame && pins > 4*(labelFrameThickness+padding)
+	if framed {
+		pins -= 2 * (labelFrameThickness + padding)
 	}
 
-	executeTemplate("search.tmpl", w, &params)
+	var img image.Image
+	switch kind {
+	case labelKindQR:
+		qrImg, err := label.GenLabelForHeight(labelFont, text,
+			pins, db.BDFScale, &qrOpts)
+		if err != nil {
+			return nil, err
+		}
+		img = label.Orient(qrImg, mediaInfo, label.OrientAlong)
+	case labelKindText:
+		img = label.GenLabelForWidth(labelFont, text, pins, db.BDFScale)
+	default:
+		return nil, errUnknownLabelKind
+	}
+
+	if footer != "" {
+		img = label.AddFooter(labelFont, img, footer, db.BDFScale)
+	}
+	if framed {
+		img = label.AddFrame(img, labelFrameThickness, padding)
+	}
+	return img, nil
 }
 
-func printLabel(id string) error {
-	printer, err := ql.Open()
+// genLabel renders a label of the given kind for the container.
+// Unless specified, the kind is taken from the container's series,
+// or determined by the media.
+func genLabel(c *Container, kind string,
+	mediaInfo *ql.MediaInfo) (image.Image, error) {
+	if kind == "" {
+		kind = indexSeries[c.Series].LabelKind
+	}
+	if kind == "" {
+		kind = defaultLabelKind(mediaInfo)
+	}
+
+	// Descriptions may be approximate, but the ID must be right.
+	text := string(c.Id())
+	if err := label.CheckGlyphs(labelFont, text); err != nil {
+		return nil, err
+	}
+	if kind == labelKindText && c.Description != "" {
+		text += "\n" + c.Description
+	}
+
+	var notes []string
+	if db.LabelLocation && c.Location != "" {
+		notes = append(notes, c.Location)
+	}
+	if count := len(c.Children()); db.LabelChildCount && count > 0 {
+		notes = append(notes,
+			translatePlural(labelLanguage(), "%d obal", count))
+	}
+	footer := strings.Join(notes, ", ")
+	img, err := genTextLabel(text, kind, footer, mediaInfo)
+	if err != nil || footer == "" {
+		return img, err
+	}
+
+	// Rather go without the notes than overflow die-cut labels.
+	if length := mediaInfo.Canvas().Dy(); length != 0 &&
+		img.Bounds().Dy() > length {
+		return genTextLabel(text, kind, "", mediaInfo)
+	}
+	return img, nil
+}
+
+// labelGenerator renders a label for the given media.
+type labelGenerator func(mediaInfo *ql.MediaInfo) (image.Image, error)
+
+// printLabelDryRun pretends to print a label, only logging what would be
+// printed, and possibly saving it as a PNG file.
+func printLabelDryRun(name string, gen labelGenerator) error {
+	img, err := gen(dbDefaultMedia())
 	if err != nil {
 		return err
 	}
+
+	bounds := img.Bounds()
+	logutil.Infof("dry run: would print a %dx%d label for %s",
+		bounds.Dx(), bounds.Dy(), name)
+	if *dryRunDir == "" {
+		return nil
+	}
+
+	return label.SavePNG(
+		filepath.Join(dataPath(*dryRunDir), name+".png"), img)
+}
+
+// archiveLabel keeps a timestamped copy of a printed label, if configured.
+// Failing to do so is not a reason not to print it.
+func archiveLabel(name string, img image.Image) {
+	if *archiveDir == "" {
+		return
+	}
+	if _, err := label.Archive(
+		dataPath(*archiveDir), name, img); err != nil {
+		logutil.Warnf("cannot archive label: %s", err)
+	}
+}
+
+// lastStatus is the last status packet received from any printer.
+var lastStatus *ql.Status
+
+// lastCounters describe communication with the printer during the last print.
+var lastCounters *ql.Counters
+
+// lastMedia returns the media in the printer as of lastStatus, if known.
+// Unlike openPrinter, it doesn't disturb the printer, which may be busy.
+func lastMedia() *ql.MediaInfo {
+	if lastStatus == nil {
+		return nil
+	}
+	return ql.GetMediaInfo(
+		lastStatus.MediaWidthMM(),
+		lastStatus.MediaLengthMM(),
+	)
+}
+
+// openPrinter finds a printer and retrieves information about its media.
+func openPrinter() (*ql.Printer, *ql.MediaInfo, error) {
+	var printer *ql.Printer
+	var err error
+	if db.PrinterPath != "" {
+		printer, err = ql.OpenPath(db.PrinterPath)
+	} else {
+		printer, err = ql.Open()
+	}
+	if err != nil {
+		return nil, nil, err
+	}
 	if printer == nil {
-		return errors.New("no suitable printer found")
+		return nil, nil, errors.New("no suitable printer found")
 	}
-	defer printer.Close()
 
-	/*
-		printer.StatusNotify = func(status *ql.Status) {
-			log.Printf("\x1b[1mreceived status\x1b[m\n%+v\n%s",
-				status[:], status)
-		}
-	*/
+	printer.StatusNotify = func(status *ql.Status) {
+		logutil.Debugf("\x1b[1mreceived status\x1b[m\n%+v\n%s",
+			status[:], status)
+		copied := *status
+		lastStatus = &copied
+	}
 
 	if err := printer.Initialize(); err != nil {
-		return err
+		printer.Close()
+		return nil, nil, err
 	}
 	if err := printer.UpdateStatus(); err != nil {
-		return err
+		printer.Close()
+		return nil, nil, err
 	}
 
+	status := printer.Status()
 	mediaInfo := ql.GetMediaInfo(
-		printer.LastStatus.MediaWidthMM(),
-		printer.LastStatus.MediaLengthMM(),
+		status.MediaWidthMM(),
+		status.MediaLengthMM(),
 	)
 	if mediaInfo == nil {
-		return errors.New("unknown media")
+		printer.Close()
+		return nil, nil, errors.New("unknown media")
 	}
+	return printer, mediaInfo, nil
+}
 
-	return printer.Print(&imgutil.LeftRotate{Image: label.GenLabelForHeight(
-		labelFont, id, mediaInfo.PrintAreaPins, db.BDFScale)}, false)
+// printOptions returns the options labels are printed with.
+func printOptions() *ql.PrintOptions {
+	opts := ql.DefaultPrintOptions
+	opts.MarginAdjust = db.MarginAdjust
+	opts.TearOffFeedDots = db.TearOffFeedDots
+	return &opts
+}
+
+// printGenerated prints a label made for the media in the printer,
+// the name is used for diagnostics. Attempts are recorded for reprinting.
+func printGenerated(name string, gen labelGenerator) (err error) {
+	defer func() { recordPrint(name, gen, err) }()
+	if *dryRun {
+		return printLabelDryRun(name, gen)
+	}
+
+	printer, mediaInfo, err := openPrinter()
+	if err != nil {
+		return err
+	}
+	defer printer.Close()
+
+	img, err := gen(mediaInfo)
+	if err != nil {
+		return err
+	}
+
+	bounds := img.Bounds()
+	logutil.Debugf("printing a %dx%d label for %s",
+		bounds.Dx(), bounds.Dy(), name)
+	archiveLabel(name, img)
+
+	err = printer.Print(img, printOptions())
+
+	counters := printer.Counters()
+	lastCounters = &counters
+	logutil.Debugf("%d bytes written, %d bytes read, %d status packets",
+		counters.BytesWritten, counters.BytesRead, counters.StatusPackets)
+	return err
+}
+
+func printLabel(c *Container, kind string) error {
+	return printGenerated(string(c.Id()),
+		func(mediaInfo *ql.MediaInfo) (image.Image, error) {
+			return genLabel(c, kind, mediaInfo)
+		})
 }
 
 func handleLabel(w http.ResponseWriter, r *http.Request) {
@@ -320,25 +726,394 @@ func handleLabel(w http.ResponseWriter, r *http.Request) {
 
 	params := struct {
 		Id        string
+		Kind      string
 		UnknownId bool
+		Preview   bool
 		Error     error
 	}{
-		Id: r.FormValue("id"),
+		Id:   r.FormValue("id"),
+		Kind: r.FormValue("kind"),
 	}
 
+	// With confirmation enabled, only print what the operator has seen.
+	_, confirmed := r.Form["confirm"]
 	if c := indexContainer[ContainerId(params.Id)]; c == nil {
 		params.UnknownId = true
+	} else if db.LabelConfirm && !confirmed {
+		params.Preview = true
 	} else {
-		params.Error = printLabel(params.Id)
+		params.Error = printLabel(c, params.Kind)
+		if params.Error == nil && db.LabelConfirm {
+			params.Error = dbContainerConfirmLabel(c)
+		}
 	}
 
-	executeTemplate("label.tmpl", w, &params)
+	executeTemplate("label.tmpl", w, r, &params)
+}
+
+// handleReserve creates an empty container in a series and prints its label,
+// for when labels need to precede knowing the contents. Its number is taken
+// under the global mutex, so nothing else can get it.
+func handleReserve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := struct {
+		Id        string
+		Kind      string
+		UnknownId bool
+		Preview   bool
+		Error     error
+	}{}
+
+	if series, ok := indexSeries[r.FormValue("prefix")]; !ok {
+		params.Error = errNoSuchSeries
+	} else {
+		c := &Container{Series: series.Prefix}
+		if params.Error = dbContainerCreate(c); params.Error == nil {
+			params.Id = string(c.Id())
+			params.Error = printLabel(c, "")
+		}
+	}
+
+	executeTemplate("label.tmpl", w, r, &params)
+}
+
+// containersByNumber returns containers of a series in their natural order.
+func containersByNumber(series *Series) []*Container {
+	containers := append([]*Container{}, series.Containers()...)
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].Number < containers[j].Number
+	})
+	return containers
+}
+
+// handleReprint prints labels for all containers within a series anew,
+// such as when their format has changed.
+func handleReprint(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := struct {
+		Prefix            string
+		ErrorNoSuchSeries bool
+		Queued            []ContainerId
+	}{
+		Prefix: r.FormValue("prefix"),
+	}
+
+	// There may be many labels, queue them so that they can be cancelled.
+	if series, ok := indexSeries[params.Prefix]; !ok {
+		params.ErrorNoSuchSeries = true
+	} else {
+		for _, c := range containersByNumber(series) {
+			queueContainerLabel(c, "")
+			params.Queued = append(params.Queued, c.Id())
+		}
+	}
+
+	executeTemplate("reprint.tmpl", w, r, &params)
+}
+
+// handleLabelsZIP bundles labels of all containers within a series
+// as PNG files in a ZIP archive, such as for a print shop. They are made
+// for the default media, and the archive is sent out as it's being made.
+func handleLabelsZIP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	series, ok := indexSeries[r.FormValue("prefix")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+series.Prefix+`.zip"`)
+
+	// The response has already begun, so failed labels can only be left out.
+	mediaInfo, zw := dbDefaultMedia(), zip.NewWriter(w)
+	for _, c := range containersByNumber(series) {
+		img, err := genLabel(c, "", mediaInfo)
+		if err != nil {
+			logutil.Errorf("%s: %s", c.Id(), err)
+			continue
+		}
+
+		// PNG is compressed already.
+		f, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     string(c.Id()) + ".png",
+			Method:   zip.Store,
+			Modified: time.Now(),
+		})
+		if err != nil {
+			logutil.Errorf("%s", err)
+			return
+		}
+		if err := png.Encode(f, img); err != nil {
+			logutil.Errorf("%s", err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		logutil.Errorf("%s", err)
+	}
+}
+
+var errEmptyLabel = errors.New("empty label")
+
+// handleLabelAdhoc prints a label with arbitrary text, unrelated to any
+// container, such as for marking shelves.
+func handleLabelAdhoc(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := struct {
+		Id        string
+		Kind      string
+		UnknownId bool
+		Preview   bool
+		Error     error
+	}{}
+
+	text, kind := strings.TrimSpace(r.FormValue("text")), r.FormValue("kind")
+	if text == "" {
+		params.Error = errEmptyLabel
+	} else {
+		params.Error = printGenerated("adhoc",
+			func(mediaInfo *ql.MediaInfo) (image.Image, error) {
+				return genTextLabel(text, kind, "", mediaInfo)
+			})
+	}
+
+	executeTemplate("label.tmpl", w, r, &params)
+}
+
+// A4 paper at the same resolution as the label printer, 300 dpi.
+const (
+	sheetWidth  = 2480
+	sheetHeight = 3508
+)
+
+func handleContents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := indexContainer[ContainerId(r.FormValue("id"))]
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var items []label.ContentsItem
+	var walk func(children []*Container, depth int)
+	walk = func(children []*Container, depth int) {
+		for _, child := range children {
+			items = append(items, label.ContentsItem{
+				Id:          string(child.Id()),
+				Description: child.Description,
+				Depth:       depth,
+			})
+			walk(child.Children(), depth+1)
+		}
+	}
+	walk(c.Children(), 0)
+
+	title := string(c.Id())
+	if c.Description != "" {
+		title += "  " + strings.SplitN(c.Description, "\n", 2)[0]
+	}
+
+	img := label.GenContentsSheet(labelFont, title, items,
+		sheetWidth, sheetHeight, db.BDFScale)
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="`+string(c.Id())+`.png"`)
+	if err := png.Encode(w, img); err != nil {
+		logutil.Errorf("%s", err)
+	}
+}
+
+// handleLabelImage renders a container's label without printing it.
+// The media last seen in the printer is used if possible, otherwise it falls
+// back to the configured default media. With "raster", it shows the label
+// the way the printer would receive it.
+func handleLabelImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := indexContainer[ContainerId(r.FormValue("id"))]
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	mediaInfo := lastMedia()
+	if mediaInfo == nil {
+		mediaInfo = dbDefaultMedia()
+	}
+
+	img, err := genLabel(c, r.FormValue("kind"), mediaInfo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Show exactly what the printer would receive, for debugging.
+	if _, ok := r.Form["raster"]; ok {
+		img = ql.RasterPreview(img, mediaInfo, printOptions())
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, img); err != nil {
+		logutil.Errorf("%s", err)
+	}
+}
+
+// Limits of the size of QR code images, in pixels.
+const (
+	minQRSize     = 64
+	maxQRSize     = 2048
+	defaultQRSize = 256
+)
+
+// handleContainerQR serves just the QR code of a container's ID,
+// for embedding in other documents.
+func handleContainerQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	c := indexContainer[ContainerId(r.FormValue("id"))]
+	if c == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	size := defaultQRSize
+	if s := r.FormValue("size"); s != "" {
+		var err error
+		if size, err = strconv.Atoi(s); err != nil ||
+			size < minQRSize || size > maxQRSize {
+			http.Error(w, fmt.Sprintf("size must be between %d and %d",
+				minQRSize, maxQRSize), http.StatusBadRequest)
+			return
+		}
+	}
+
+	code, err := qr.Encode(string(c.Id()), qr.H, qr.Auto)
+	if err == nil {
+		code, err = barcode.Scale(code, size, size)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	if err := png.Encode(w, code); err != nil {
+		logutil.Errorf("%s", err)
+	}
+}
+
+// handlePrinterRaw dumps the last known printer status in raw form,
+// as well as decoded, for diagnosing issues with particular models.
+// The printer isn't asked for a fresh status, as it may be busy printing.
+func handlePrinterRaw(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err := lastPrintError(); err != nil {
+		fmt.Fprintf(w, "error: %s\n\n", err)
+	}
+	if c := lastCounters; c != nil {
+		fmt.Fprintf(w, "last print: %d bytes written, %d bytes read,"+
+			" %d status packets\n\n",
+			c.BytesWritten, c.BytesRead, c.StatusPackets)
+	}
+	if lastStatus == nil {
+		fmt.Fprintln(w, "no status has been received yet")
+		return
+	}
+	fmt.Fprintf(w, "%s\n%s", hex.Dump(lastStatus[:]), lastStatus)
+}
+
+// handlePrinterJSON is a machine-readable counterpart to handlePrinterRaw.
+func handlePrinterJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	status := struct {
+		Error    string        // why the last print has failed, if it has
+		Media    *ql.MediaInfo // the loaded media, if known
+		Errors   []string      // errors in the last status packet
+		Counters *ql.Counters  // statistics of the last print
+	}{
+		Media:    lastMedia(),
+		Counters: lastCounters,
+	}
+
+	if err := lastPrintError(); err != nil {
+		status.Error = err.Error()
+	}
+	if lastStatus != nil {
+		status.Errors = lastStatus.Errors()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&status); err != nil {
+		logutil.Errorf("%s", err)
+	}
 }
 
 var mutex sync.Mutex
 
+var errRequestTooLarge = errors.New("request too large")
+
 func handle(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
+	// Don't let a single huge request exhaust all memory. Chunked requests
+	// are only rejected once they exceed the limit while being read.
+	if r.ContentLength > *maxRequestSize {
+		http.Error(w, errRequestTooLarge.Error(),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, *maxRequestSize)
+
+	// Webhook signatures cover the raw body, which ParseForm would consume.
+	if path.Base(r.URL.Path) == "print" &&
+		path.Base(path.Dir(r.URL.Path)) == "webhook" {
+		mutex.Lock()
+		defer mutex.Unlock()
+		handleWebhookPrint(w, r)
+		return
+	}
+
+	if err := r.ParseForm(); errors.As(err, new(*http.MaxBytesError)) {
+		http.Error(w, errRequestTooLarge.Error(),
+			http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -360,9 +1135,38 @@ func handle(w http.ResponseWriter, r *http.Request) {
 	case "series":
 		sessionWrap(handleSeries)(w, r)
 	case "search":
-		sessionWrap(handleSearch)(w, r)
+		// Only the session needs the lock, searches work on a snapshot.
+		sessionWrap(func(w http.ResponseWriter, r *http.Request) {
+			mutex.Unlock()
+			defer mutex.Lock()
+			handleSearch(w, r)
+		})(w, r)
 	case "label":
 		sessionWrap(handleLabel)(w, r)
+	case "adhoc":
+		sessionWrap(handleLabelAdhoc)(w, r)
+	case "reprint":
+		sessionWrap(handleReprint)(w, r)
+	case "reserve":
+		sessionWrap(handleReserve)(w, r)
+	case "labels.zip":
+		sessionWrap(handleLabelsZIP)(w, r)
+	case "raw":
+		sessionWrap(handlePrinterRaw)(w, r)
+	case "printer.json":
+		sessionWrap(handlePrinterJSON)(w, r)
+	case "queue":
+		sessionWrap(handleQueue)(w, r)
+	case "label.png":
+		sessionWrap(handleLabelImage)(w, r)
+	case "qr":
+		sessionWrap(handleContainerQR)(w, r)
+	case "contents":
+		sessionWrap(handleContents)(w, r)
+	case "tree":
+		sessionWrap(handleTree)(w, r)
+	case "tree.json":
+		sessionWrap(handleTreeJSON)(w, r)
 
 	case "":
 		http.Redirect(w, r, "container", http.StatusSeeOther)
@@ -371,6 +1175,19 @@ func handle(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// kindIcons maps well-known container kinds to icons.
+var kindIcons = map[string]string{
+	"box":     "📦",
+	"krabice": "📦",
+	"drawer":  "🗃",
+	"šuplík":  "🗃",
+	"zásuvka": "🗃",
+	"shelf":   "🗄",
+	"police":  "🗄",
+	"bag":     "👜",
+	"taška":   "👜",
+}
+
 var funcMap = template.FuncMap{
 	"max": func(i, j int) int {
 		if i > j {
@@ -378,9 +1195,31 @@ var funcMap = template.FuncMap{
 		}
 		return j
 	},
+	"kindIcon": func(kind string) string {
+		if icon, ok := kindIcons[strings.ToLower(kind)]; ok {
+			return icon
+		}
+		return "🏷"
+	},
+	"firstLine": func(s string) string {
+		return strings.TrimSpace(strings.SplitN(s, "\n", 2)[0])
+	},
 	"lines": func(s string) int {
 		return strings.Count(s, "\n") + 1
 	},
+	// The length is in runes, so that no character gets cut in half.
+	"truncate": func(runes int, s string) string {
+		if runes <= 0 {
+			return s
+		}
+		for i := range s {
+			if runes == 0 {
+				return s[:i]
+			}
+			runes--
+		}
+		return s
+	},
 	"highlight": func(highlight, s string) template.HTML {
 		b, last := strings.Builder{}, 0
 		for _, m := range regexp.MustCompile(
@@ -396,34 +1235,132 @@ var funcMap = template.FuncMap{
 	},
 }
 
+// loadTemplates (re)loads all HTML templates from the given directory,
+// each of them being combined with the base template.
+func loadTemplates(dir string) error {
+	m, err := filepath.Glob(filepath.Join(dir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+
+	// Templates are parsed for each language, so that they needn't be cloned
+	// for every request in order to switch their translation functions.
+	loaded := map[string]map[string]*template.Template{}
+	for _, language := range languages() {
+		loaded[language] = map[string]*template.Template{}
+		for _, path := range m {
+			t, err := template.New("base.tmpl").Funcs(funcMap).
+				Funcs(languageFuncs(language)).
+				ParseFiles(filepath.Join(dir, "base.tmpl"), path)
+			if err != nil {
+				return err
+			}
+			loaded[language][filepath.Base(path)] = t
+		}
+	}
+	templates = loaded
+	return nil
+}
+
+// Label printing may take a while, so the write timeout needs to be generous.
+var (
+	readTimeout = flag.Duration("read-timeout", 30*time.Second,
+		"maximum duration for reading a request")
+	writeTimeout = flag.Duration("write-timeout", 2*time.Minute,
+		"maximum duration for writing a response")
+	idleTimeout = flag.Duration("idle-timeout", 2*time.Minute,
+		"maximum duration to keep idle connections open")
+	maxRequestSize = flag.Int64("max-request-size", 1<<20,
+		"maximum size of request bodies in bytes")
+
+	dryRun = flag.Bool("dry-run", false,
+		"only log labels instead of printing them")
+	dryRunDir = flag.String("dry-run-dir", "",
+		"save labels not printed because of -dry-run to this directory")
+
+	archiveDir = flag.String("archive-dir", "",
+		"keep a copy of every printed label in this directory")
+	queueJournal = flag.String("queue-journal", "",
+		"persist queued container labels in this file across restarts")
+
+	backups = flag.Int("backups", 0,
+		"back up the database on start, keeping this many copies")
+	numberWidth = flag.Int("number-width", -1,
+		"change zero-padding of numbers in container IDs, and exit")
+
+	dataDir = flag.String("data", "",
+		"resolve templates, fonts, and other relative paths in this directory")
+)
+
+// dataPath resolves relative paths against the data directory, if set.
+func dataPath(path string) string {
+	if *dataDir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(*dataDir, path)
+}
+
+// newServer creates the HTTP server with timeouts as configured by flags.
+func newServer(address string) *http.Server {
+	return &http.Server{
+		Addr:         address,
+		ReadTimeout:  *readTimeout,
+		WriteTimeout: *writeTimeout,
+		IdleTimeout:  *idleTimeout,
+	}
+}
+
 func main() {
-	// Randomize the RNG for session string generation.
-	rand.Seed(time.Now().UnixNano())
+	flag.Var(&logutil.Default.Level, "log-level",
+		"minimum level of messages to log: debug, info, warn, or error")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(),
+			"Usage: %s [OPTION]... ADDRESS DATABASE-FILE\n", os.Args[0])
+		flag.PrintDefaults()
+	}
 
-	if len(os.Args) != 3 {
-		log.Fatalf("Usage: %s ADDRESS DATABASE-FILE\n", os.Args[0])
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(1)
 	}
 
 	var address string
-	address, dbPath = os.Args[1], os.Args[2]
+	address, dbPath = flag.Arg(0), dataPath(flag.Arg(1))
+
+	// Take a snapshot before anything has a chance to change,
+	// including the log, which gets opened along with the database.
+	if *backups > 0 {
+		if err := dbBackup(*backups); err != nil {
+			log.Fatalln(err)
+		}
+	}
 
 	// Load database.
 	if err := loadDatabase(); err != nil {
 		log.Fatalln(err)
 	}
-
-	// Load HTML templates from the current working directory.
-	m, err := filepath.Glob("*.tmpl")
-	if err != nil {
+	if err := queueLoad(); err != nil {
 		log.Fatalln(err)
 	}
-	for _, name := range m {
-		templates[name] = template.Must(template.New("base.tmpl").
-			Funcs(funcMap).ParseFiles("base.tmpl", name))
+
+	// Container IDs are used as references, they can't change arbitrarily.
+	if *numberWidth >= 0 {
+		if err := dbSetNumberWidth(*numberWidth); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	// Load HTML templates from the data or current working directory.
+	if err := loadTemplates(dataPath(".")); err != nil {
+		log.Fatalln(err)
 	}
 
-	http.HandleFunc("/", handle)
-	server := &http.Server{Addr: address}
+	go printWorker()
+
+	http.HandleFunc("/", gzipWrap(handle))
+	server := newServer(address)
 
 	sigs := make(chan os.Signal, 1)
 	errs := make(chan error, 1)
@@ -433,7 +1370,7 @@ func main() {
 	select {
 	case <-sigs:
 	case err := <-errs:
-		log.Println(err)
+		logutil.Errorf("%s", err)
 	}
 
 	// Wait for all HTTP goroutines to finish so that not even the database
@@ -0,0 +1,1578 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/imgutil"
+	"janouch.name/sklad/label"
+	"janouch.name/sklad/logutil"
+	"janouch.name/sklad/ql"
+
+	"github.com/boombuler/barcode/qr"
+)
+
+// testFont loads the font shared by tests as the label font.
+func testFont(t *testing.T) {
+	f, err := os.Open("../../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if labelFont, err = bdf.NewFromBDF(f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testRequest makes a form request the way handlers get it from sessionWrap.
+func testRequest(t *testing.T, session *Session,
+	method, target string, form url.Values) *http.Request {
+	r := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err := r.ParseForm(); err != nil {
+		t.Fatal(err)
+	}
+	return r.WithContext(
+		context.WithValue(r.Context(), sessionContextKey{}, session))
+}
+
+// TestDefaultMediaPreview renders labels the way they are previewed
+// without a printer, which must span the default media.
+func TestDefaultMediaPreview(t *testing.T) {
+	testFont(t)
+	for _, size := range []struct{ widthMM, lengthMM int }{
+		{0, 0}, {29, 0}, {62, 29}, {24, 24},
+	} {
+		testDatabase(t, Database{
+			Prefix:               "X",
+			BDFScale:             3,
+			DefaultMediaWidthMM:  size.widthMM,
+			DefaultMediaLengthMM: size.lengthMM,
+			Series:               []*Series{{Prefix: "A"}},
+			Containers: []*Container{
+				{Series: "A", Number: 1, Description: "Contents"},
+			},
+		})
+
+		mediaInfo := dbDefaultMedia()
+		if mediaInfo == nil {
+			t.Fatalf("%+v: no default media", size)
+		}
+		for _, kind := range []string{"", labelKindText, labelKindQR} {
+			img, err := genLabel(db.Containers[0], kind, mediaInfo)
+			if err != nil {
+				t.Errorf("%+v, %q: %s", size, kind, err)
+			} else if dx, pins := img.Bounds().Dx(),
+				label.InscribedPins(mediaInfo); dx != pins {
+				t.Errorf("%+v, %q: the label is %d pins wide, not %d",
+					size, kind, dx, pins)
+			}
+		}
+	}
+}
+
+// TestLabelImageMedia checks that previews are made for the media last seen
+// in the printer, without asking it.
+func TestLabelImageMedia(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:              "X",
+		BDFScale:            3,
+		DefaultMediaWidthMM: 62,
+		Series:              []*Series{{Prefix: "A"}},
+		Containers:          []*Container{{Series: "A", Number: 1}},
+	})
+	defer func() { lastStatus = nil }()
+
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		known             bool
+		mediaWidthMM      int
+	}{
+		{0, 0, false, 62},
+		{29, 0, true, 29},
+		{0, 0, true, 62},
+	} {
+		lastStatus = nil
+		if test.known {
+			lastStatus = new(ql.Status)
+			lastStatus[10], lastStatus[17] =
+				byte(test.widthMM), byte(test.lengthMM)
+		}
+
+		w := httptest.NewRecorder()
+		handleLabelImage(w, httptest.NewRequest("GET", "/label?id=XA1", nil))
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%+v: %s", test, err)
+		}
+		want := label.InscribedPins(ql.GetMediaInfo(test.mediaWidthMM, 0))
+		if dx := img.Bounds().Dx(); dx != want {
+			t.Errorf("%+v: the label is %d pins wide, not %d", test, dx, want)
+		}
+	}
+}
+
+func TestLabelImageRaster(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:       "X",
+		BDFScale:     3,
+		MarginAdjust: 5,
+		Series:       []*Series{{Prefix: "A"}},
+		Containers:   []*Container{{Series: "A", Number: 1}},
+	})
+
+	mediaInfo := dbDefaultMedia()
+	img, err := genLabel(indexContainer["XA1"], "", mediaInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := ql.DefaultPrintOptions
+	opts.MarginAdjust = 5
+	raster := ql.RasterPreview(img, mediaInfo, &opts)
+
+	for target, want := range map[string]image.Image{
+		"/label?id=XA1":        img,
+		"/label?id=XA1&raster": raster,
+	} {
+		w := httptest.NewRecorder()
+		handleLabelImage(w, testRequest(t, &Session{LoggedIn: true},
+			"GET", target, nil))
+		got, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %s", target, err)
+		}
+		if !sameImages(got, want) {
+			t.Errorf("%s: unexpected image of %v", target, got.Bounds())
+		}
+	}
+	if raster.Bounds().Dx() <= img.Bounds().Dx() {
+		t.Errorf("the raster doesn't span the print head")
+	}
+}
+
+func TestPrinterRaw(t *testing.T) {
+	defer func() { lastStatus, lastCounters, recentPrints = nil, nil, nil }()
+
+	status := new(ql.Status)
+	status[10] = 29
+	for _, test := range []struct {
+		name     string
+		status   *ql.Status
+		counters *ql.Counters
+		err      error
+		contains []string
+	}{
+		{"nothing known", nil, nil, nil,
+			[]string{"no status has been received yet"}},
+		{"status", status, &ql.Counters{BytesWritten: 1234}, nil,
+			[]string{"media width: 29 mm", "1234 bytes written"}},
+		{"failed print", nil, nil, errors.New("no suitable printer found"),
+			[]string{"error: no suitable printer found"}},
+	} {
+		lastStatus, lastCounters, recentPrints = test.status, test.counters, nil
+		recordPrint("XA1", nil, test.err)
+
+		w := httptest.NewRecorder()
+		handlePrinterRaw(w, httptest.NewRequest("GET", "/printer", nil))
+		for _, s := range test.contains {
+			if !strings.Contains(w.Body.String(), s) {
+				t.Errorf("%s: %q is missing", test.name, s)
+			}
+		}
+	}
+}
+
+func TestPrinterJSON(t *testing.T) {
+	defer func() { lastStatus, recentPrints = nil, nil }()
+
+	status := new(ql.Status)
+	status[8], status[10] = 0x01, 62
+	for _, test := range []struct {
+		name   string
+		status *ql.Status
+		err    error
+		media  string
+		errors []string
+	}{
+		{"nothing known", nil, nil, "", nil},
+		{"status", status, nil, "62 mm continuous tape", []string{"no media"}},
+		{"failed print", nil, errors.New("unknown media"), "", nil},
+	} {
+		lastStatus, recentPrints = test.status, nil
+		recordPrint("XA1", nil, test.err)
+
+		w := httptest.NewRecorder()
+		handlePrinterJSON(w, httptest.NewRequest("GET", "/printer.json", nil))
+
+		var result struct {
+			Error  string
+			Media  *struct{ Name string }
+			Errors []string
+		}
+		if err := json.NewDecoder(w.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if test.err != nil && result.Error != test.err.Error() ||
+			test.err == nil && result.Error != "" {
+			t.Errorf("%s: got error %q", test.name, result.Error)
+		}
+		media := ""
+		if result.Media != nil {
+			media = result.Media.Name
+		}
+		if media != test.media {
+			t.Errorf("%s: got media %q, want %q", test.name, media, test.media)
+		}
+		if !reflect.DeepEqual(result.Errors, test.errors) {
+			t.Errorf("%s: got errors %v, want %v",
+				test.name, result.Errors, test.errors)
+		}
+	}
+}
+
+func TestSeriesAutoPrint(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	for _, autoPrint := range []bool{false, true} {
+		testDatabase(t, Database{
+			Prefix: "X",
+			Series: []*Series{{Prefix: "A", AutoPrintLabel: autoPrint}},
+		})
+
+		w := httptest.NewRecorder()
+		handleSeries(w, httptest.NewRequest("GET", "/series", nil))
+		if checked := strings.Contains(w.Body.String(),
+			"checked"); checked != autoPrint {
+			t.Errorf("%t: the checkbox is checked: %t", autoPrint, checked)
+		}
+	}
+}
+
+// sameImages reports whether two images have the same bounds and pixels.
+func sameImages(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestLabelChildCount(t *testing.T) {
+	testFont(t)
+	mediaInfo := ql.GetMediaInfo(62, 0)
+	for _, test := range []struct {
+		language   string
+		childCount bool
+		children   int
+		footer     string
+	}{
+		{"", true, 1, "1 obal"},
+		{"cs", true, 3, "3 obaly"},
+		{"cs", true, 12, "12 obalů"},
+		{"en", true, 2, "2 containers"},
+		{"cs", true, 0, ""},
+		{"cs", false, 2, ""},
+	} {
+		d := Database{
+			Prefix:          "X",
+			BDFScale:        3,
+			Language:        test.language,
+			LabelChildCount: test.childCount,
+			Series:          []*Series{{Prefix: "A"}},
+			Containers:      []*Container{{Series: "A", Number: 1}},
+		}
+		for i := 0; i < test.children; i++ {
+			d.Containers = append(d.Containers, &Container{
+				Series: "A", Number: uint(i + 2), Parent: "XA1"})
+		}
+		testDatabase(t, d)
+
+		img, err := genLabel(indexContainer["XA1"], labelKindText, mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := genTextLabel("XA1", labelKindText, test.footer,
+			mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameImages(img, want) {
+			t.Errorf("%+v: the label doesn't have the expected footer", test)
+		}
+	}
+}
+
+// TestLabelNotesOverflow checks that notes are dropped from die-cut labels
+// that they would make overflow.
+func TestLabelNotesOverflow(t *testing.T) {
+	testFont(t)
+	mediaInfo := ql.GetMediaInfo(62, 29)
+	for _, test := range []struct {
+		lines int
+		notes bool
+	}{
+		{1, true},
+		{11, false},
+	} {
+		description := strings.Repeat("Contents\n", test.lines-1) + "Contents"
+		testDatabase(t, Database{
+			Prefix:        "X",
+			BDFScale:      3,
+			LabelLocation: true,
+			Series:        []*Series{{Prefix: "A"}},
+			Containers: []*Container{{Series: "A", Number: 1,
+				Description: description, Location: "Shelf"}},
+		})
+
+		text := "XA1\n" + description
+		img, err := genLabel(indexContainer["XA1"], labelKindText, mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withNotes, err := genTextLabel(text, labelKindText, "Shelf", mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		withoutNotes, err := genTextLabel(text, labelKindText, "", mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if overflows := withNotes.Bounds().Dy() >
+			mediaInfo.PrintAreaLength; overflows == test.notes {
+			t.Fatalf("%d lines: the test doesn't exercise the fallback",
+				test.lines)
+		}
+
+		want := withoutNotes
+		if test.notes {
+			want = withNotes
+		}
+		if !sameImages(img, want) {
+			t.Errorf("%d lines: notes present: %t", test.lines, !test.notes)
+		}
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	testDatabase(t, Database{Prefix: "X", WebhookSecret: "secret"})
+	limit := *maxRequestSize
+	*maxRequestSize = 100
+	defer func() { *maxRequestSize = limit }()
+
+	for _, test := range []struct {
+		path        string
+		contentType string
+		size        int
+		chunked     bool
+		tooLarge    bool
+	}{
+		{"/container", "application/x-www-form-urlencoded", 50, false, false},
+		{"/container", "application/x-www-form-urlencoded", 200, false, true},
+		{"/container", "application/x-www-form-urlencoded", 50, true, false},
+		{"/container", "application/x-www-form-urlencoded", 200, true, true},
+		{"/webhook/print", "application/json", 200, true, true},
+	} {
+		r := httptest.NewRequest("POST", test.path,
+			strings.NewReader("x="+strings.Repeat("x", test.size-2)))
+		r.Header.Set("Content-Type", test.contentType)
+		if test.chunked {
+			r.ContentLength = -1
+		}
+
+		w := httptest.NewRecorder()
+		handle(w, r)
+		if tooLarge := w.Code ==
+			http.StatusRequestEntityTooLarge; tooLarge != test.tooLarge {
+			t.Errorf("%+v: got status %d", test, w.Code)
+		}
+	}
+}
+
+func TestSeriesMerge(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A", Counter: 2}, {Prefix: "B", Counter: 2}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2},
+			{Series: "B", Number: 1},
+			{Series: "B", Number: 2, Parent: "XB1"},
+		},
+	})
+
+	session := &Session{LoggedIn: true}
+	for _, test := range []struct {
+		form url.Values
+		err  error
+	}{
+		{url.Values{"into": {"A"}}, errMergeNotConfirmed},
+		{url.Values{"into": {"A"}, "confirm": {"A"}}, errMergeNotConfirmed},
+		{url.Values{"into": {"A"}, "confirm": {"B"}}, errConfirmMerge},
+		{url.Values{"into": {"A"}, "confirm": {"B"}, "token": {"stale"}},
+			errConfirmMerge},
+		{url.Values{"into": {"C"}, "confirm": {"B"}}, errNoSuchSeries},
+	} {
+		r := testRequest(t, session, "POST", "/series?prefix=B", test.form)
+		if err := handleSeriesPost(r); err != test.err {
+			t.Errorf("%v: got %v, want %v", test.form, err, test.err)
+		}
+	}
+
+	// The confirmation form must carry the token that allows the merge.
+	w := httptest.NewRecorder()
+	handleSeries(w, testRequest(t, session, "POST", "/series?prefix=B",
+		url.Values{"into": {"A"}, "confirm": {"B"}}))
+	token := session.removals["merge:B:A"]
+	if token == "" || !strings.Contains(w.Body.String(), token) {
+		t.Fatal("no confirmation form with a token has been shown")
+	}
+
+	r := testRequest(t, session, "POST", "/series?prefix=B",
+		url.Values{"into": {"A"}, "confirm": {"B"}, "token": {token}})
+	if err := handleSeriesPost(r); err != nil {
+		t.Fatal(err)
+	}
+
+	d := testCommitted(t)
+	if len(d.Series) != 1 || d.Series[0].Prefix != "A" ||
+		d.Series[0].Counter != 4 {
+		t.Errorf("unexpected series after merging: %+v", d.Series)
+	}
+	var ids []string
+	for _, c := range d.Containers {
+		ids = append(ids, c.Series+strconv.FormatUint(uint64(c.Number), 10)+
+			"<"+string(c.Parent))
+	}
+	sort.Strings(ids)
+	if want := []string{"A1<", "A2<", "A3<", "A4<XA3"}; !reflect.DeepEqual(
+		ids, want) {
+		t.Errorf("got containers %v, want %v", ids, want)
+	}
+
+	// Tokens are single-use.
+	if session.confirmRemoval("merge:B:A", token) {
+		t.Error("the token has not been invalidated")
+	}
+}
+
+func TestContainerCreate(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, Database{Prefix: "X", Series: []*Series{{Prefix: "A"}}})
+
+	session := &Session{LoggedIn: true}
+	w := httptest.NewRecorder()
+	handleContainer(w, testRequest(t, session, "POST", "/container",
+		url.Values{"series": {"A"}, "description": {"Šroubky M3"},
+			"kind": {"krabička"}, "location": {"Sklep"}}))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("creation failed with status %d: %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	handleContainer(w, testRequest(t, session, "GET", "/container?id=XA1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d", w.Code)
+	}
+	for _, want := range []string{"XA1", "Šroubky M3", "krabička", "Sklep"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("the container page doesn't contain %q", want)
+		}
+	}
+
+	d := testCommitted(t)
+	if len(d.Containers) != 1 || d.Containers[0].Description != "Šroubky M3" {
+		t.Errorf("the container hasn't been committed: %+v", d.Containers)
+	}
+}
+
+func TestRemovalConfirmation(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A", Counter: 3}, {Prefix: "B"}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2, Parent: "XA1"},
+			{Series: "A", Number: 3},
+		},
+	})
+
+	// The steps go in order, successful removals affect later ones.
+	session := &Session{LoggedIn: true}
+	for _, test := range []struct {
+		target   string
+		form     url.Values
+		tokenFor string // the removal target to send a valid token of
+		err      error
+	}{
+		{"/container?id=XA3&remove", nil, "", errConfirmRemoval},
+		{"/container?id=XA3&remove", url.Values{"token": {"stale"}}, "",
+			errConfirmRemoval},
+		{"/container?id=XA3&remove", nil, "container:XA1", errConfirmRemoval},
+		{"/container?id=XA1&remove&recursive", nil, "container:XA1",
+			errRemovalNotConfirmed},
+		{"/container?id=XA1&remove&recursive", url.Values{"confirm": {"XA2"}},
+			"container:XA1", errRemovalNotConfirmed},
+		{"/container?id=XA1&remove&recursive", url.Values{"confirm": {"XA1"}},
+			"", errConfirmRemoval},
+		{"/container?id=XA1&remove&recursive", url.Values{"confirm": {"XA1"}},
+			"container:XA3", errConfirmRemoval},
+		{"/series?prefix=B&remove", nil, "series:A", errConfirmRemoval},
+
+		{"/container?id=XA3&remove", nil, "container:XA3", nil},
+		{"/container?id=XA1&remove&recursive", url.Values{"confirm": {"XA1"}},
+			"container:XA1", nil},
+		{"/series?prefix=B&remove", nil, "series:B", nil},
+	} {
+		form := url.Values{}
+		for key, values := range test.form {
+			form[key] = values
+		}
+		if test.tokenFor != "" {
+			form.Set("token", session.removalToken(test.tokenFor))
+		}
+
+		r := testRequest(t, session, "POST", test.target, form)
+		handlePost := handleContainerPost
+		if strings.HasPrefix(test.target, "/series") {
+			handlePost = handleSeriesPost
+		}
+		if err := handlePost(r); err != test.err {
+			t.Errorf("%s %v: got %v, want %v", test.target, form, err, test.err)
+		}
+	}
+
+	d := testCommitted(t)
+	if len(d.Series) != 1 || len(d.Containers) != 0 {
+		t.Errorf("unexpected database contents: %+v", d)
+	}
+}
+
+func TestLabelConfirm(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testFont(t)
+	*dryRun = true
+	defer func() { *dryRun = false }()
+
+	for _, test := range []struct {
+		labelConfirm bool
+		target       string
+		preview      bool
+		confirmed    bool
+	}{
+		{false, "/label?id=XA1", false, false},
+		{false, "/label?id=XA1&confirm", false, false},
+		{true, "/label?id=XA1", true, false},
+		{true, "/label?id=XA1&confirm", false, true},
+	} {
+		testDatabase(t, Database{
+			Prefix:       "X",
+			LabelConfirm: test.labelConfirm,
+			Series:       []*Series{{Prefix: "A", Counter: 1}},
+			Containers:   []*Container{{Series: "A", Number: 1}},
+		})
+		recentPrints = nil
+
+		before := time.Now()
+		w := httptest.NewRecorder()
+		handleLabel(w, testRequest(t, &Session{LoggedIn: true},
+			"POST", test.target, url.Values{"kind": {labelKindText}}))
+		after := time.Now()
+
+		preview := strings.Contains(w.Body.String(), "label.png?id=XA1")
+		if preview != test.preview {
+			t.Errorf("%+v: preview shown: %t", test, preview)
+		}
+		if printed := len(recentPrints) != 0; printed == test.preview {
+			t.Errorf("%+v: printed: %t", test, printed)
+		}
+
+		if !test.confirmed {
+			if indexContainer["XA1"].LabelConfirmed != nil {
+				t.Errorf("%+v: the label has been confirmed", test)
+			}
+			continue
+		}
+
+		// The timestamp needs to survive being committed.
+		c := testCommitted(t).Containers[0]
+		if c.LabelConfirmed == nil || c.LabelConfirmed.Before(
+			before) || c.LabelConfirmed.After(after) {
+			t.Errorf("%+v: unexpected confirmation time: %v",
+				test, c.LabelConfirmed)
+		}
+	}
+}
+
+func TestServerTimeouts(t *testing.T) {
+	defaults := []string{"read-timeout", "write-timeout", "idle-timeout"}
+	defer func() {
+		for _, name := range defaults {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+	}()
+
+	for _, test := range []struct {
+		args              []string
+		read, write, idle time.Duration
+	}{
+		{nil, 30 * time.Second, 2 * time.Minute, 2 * time.Minute},
+		{[]string{"-read-timeout", "5s", "-idle-timeout", "1m"},
+			5 * time.Second, 2 * time.Minute, time.Minute},
+		{[]string{"-write-timeout", "10m"},
+			30 * time.Second, 10 * time.Minute, 2 * time.Minute},
+	} {
+		for _, name := range defaults {
+			f := flag.Lookup(name)
+			f.Value.Set(f.DefValue)
+		}
+		if err := flag.CommandLine.Parse(test.args); err != nil {
+			t.Fatal(err)
+		}
+
+		s := newServer(":8080")
+		if s.Addr != ":8080" || s.ReadTimeout != test.read ||
+			s.WriteTimeout != test.write || s.IdleTimeout != test.idle {
+			t.Errorf("%v: got %v, %v, %v", test.args,
+				s.ReadTimeout, s.WriteTimeout, s.IdleTimeout)
+		}
+	}
+}
+
+func TestContainerUpLink(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A", Counter: 3}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2, Parent: "XA1"},
+			{Series: "A", Number: 3, Parent: "XA2"},
+		},
+	})
+
+	for _, test := range []struct {
+		id   string
+		link string
+	}{
+		{"XA3", `href="container\?id=XA2"`},
+		{"XA2", `href="container\?id=XA1"`},
+		{"XA1", `href="container"`},
+	} {
+		w := httptest.NewRecorder()
+		handleContainer(w, testRequest(t, &Session{LoggedIn: true},
+			"GET", "/container?id="+test.id, nil))
+		if !regexp.MustCompile(test.link + `\s+accesskey=u`).MatchString(
+			w.Body.String()) {
+			t.Errorf("%s: no up-link to %s", test.id, test.link)
+		}
+	}
+}
+
+func TestLabelKinds(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:     "X",
+		BDFScale:   2,
+		Series:     []*Series{{Prefix: "A", Counter: 1}},
+		Containers: []*Container{{Series: "A", Number: 1, Description: "Box"}},
+	})
+
+	c := indexContainer["XA1"]
+	for _, test := range []struct {
+		kind              string
+		widthMM, lengthMM int
+		rotated           bool
+	}{
+		{labelKindText, 62, 0, false},
+		{labelKindText, 62, 29, false},
+		{labelKindQR, 62, 0, true},
+		{labelKindQR, 62, 29, true},
+		{"", 62, 0, false},
+		{"", 29, 0, true},
+	} {
+		mediaInfo := ql.GetMediaInfo(test.widthMM, test.lengthMM)
+		img, err := genLabel(c, test.kind, mediaInfo)
+		if err != nil {
+			t.Errorf("%+v: %s", test, err)
+			continue
+		}
+
+		_, rotated := img.(*imgutil.LeftRotate)
+		if rotated != test.rotated {
+			t.Errorf("%+v: rotated: %t", test, rotated)
+		}
+		if !rotated && !sameImages(img, label.GenLabelForWidth(labelFont,
+			"XA1\nBox", mediaInfo.PrintAreaPins, 2)) {
+			t.Errorf("%+v: not a horizontal text label", test)
+		}
+	}
+
+	if _, err := genLabel(c, "barcode",
+		ql.GetMediaInfo(62, 0)); err != errUnknownLabelKind {
+		t.Errorf("unknown label kinds aren't rejected: %v", err)
+	}
+}
+
+func TestDefaultLabelKind(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		kind              string
+	}{
+		{62, 0, labelKindText},
+		{38, 0, labelKindText},
+		{29, 0, labelKindQR},
+		{12, 0, labelKindQR},
+		{62, 29, labelKindText},
+		{52, 29, labelKindText},
+		{23, 23, labelKindQR},
+		{24, 24, labelKindQR},
+		{58, 58, labelKindQR},
+		{29, 90, labelKindQR},
+		{62, 100, labelKindQR},
+	} {
+		mediaInfo := ql.GetMediaInfo(test.widthMM, test.lengthMM)
+		if kind := defaultLabelKind(mediaInfo); kind != test.kind {
+			t.Errorf("%dx%d: got %s, want %s",
+				test.widthMM, test.lengthMM, kind, test.kind)
+		}
+	}
+
+	// Series can override it, and requests can override series.
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:   "X",
+		BDFScale: 1,
+		Series: []*Series{{Prefix: "A", Counter: 1},
+			{Prefix: "B", Counter: 1, LabelKind: labelKindQR}},
+		Containers: []*Container{{Series: "A", Number: 1},
+			{Series: "B", Number: 1}},
+	})
+	mediaInfo := ql.GetMediaInfo(62, 0)
+	for _, test := range []struct {
+		id      ContainerId
+		kind    string
+		rotated bool
+	}{
+		{"XA1", "", false},
+		{"XA1", labelKindQR, true},
+		{"XB1", "", true},
+		{"XB1", labelKindText, false},
+	} {
+		img, err := genLabel(indexContainer[test.id], test.kind, mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, rotated := img.(*imgutil.LeftRotate); rotated != test.rotated {
+			t.Errorf("%s %q: rotated: %t", test.id, test.kind, rotated)
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testFont(t)
+	defer func() { *dryRun, *dryRunDir = false, "" }()
+
+	for _, test := range []struct {
+		dryRun bool
+		dir    string
+		ok     bool
+	}{
+		{true, "", true},
+		{true, t.TempDir(), true},
+		{false, "", false},
+	} {
+		// Any attempt at opening this printer fails.
+		testDatabase(t, Database{
+			Prefix:      "X",
+			BDFScale:    1,
+			PrinterPath: filepath.Join(t.TempDir(), "lp0"),
+			Series:      []*Series{{Prefix: "A", Counter: 1}},
+			Containers:  []*Container{{Series: "A", Number: 1}},
+		})
+		*dryRun, *dryRunDir = test.dryRun, test.dir
+
+		w := httptest.NewRecorder()
+		handleLabel(w, testRequest(t, &Session{LoggedIn: true},
+			"POST", "/label?id=XA1", nil))
+		if ok := strings.Contains(w.Body.String(),
+			"Tisk proběhl úspěšně."); ok != test.ok {
+			t.Errorf("%+v: printed successfully: %t", test, ok)
+		}
+
+		if test.dir != "" {
+			if _, err := os.Stat(filepath.Join(
+				test.dir, "XA1.png")); err != nil {
+				t.Errorf("%+v: %s", test, err)
+			}
+		}
+	}
+}
+
+// TestArchiveLabel checks that labels get archived, and that failing to do so
+// is only logged, as archiveLabel can't fail printing.
+func TestArchiveLabel(t *testing.T) {
+	b, logger := &bytes.Buffer{}, logutil.Default
+	logutil.Default = logutil.New(b, logutil.LevelInfo)
+	defer func() { logutil.Default, *archiveDir, *dataDir = logger, "", "" }()
+
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	*dataDir, *archiveDir = t.TempDir(), "archive"
+	if err := os.Mkdir(dataPath(*archiveDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	archiveLabel("XA1", img)
+	archiveLabel("XA1", img)
+	if m, _ := filepath.Glob(
+		filepath.Join(dataPath(*archiveDir), "XA1-*.png")); len(m) != 2 {
+		t.Errorf("got archived labels %v, want two", m)
+	}
+	if b.Len() != 0 {
+		t.Errorf("unexpected log output: %s", b)
+	}
+
+	*archiveDir = "nonexistent"
+	archiveLabel("XA1", img)
+	if !strings.Contains(b.String(), "cannot archive label") {
+		t.Errorf("the failure hasn't been logged: %q", b)
+	}
+}
+
+func TestReserve(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testFont(t)
+	defer func() { *dryRun, *dryRunDir, recentPrints = false, "", nil }()
+
+	for _, test := range []struct {
+		prefix   string
+		reserved ContainerId
+	}{
+		{"A", "XA2"},
+		{"B", ""},
+	} {
+		testDatabase(t, Database{
+			Prefix:     "X",
+			BDFScale:   1,
+			Series:     []*Series{{Prefix: "A", Counter: 1}},
+			Containers: []*Container{{Series: "A", Number: 1}},
+		})
+		*dryRun, *dryRunDir, recentPrints = true, t.TempDir(), nil
+
+		w := httptest.NewRecorder()
+		handleReserve(w, testRequest(t, &Session{LoggedIn: true},
+			"POST", "/reserve", url.Values{"prefix": {test.prefix}}))
+
+		if test.reserved == "" {
+			if len(db.Containers) != 1 || len(recentPrints) != 0 {
+				t.Errorf("%s: reserved something", test.prefix)
+			}
+			continue
+		}
+
+		// The reservation is an empty container within the series.
+		d, c := testCommitted(t), indexContainer[test.reserved]
+		if c == nil || len(d.Containers) != 2 || d.Series[0].Counter != 2 {
+			t.Fatalf("%s: %s has not been reserved",
+				test.prefix, test.reserved)
+		}
+		if c.Parent != "" || c.Description != "" || c.Kind != "" {
+			t.Errorf("%s: %s is not empty", test.prefix, test.reserved)
+		}
+
+		// Its label has been printed.
+		if len(recentPrints) != 1 || recentPrints[0].Name !=
+			string(test.reserved) || recentPrints[0].Error != nil {
+			t.Errorf("%s: no label has been printed", test.prefix)
+		}
+		if _, err := os.Stat(filepath.Join(
+			*dryRunDir, string(test.reserved)+".png")); err != nil {
+			t.Errorf("%s: %s", test.prefix, err)
+		}
+
+		// Subsequently created containers get other numbers.
+		next := &Container{Series: test.prefix}
+		if err := dbContainerCreate(next); err != nil {
+			t.Fatal(err)
+		}
+		if next.Id() == test.reserved {
+			t.Errorf("%s: %s has been reused", test.prefix, test.reserved)
+		}
+	}
+}
+
+func TestLabelsZIP(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:   "X",
+		BDFScale: 1,
+		Series: []*Series{{Prefix: "A", Counter: 10},
+			{Prefix: "B", Counter: 1}},
+		Containers: []*Container{
+			{Series: "A", Number: 10},
+			{Series: "A", Number: 2, Parent: "XA10"},
+			{Series: "B", Number: 1},
+			{Series: "A", Number: 1, Description: "Screws"},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	handleLabelsZIP(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/labels.zip?prefix=A", nil))
+	if w.Code != http.StatusOK ||
+		w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("got %d, %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	zr, err := zip.NewReader(
+		bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Entries go in the natural order, and contain the very same labels.
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("%s: %s", f.Name, err)
+		}
+
+		c := indexContainer[ContainerId(strings.TrimSuffix(f.Name, ".png"))]
+		if c == nil {
+			continue
+		}
+		if want, err := genLabel(c, "", dbDefaultMedia()); err != nil {
+			t.Fatal(err)
+		} else if !sameImages(img, want) {
+			t.Errorf("%s: the label differs", f.Name)
+		}
+	}
+	if want := []string{"XA1.png", "XA2.png", "XA10.png"}; !reflect.DeepEqual(
+		names, want) {
+		t.Errorf("got entries %v, want %v", names, want)
+	}
+
+	w = httptest.NewRecorder()
+	handleLabelsZIP(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/labels.zip?prefix=C", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown series: got %d", w.Code)
+	}
+}
+
+func TestListDescriptionRunes(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	const description = "Příliš žluťoučký kůň úpěl ďábelské ódy"
+	testDatabase(t, Database{
+		Prefix:               "X",
+		ListDescriptionRunes: 10,
+		Series:               []*Series{{Prefix: "A", Counter: 2}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2, Parent: "XA1", Description: description},
+		},
+	})
+
+	// In listings, the description is cut, yet it can be expanded.
+	w := httptest.NewRecorder()
+	handleContainer(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/container?id=XA1", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, "<summary>Příliš žlu&hellip;</summary>") {
+		t.Errorf("the listed description isn't cut at 10 characters")
+	}
+	if !strings.Contains(body, "<p>"+description) {
+		t.Errorf("the listed description cannot be expanded")
+	}
+
+	// The container's own page has it in full.
+	w = httptest.NewRecorder()
+	handleContainer(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/container?id=XA2", nil))
+	body = w.Body.String()
+	if strings.Contains(body, "<summary>") {
+		t.Errorf("the description is cut on the container's page")
+	}
+	if !strings.Contains(body, description) {
+		t.Errorf("the description is missing on the container's page")
+	}
+}
+
+func TestContainerCompact(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{{Prefix: "A", Counter: 5}},
+		Containers: []*Container{
+			{Series: "A", Number: 1},
+			{Series: "A", Number: 2, Parent: "XA1", Description: "Screws\nM4"},
+			{Series: "A", Number: 3, Parent: "XA1",
+				Description: strings.Repeat("ř", 100)},
+			{Series: "A", Number: 4, Parent: "XA1"},
+			{Series: "A", Number: 5, Parent: "XA2"},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	handleContainer(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/container?id=XA1&compact", nil))
+	body := w.Body.String()
+	if strings.Contains(body, "<h3>") {
+		t.Errorf("children are listed in full")
+	}
+
+	// Each child makes a single line, without any markup.
+	var lines []string
+	list := regexp.MustCompile(`(?s)<ul>\s*<li>(.*?)</ul>`).
+		FindStringSubmatch(body)
+	if list == nil {
+		t.Fatal("no list of children")
+	}
+	tag := regexp.MustCompile(`<[^>]*>`)
+	for _, item := range strings.Split(list[1], "<li>") {
+		lines = append(lines,
+			strings.Join(strings.Fields(tag.ReplaceAllString(item, "")), " "))
+	}
+	want := []string{
+		"📂 XA2 Screws (podobalů: 1)",
+		"📦 XA3 " + strings.Repeat("ř", 60) + "&hellip;",
+		"📦 XA4",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+	if !strings.Contains(body, `href="container?id=XA2&amp;compact"`) {
+		t.Errorf("links don't stay in compact mode")
+	}
+}
+
+func TestLabelMissingGlyphs(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:   "X",
+		BDFScale: 1,
+		Series: []*Series{{Prefix: "A", Counter: 1},
+			{Prefix: "Č", Counter: 1}},
+		Containers: []*Container{
+			{Series: "A", Number: 1, Description: "Šrouby"},
+			{Series: "Č", Number: 1, Description: "Screws"},
+		},
+	})
+
+	// Descriptions may be approximate, IDs must not.
+	mediaInfo := ql.GetMediaInfo(62, 0)
+	for _, kind := range []string{labelKindText, labelKindQR} {
+		if _, err := genLabel(
+			indexContainer["XA1"], kind, mediaInfo); err != nil {
+			t.Errorf("%s: %s", kind, err)
+		}
+		if img, err := genLabel(
+			indexContainer["XČ1"], kind, mediaInfo); err == nil {
+			t.Errorf("%s: an unrenderable ID has been accepted", kind)
+		} else if img != nil {
+			t.Errorf("%s: an image has been returned", kind)
+		}
+	}
+}
+
+func TestLabelAdhoc(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testFont(t)
+	defer func() { *dryRun, *dryRunDir, recentPrints = false, "", nil }()
+
+	for _, test := range []struct {
+		text, kind string
+		printed    bool
+	}{
+		{"Shelf 3", labelKindText, true},
+		{" Do not stack ", labelKindQR, true},
+		{" \n", "", false},
+	} {
+		testDatabase(t, Database{
+			Prefix:     "X",
+			BDFScale:   1,
+			Series:     []*Series{{Prefix: "A", Counter: 1}},
+			Containers: []*Container{{Series: "A", Number: 1}},
+		})
+		*dryRun, *dryRunDir, recentPrints = true, t.TempDir(), nil
+
+		w := httptest.NewRecorder()
+		handleLabelAdhoc(w, testRequest(t, &Session{LoggedIn: true},
+			"POST", "/adhoc", url.Values{
+				"text": {test.text}, "kind": {test.kind}}))
+
+		// Nothing may be added to the database, or even committed.
+		if len(db.Containers) != 1 || len(indexContainer) != 1 {
+			t.Errorf("%q: the database has changed", test.text)
+		}
+		if _, err := os.Stat(dbPath); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%q: the database has been committed", test.text)
+		}
+
+		if !test.printed {
+			if len(recentPrints) != 0 {
+				t.Errorf("%q: a label has been printed", test.text)
+			}
+			continue
+		}
+		if len(recentPrints) != 1 || recentPrints[0].Error != nil {
+			t.Fatalf("%q: no label has been printed", test.text)
+		}
+
+		f, err := os.Open(filepath.Join(
+			*dryRunDir, recentPrints[0].Name+".png"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := genTextLabel(strings.TrimSpace(test.text), test.kind,
+			"", dbDefaultMedia())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Rotated labels have their origin elsewhere, unlike PNG files.
+		var b bytes.Buffer
+		if err := png.Encode(&b, want); err != nil {
+			t.Fatal(err)
+		}
+		if want, err = png.Decode(&b); err != nil {
+			t.Fatal(err)
+		}
+		if !sameImages(img, want) {
+			t.Errorf("%q: the label doesn't have the text", test.text)
+		}
+	}
+}
+
+func TestReprint(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testFont(t)
+
+	// Keep the print worker, if any, away from the queue.
+	mutex.Lock()
+	defer mutex.Unlock()
+	defer func() { printQueue = nil }()
+
+	testDatabase(t, Database{
+		Prefix:   "X",
+		BDFScale: 1,
+		Series: []*Series{{Prefix: "A", Counter: 10},
+			{Prefix: "B", Counter: 1}},
+		Containers: []*Container{
+			{Series: "A", Number: 10},
+			{Series: "B", Number: 1},
+			{Series: "A", Number: 2, Parent: "XB1"},
+			{Series: "A", Number: 1},
+		},
+	})
+	printQueue = nil
+
+	w := httptest.NewRecorder()
+	handleReprint(w, testRequest(t, &Session{LoggedIn: true},
+		"POST", "/reprint", url.Values{"prefix": {"A"}}))
+
+	var queued []ContainerId
+	mediaInfo := dbDefaultMedia()
+	for _, job := range printQueue {
+		queued = append(queued, job.Id)
+		if job.Name != string(job.Id) {
+			t.Errorf("%s: named %s", job.Id, job.Name)
+		}
+
+		img, err := job.gen(mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, err := genLabel(
+			indexContainer[job.Id], "", mediaInfo); err != nil {
+			t.Fatal(err)
+		} else if !sameImages(img, want) {
+			t.Errorf("%s: the label differs", job.Id)
+		}
+	}
+	want := []ContainerId{"XA1", "XA2", "XA10"}
+	if !reflect.DeepEqual(queued, want) {
+		t.Errorf("got %v, want %v", queued, want)
+	}
+	for _, id := range want {
+		if !strings.Contains(w.Body.String(), string(id)) {
+			t.Errorf("%s is not reported", id)
+		}
+	}
+
+	printQueue = nil
+	w = httptest.NewRecorder()
+	handleReprint(w, testRequest(t, &Session{LoggedIn: true},
+		"POST", "/reprint", url.Values{"prefix": {"C"}}))
+	if len(printQueue) != 0 {
+		t.Errorf("labels of an unknown series have been queued")
+	}
+}
+
+// clearRing returns how many pixels wide the clear ring is just inside
+// a frame of the given thickness, around the contents of a label.
+func clearRing(img image.Image, thickness int) int {
+	bounds := img.Bounds().Inset(thickness)
+	for ring := 0; ring < bounds.Dx()/2 && ring < bounds.Dy()/2; ring++ {
+		r := bounds.Inset(ring)
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if imgutil.IsBlack(img, x, r.Min.Y) ||
+				imgutil.IsBlack(img, x, r.Max.Y-1) {
+				return ring
+			}
+		}
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			if imgutil.IsBlack(img, r.Min.X, y) ||
+				imgutil.IsBlack(img, r.Max.X-1, y) {
+				return ring
+			}
+		}
+	}
+	return -1
+}
+
+func TestLabelFrame(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:     "X",
+		BDFScale:   2,
+		LabelFrame: true,
+		Series:     []*Series{{Prefix: "A", Counter: 1}},
+		Containers: []*Container{{Series: "A", Number: 1, Description: "Box"}},
+	})
+
+	mediaInfo := ql.GetMediaInfo(62, 0)
+	for _, kind := range []string{labelKindText, labelKindQR} {
+		img, err := genLabel(indexContainer["XA1"], kind, mediaInfo)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The frame must go along all four edges.
+		bounds := img.Bounds()
+		for i := 0; i < labelFrameThickness; i++ {
+			r := bounds.Inset(i)
+			for x := r.Min.X; x < r.Max.X; x++ {
+				if !imgutil.IsBlack(img, x, r.Min.Y) ||
+					!imgutil.IsBlack(img, x, r.Max.Y-1) {
+					t.Fatalf("%s: the frame is interrupted at x=%d", kind, x)
+				}
+			}
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				if !imgutil.IsBlack(img, r.Min.X, y) ||
+					!imgutil.IsBlack(img, r.Max.X-1, y) {
+					t.Fatalf("%s: the frame is interrupted at y=%d", kind, y)
+				}
+			}
+		}
+
+		ring := clearRing(img, labelFrameThickness)
+		if ring < labelFrameThickness {
+			t.Errorf("%s: the frame touches the contents", kind)
+		}
+		if kind != labelKindQR {
+			continue
+		}
+
+		// QR codes need a quiet zone of four modules around them.
+		// The code is turned along the tape, which makes it as tall
+		// as the label is wide, minus the frame.
+		code, err := qr.Encode("XA1", qr.H, qr.Auto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layout := label.LayoutQRLabel(labelFont, "XA1",
+			label.InscribedPins(mediaInfo)-2*(labelFrameThickness+ring),
+			db.BDFScale, &label.DefaultQRLabelOptions)
+		module := layout.QR.Dx() / code.Bounds().Dx()
+		if module < 1 || ring < 4*module {
+			t.Errorf("%s: a quiet zone of %d, with %d-pixel modules",
+				kind, ring, module)
+		}
+	}
+}
+
+func TestContainerQR(t *testing.T) {
+	testDatabase(t, Database{
+		Prefix:     "X",
+		Series:     []*Series{{Prefix: "A", Counter: 1}},
+		Containers: []*Container{{Series: "A", Number: 1}},
+	})
+
+	code, err := qr.Encode("XA1", qr.H, qr.Auto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	modules := code.Bounds().Dx()
+
+	for _, test := range []struct {
+		query string
+		code  int
+		size  int
+	}{
+		{"id=XA1", http.StatusOK, defaultQRSize},
+		{"id=XA1&size=100", http.StatusOK, 100},
+		{"id=XA1&size=10", http.StatusBadRequest, 0},
+		{"id=XA1&size=100000", http.StatusBadRequest, 0},
+		{"id=XA1&size=x", http.StatusBadRequest, 0},
+		{"id=XA2", http.StatusNotFound, 0},
+	} {
+		w := httptest.NewRecorder()
+		handleContainerQR(w, testRequest(t, &Session{LoggedIn: true},
+			"GET", "/qr?"+test.query, nil))
+		if w.Code != test.code {
+			t.Errorf("%s: got status %d, want %d",
+				test.query, w.Code, test.code)
+		}
+		if test.code != http.StatusOK {
+			continue
+		}
+
+		img, err := png.Decode(w.Body)
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		if img.Bounds() != image.Rect(0, 0, test.size, test.size) {
+			t.Fatalf("%s: got bounds %v", test.query, img.Bounds())
+		}
+
+		// Check the middle of every module against the expected payload.
+		factor := test.size / modules
+		offset := (test.size - modules*factor) / 2
+		for my := 0; my < modules; my++ {
+			for mx := 0; mx < modules; mx++ {
+				x := offset + mx*factor + factor/2
+				y := offset + my*factor + factor/2
+				if imgutil.IsBlack(img, x, y) !=
+					imgutil.IsBlack(code, mx, my) {
+					t.Fatalf("%s: module %d, %d differs", test.query, mx, my)
+				}
+			}
+		}
+	}
+}
+
+func TestHTMLCharset(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, Database{
+		Prefix: "X",
+		Series: []*Series{
+			{Prefix: "A", Counter: 1, Description: "Šroubky a matičky"},
+		},
+		Containers: []*Container{
+			{Series: "A", Number: 1, Description: "Šroubky a matičky"},
+		},
+	})
+
+	// Non-ASCII descriptions must survive, the pages declare UTF-8.
+	for _, test := range []struct {
+		handler func(w http.ResponseWriter, r *http.Request)
+		target  string
+	}{
+		{handleContainer, "/container?id=XA1"},
+		{handleSeries, "/series?prefix=A"},
+		{handleSearch, "/search?q=XA1"},
+		{handleTree, "/tree"},
+	} {
+		w := httptest.NewRecorder()
+		test.handler(w, testRequest(t, &Session{LoggedIn: true},
+			"GET", test.target, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: got status %d", test.target, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct !=
+			"text/html; charset=utf-8" {
+			t.Errorf("%s: got Content-Type %q", test.target, ct)
+		}
+		if !strings.Contains(w.Body.String(), "Šroubky a matičky") {
+			t.Errorf("%s: the description is missing", test.target)
+		}
+	}
+}
+
+// TestDataDir runs through everything that touches files with relative paths,
+// which must all resolve within the data directory, not the working one.
+func TestDataDir(t *testing.T) {
+	templateFiles, err := filepath.Glob("*.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	font, err := os.ReadFile("../../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, cwd := t.TempDir(), t.TempDir()
+	for _, name := range templateFiles {
+		contents, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(
+			filepath.Join(data, name), contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, contents := range map[string]string{
+		"fonts/test.bdf": string(font),
+		"db.json": `{"Prefix": "X", "BDFPath": "fonts/test.bdf",
+			"Series": [{"Prefix": "A", "Counter": 1}],
+			"Containers": [{"Series": "A", "Number": 1}]}`,
+		"labels/.keep":  "",
+		"archive/.keep": "",
+	} {
+		path := filepath.Join(data, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(cwd); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	defer func() {
+		*dataDir, *dryRun, *dryRunDir = "", false, ""
+		*archiveDir, *queueJournal = "", ""
+		printQueue, printRestored = nil, nil
+		if dbLog != nil {
+			dbLog.Close()
+			dbLog = nil
+		}
+	}()
+
+	// This is the order in which main goes about it.
+	*dataDir, *dryRun, *dryRunDir = data, true, "labels"
+	*archiveDir, *queueJournal = "archive", "queue.json"
+	dbPath, labelFont, templates = dataPath("db.json"), nil, nil
+	if err := dbBackup(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queueLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadTemplates(dataPath(".")); err != nil {
+		t.Fatal(err)
+	}
+	if labelFont == nil ||
+		templates[languages()[0]]["container.tmpl"] == nil {
+		t.Fatal("the font or templates haven't been loaded")
+	}
+
+	db.Containers[0].Description = "Screws"
+	if err := dbCommit(); err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewGray(image.Rect(0, 0, 10, 10))
+	if err := printLabelDryRun("XA1", func(*ql.MediaInfo) (
+		image.Image, error) {
+		return img, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	archiveLabel("XA1", img)
+	printQueue = []*printJob{{Name: "XA1", Id: "XA1"}}
+	queueSave()
+
+	for _, pattern := range []string{
+		"db.json", "db.json.log", "db.json.*.bak",
+		"labels/XA1.png", "archive/XA1-*.png", "queue.json",
+	} {
+		if m, _ := filepath.Glob(filepath.Join(
+			data, filepath.FromSlash(pattern))); len(m) != 1 {
+			t.Errorf("%s: got %v", pattern, m)
+		}
+	}
+	if entries, err := os.ReadDir(cwd); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Errorf("files have been created in the working directory: %v",
+			entries)
+	}
+
+	// Absolute paths are kept.
+	if path := filepath.Join(cwd, "db.json"); dataPath(path) != path {
+		t.Errorf("%s: resolved to %s", path, dataPath(path))
+	}
+}
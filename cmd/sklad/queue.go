@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"image"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"janouch.name/sklad/logutil"
+	"janouch.name/sklad/ql"
+)
+
+// printJob is a label waiting in the print queue.
+type printJob struct {
+	Name  string      // what the label is for
+	Id    ContainerId // container to regenerate the label of, if any
+	Kind  string      // label kind, for Id
+	Error error       // why printing has failed, if it has
+	gen   labelGenerator
+}
+
+// maxPrintFailures limits how many failed jobs are kept around for display.
+const maxPrintFailures = 20
+
+// The print queue is guarded by the global mutex, like everything else.
+var (
+	printQueue    []*printJob // jobs waiting to be printed
+	printFailures []*printJob // most recent failed jobs, oldest first
+	printRestored []*printJob // jobs from the journal, awaiting a decision
+
+	// printWakeup signals printWorker that there is work to be done.
+	printWakeup = make(chan struct{}, 1)
+)
+
+func queueJob(job *printJob) {
+	printQueue = append(printQueue, job)
+	select {
+	case printWakeup <- struct{}{}:
+	default:
+	}
+}
+
+// queueLabel appends a label to the print queue.
+func queueLabel(name string, gen labelGenerator) {
+	queueJob(&printJob{Name: name, gen: gen})
+}
+
+// queueContainerLabel appends the label of a container to the print queue.
+// Unlike other labels, these can be persisted in the journal.
+func queueContainerLabel(c *Container, kind string) {
+	queueJob(&printJob{Name: string(c.Id()), Id: c.Id(), Kind: kind,
+		gen: func(mediaInfo *ql.MediaInfo) (image.Image, error) {
+			return genLabel(c, kind, mediaInfo)
+		}})
+}
+
+// queueCancel drops all jobs that haven't started printing yet,
+// returning their number. The job being printed is left to finish.
+func queueCancel() int {
+	n := len(printQueue)
+	printQueue = nil
+	queueSave()
+	return n
+}
+
+// journalJob is how container label jobs are persisted in the journal.
+type journalJob struct {
+	Name string
+	Id   ContainerId
+	Kind string
+}
+
+// queueSave writes all container label jobs that are yet to be printed
+// to the journal, if enabled, so that they aren't lost on restarts.
+// Failing that is not fatal, as they are still kept in memory.
+func queueSave() {
+	if *queueJournal == "" {
+		return
+	}
+
+	jobs := []journalJob{}
+	for _, list := range [][]*printJob{printRestored, printQueue} {
+		for _, job := range list {
+			if job.Id != "" {
+				jobs = append(jobs, journalJob{job.Name, job.Id, job.Kind})
+			}
+		}
+	}
+
+	data, err := json.Marshal(jobs)
+	if err != nil {
+		logutil.Errorf("print queue journal: %s", err)
+		return
+	}
+
+	// Atomically replace the current journal.
+	path := dataPath(*queueJournal)
+	if err := os.WriteFile(path+".new", data, 0644); err != nil {
+		logutil.Errorf("print queue journal: %s", err)
+	} else if err := os.Rename(path+".new", path); err != nil {
+		logutil.Errorf("print queue journal: %s", err)
+	}
+}
+
+// queueLoad reads jobs left in the journal by a previous run. They are only
+// offered for printing, as the labels may no longer be wanted.
+func queueLoad() error {
+	if *queueJournal == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(dataPath(*queueJournal))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var jobs []journalJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		printRestored = append(printRestored,
+			&printJob{Name: job.Name, Id: job.Id, Kind: job.Kind})
+	}
+	if len(printRestored) > 0 {
+		logutil.Infof("%d labels from before a restart await a decision",
+			len(printRestored))
+	}
+	return nil
+}
+
+// queueRestore moves jobs from the journal to the print queue, returning
+// their number. Labels of containers that no longer exist are dropped.
+func queueRestore() int {
+	n := 0
+	for _, job := range printRestored {
+		if c := indexContainer[job.Id]; c == nil {
+			logutil.Warnf("not restoring %s: %s", job.Name, errNoSuchContainer)
+		} else {
+			queueContainerLabel(c, job.Kind)
+			n++
+		}
+	}
+	printRestored = nil
+	queueSave()
+	return n
+}
+
+// queueDiscard drops jobs from the journal, returning their number.
+func queueDiscard() int {
+	n := len(printRestored)
+	printRestored = nil
+	queueSave()
+	return n
+}
+
+// printWorker prints queued labels one by one. The global mutex is released
+// between jobs, so that the rest of the application stays responsive,
+// and the queue can be cancelled.
+//
+// The journal is only updated here, so that big batches don't rewrite it
+// for every queued label, and so that jobs remain in it until printed.
+func printWorker() {
+	for range printWakeup {
+		for {
+			mutex.Lock()
+			queueSave()
+			if len(printQueue) == 0 {
+				mutex.Unlock()
+				break
+			}
+
+			job := printQueue[0]
+			printQueue = printQueue[1:]
+			if job.Error = printGenerated(job.Name, job.gen); job.Error != nil {
+				logutil.Errorf("printing %s: %s", job.Name, job.Error)
+				printFailures = append(printFailures, job)
+				if len(printFailures) > maxPrintFailures {
+					printFailures = printFailures[1:]
+				}
+			}
+			mutex.Unlock()
+		}
+	}
+}
+
+// recentPrint is a label that has recently been printed, or attempted to be.
+type recentPrint struct {
+	Serial int       // unique identifier of the attempt
+	Name   string    // what the label is for
+	Time   time.Time // when it was printed
+	Error  error     // why printing has failed, if it has
+	gen    labelGenerator
+}
+
+// maxRecentPrints limits how many recent prints are remembered.
+const maxRecentPrints = 10
+
+var (
+	recentPrints []*recentPrint // most recent prints, oldest first
+	recentSerial int            // last used serial number
+)
+
+// recordPrint remembers a print attempt, so that it can be easily repeated.
+func recordPrint(name string, gen labelGenerator, err error) {
+	recentSerial++
+	recentPrints = append(recentPrints, &recentPrint{
+		Serial: recentSerial,
+		Name:   name,
+		Time:   time.Now(),
+		Error:  err,
+		gen:    gen,
+	})
+	if len(recentPrints) > maxRecentPrints {
+		recentPrints = recentPrints[1:]
+	}
+}
+
+// lastPrintError returns why the last print attempt has failed, if it has.
+func lastPrintError() error {
+	if len(recentPrints) == 0 {
+		return nil
+	}
+	return recentPrints[len(recentPrints)-1].Error
+}
+
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if _, ok := r.Form["cancel"]; ok {
+			logutil.Infof("cancelled %d queued labels", queueCancel())
+		}
+		if _, ok := r.Form["restore"]; ok {
+			logutil.Infof("restored %d queued labels", queueRestore())
+		}
+		if _, ok := r.Form["discard"]; ok {
+			logutil.Infof("discarded %d restored labels", queueDiscard())
+		}
+
+		// Labels of containers get regenerated, so they may have changed.
+		serial, _ := strconv.Atoi(r.FormValue("reprint"))
+		for _, rp := range recentPrints {
+			if rp.Serial == serial {
+				queueLabel(rp.Name, rp.gen)
+			}
+		}
+		http.Redirect(w, r, r.URL.EscapedPath(), http.StatusSeeOther)
+		return
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := struct {
+		Queue    []*printJob
+		Restored []*printJob
+		Failures []*printJob
+		Recent   []*recentPrint
+	}{
+		Queue:    printQueue,
+		Restored: printRestored,
+		Failures: printFailures,
+	}
+	for i := len(recentPrints) - 1; i >= 0; i-- {
+		params.Recent = append(params.Recent, recentPrints[i])
+	}
+
+	executeTemplate("queue.tmpl", w, r, &params)
+}
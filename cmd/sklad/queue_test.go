@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"janouch.name/sklad/ql"
+)
+
+// testWorker is the print worker shared by tests, as it can't be stopped.
+var testWorker sync.Once
+
+// TestQueueCancel cancels the print queue while a job is being printed,
+// which must finish, while the rest must be dropped.
+func TestQueueCancel(t *testing.T) {
+	mutex.Lock()
+	testDatabase(t, Database{Prefix: "X"})
+	*dryRun, recentPrints = true, nil
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		*dryRun = false
+		mutex.Unlock()
+	}()
+	testWorker.Do(func() { go printWorker() })
+
+	generated := map[string]int{}
+	cancelled := -1
+	gen := func(name string) labelGenerator {
+		return func(mediaInfo *ql.MediaInfo) (image.Image, error) {
+			generated[name]++
+			if name == "first" {
+				// The global mutex is held while printing.
+				cancelled = queueCancel()
+			}
+			return image.NewGray(image.Rect(0, 0, 100, 100)), nil
+		}
+	}
+
+	mutex.Lock()
+	for _, name := range []string{"first", "second", "third", "fourth"} {
+		queueLabel(name, gen(name))
+	}
+	mutex.Unlock()
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		mutex.Lock()
+		done := len(recentPrints) > 0
+		mutex.Unlock()
+		if done {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the print queue")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if cancelled != 3 {
+		t.Errorf("%d labels cancelled, want 3", cancelled)
+	}
+	if len(printQueue) != 0 {
+		t.Errorf("%d labels remain in the queue", len(printQueue))
+	}
+	if len(recentPrints) != 1 || recentPrints[0].Name != "first" ||
+		recentPrints[0].Error != nil {
+		t.Errorf("the running job didn't finish correctly")
+	}
+	for _, name := range []string{"second", "third", "fourth"} {
+		if generated[name] != 0 {
+			t.Errorf("%s has been printed after cancelling", name)
+		}
+	}
+}
+
+// TestQueueJournal simulates a restart with labels waiting in the queue,
+// which must be offered again, but not printed on their own.
+func TestQueueJournal(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	testDatabase(t, Database{
+		Prefix:     "X",
+		Series:     []*Series{{Prefix: "A", Counter: 2}},
+		Containers: []*Container{{Series: "A", Number: 1}},
+	})
+	*queueJournal = filepath.Join(t.TempDir(), "queue.json")
+	defer func() {
+		*queueJournal, printQueue, printRestored = "", nil, nil
+	}()
+
+	// Bypass queueJob, so that the print worker doesn't get involved.
+	// Only container labels can be persisted, XA2 has since been removed.
+	printQueue = []*printJob{
+		{Name: "XA1", Id: "XA1", Kind: "qr"},
+		{Name: "text"},
+		{Name: "XA2", Id: "XA2"},
+	}
+	queueSave()
+
+	printQueue, printRestored = nil, nil
+	if err := queueLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if len(printQueue) != 0 {
+		t.Errorf("restored labels have been queued for printing")
+	}
+	var restored []string
+	for _, job := range printRestored {
+		restored = append(restored, job.Name+":"+job.Kind)
+	}
+	if !reflect.DeepEqual(restored, []string{"XA1:qr", "XA2:"}) {
+		t.Errorf("got restored jobs %v", restored)
+	}
+
+	// They must be listed as pending.
+	w := httptest.NewRecorder()
+	handleQueue(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/queue", nil))
+	if body := w.Body.String(); !strings.Contains(body, "XA1") ||
+		!strings.Contains(body, "XA2") || !strings.Contains(body, "?restore") {
+		t.Errorf("restored jobs are not offered")
+	}
+
+	// Restored jobs survive another restart, until they're printed.
+	if n := queueRestore(); n != 1 {
+		t.Errorf("restored %d jobs, want 1", n)
+	}
+	printQueue, printRestored = nil, nil
+	if err := queueLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if len(printRestored) != 1 || printRestored[0].Id != "XA1" {
+		t.Errorf("got %d restored jobs after restoring", len(printRestored))
+	}
+
+	// Discarded jobs are gone for good.
+	if n := queueDiscard(); n != 1 {
+		t.Errorf("discarded %d jobs, want 1", n)
+	}
+	if err := queueLoad(); err != nil {
+		t.Fatal(err)
+	}
+	if len(printRestored) != 0 {
+		t.Errorf("got %d restored jobs after discarding", len(printRestored))
+	}
+}
+
+func TestRecentPrints(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testFont(t)
+
+	// Keep the print worker, if any, away from the queue.
+	mutex.Lock()
+	defer mutex.Unlock()
+	defer func() { *dryRun, printQueue, recentPrints = false, nil, nil }()
+
+	// Any attempt at opening this printer fails.
+	testDatabase(t, Database{
+		Prefix:      "X",
+		BDFScale:    1,
+		PrinterPath: filepath.Join(t.TempDir(), "lp0"),
+		Series:      []*Series{{Prefix: "A", Counter: 2}},
+		Containers: []*Container{{Series: "A", Number: 1},
+			{Series: "A", Number: 2}},
+	})
+	printQueue, recentPrints = nil, nil
+
+	// Both dry runs and failed prints get recorded.
+	for _, test := range []struct {
+		id     string
+		dryRun bool
+	}{
+		{"XA1", true},
+		{"XA2", false},
+	} {
+		*dryRun = test.dryRun
+		w := httptest.NewRecorder()
+		handleLabel(w, testRequest(t, &Session{LoggedIn: true},
+			"POST", "/label?id="+test.id, nil))
+
+		last := recentPrints[len(recentPrints)-1]
+		if last.Name != test.id || (last.Error == nil) != test.dryRun {
+			t.Errorf("%s: recorded %s, %v", test.id, last.Name, last.Error)
+		}
+	}
+	if len(recentPrints) != 2 {
+		t.Fatalf("%d prints recorded, want 2", len(recentPrints))
+	}
+
+	// Reprinting queues the very same label, even if it has failed.
+	failed := recentPrints[1]
+	w := httptest.NewRecorder()
+	handleQueue(w, testRequest(t, &Session{LoggedIn: true}, "POST",
+		"/queue?reprint="+strconv.Itoa(failed.Serial), nil))
+	if len(printQueue) != 1 || printQueue[0].Name != "XA2" {
+		t.Fatalf("the label hasn't been queued again")
+	}
+	img, err := printQueue[0].gen(dbDefaultMedia())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, err := failed.gen(dbDefaultMedia()); err != nil {
+		t.Fatal(err)
+	} else if !sameImages(img, want) {
+		t.Errorf("the reprinted label differs")
+	}
+
+	// Only so many of the most recent prints are remembered, in order.
+	gen := func(mediaInfo *ql.MediaInfo) (image.Image, error) {
+		return nil, errors.New("no label")
+	}
+	for i := 0; i < maxRecentPrints+5; i++ {
+		recordPrint(strconv.Itoa(i), gen, nil)
+	}
+	if len(recentPrints) != maxRecentPrints {
+		t.Fatalf("%d prints remembered", len(recentPrints))
+	}
+	for i, rp := range recentPrints {
+		if rp.Name != strconv.Itoa(i+5) {
+			t.Errorf("print %d is %s", i, rp.Name)
+		}
+		if i > 0 && rp.Serial != recentPrints[i-1].Serial+1 {
+			t.Errorf("print %d has serial %d", i, rp.Serial)
+		}
+	}
+}
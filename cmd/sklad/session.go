@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/hex"
-	"math/rand"
 	"net/http"
 	"net/url"
 )
@@ -13,6 +13,33 @@ var sessions = map[string]*Session{}
 
 type Session struct {
 	LoggedIn bool // may access the DB
+
+	removals map[string]string // removal confirmation tokens by target
+}
+
+// removalToken returns a token that needs to be sent back in order to confirm
+// the removal of target, which names the kind of the object and its key.
+func (s *Session) removalToken(target string) string {
+	if s.removals == nil {
+		s.removals = map[string]string{}
+	}
+	token, ok := s.removals[target]
+	if !ok {
+		token = sessionGenId()
+		s.removals[target] = token
+	}
+	return token
+}
+
+// confirmRemoval checks the token for removing target, and invalidates it,
+// so that repeating the request can't remove anything else.
+func (s *Session) confirmRemoval(target, token string) bool {
+	expected, ok := s.removals[target]
+	if !ok || token != expected {
+		return false
+	}
+	delete(s.removals, target)
+	return true
 }
 
 type sessionContextKey struct{}
@@ -25,13 +52,27 @@ func sessionGenId() string {
 	return hex.EncodeToString(u)
 }
 
+// sessionValidId checks whether id could have been made by sessionGenId,
+// so that arbitrary client input doesn't end up as a map key.
+func sessionValidId(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
 // TODO: We don't want to keep an unlimited amount of cookies in the storage.
 //  - The essential question is: how do we avoid DoS?
 //  - Which cookies are worth keeping?
 //     - Definitely logged-in users, only one person should know the password.
 //  - Evict by FIFO? LRU?
 func sessionGet(w http.ResponseWriter, r *http.Request) (session *Session) {
-	if c, _ := r.Cookie("sessionid"); c != nil {
+	if c, _ := r.Cookie("sessionid"); c != nil && sessionValidId(c.Value) {
 		session, _ = sessions[c.Value]
 	}
 	if session == nil {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSessionGet(t *testing.T) {
+	defer func(saved map[string]*Session) { sessions = saved }(sessions)
+	known := sessionGenId()
+	sessions = map[string]*Session{known: {LoggedIn: true}}
+
+	for _, test := range []struct {
+		cookie string
+		known  bool
+	}{
+		{known, true},
+		{"", false},
+		{sessionGenId(), false},
+		{strings.ToUpper(known), false},
+		{known[1:], false},
+		{known + "0", false},
+		{strings.Repeat("x", 1<<16), false},
+		{"../../etc/passwd", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: "sessionid", Value: test.cookie})
+		}
+		w := httptest.NewRecorder()
+		session := sessionGet(w, r)
+		cookies := w.Result().Cookies()
+		if test.known {
+			if session != sessions[known] || len(cookies) != 0 {
+				t.Errorf("%.40q: the known session hasn't been used",
+					test.cookie)
+			}
+			continue
+		}
+
+		// A fresh session must be made under a newly generated ID.
+		if session == nil || session.LoggedIn {
+			t.Errorf("%.40q: got %+v", test.cookie, session)
+		}
+		if len(cookies) != 1 || !sessionValidId(cookies[0].Value) ||
+			cookies[0].Value == test.cookie ||
+			sessions[cookies[0].Value] != session {
+			t.Errorf("%.40q: got cookies %v", test.cookie, cookies)
+		}
+		if _, ok := sessions[test.cookie]; ok {
+			t.Errorf("%.40q: used as a session key", test.cookie)
+		}
+	}
+}
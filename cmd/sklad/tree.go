@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+
+	"janouch.name/sklad/logutil"
+)
+
+// handleTree renders the whole container hierarchy as a nested list.
+// Templates write directly to the response, so it's produced as it goes.
+func handleTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	executeTemplate("tree.tmpl", w, r, indexChildren[""])
+}
+
+// writeTreeJSON writes containers as a JSON array of objects,
+// each with its ID, description, and recursively its children.
+func writeTreeJSON(bw *bufio.Writer, containers []*Container) {
+	bw.WriteByte('[')
+	for i, c := range containers {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+
+		// Marshalling strings cannot fail, the object is left open.
+		head, _ := json.Marshal(struct {
+			Id          ContainerId
+			Description string
+		}{c.Id(), c.Description})
+		bw.Write(head[:len(head)-1])
+		bw.WriteString(`,"Children":`)
+		writeTreeJSON(bw, c.Children())
+		bw.WriteByte('}')
+	}
+	bw.WriteByte(']')
+}
+
+// handleTreeJSON is like handleTree, but produces nested JSON,
+// streaming it rather than building the whole document in memory.
+func handleTreeJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	bw := bufio.NewWriter(w)
+	writeTreeJSON(bw, indexChildren[""])
+	bw.WriteByte('\n')
+	if err := bw.Flush(); err != nil {
+		logutil.Errorf("%s", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+// testTree is a hierarchy with two roots, XA1 and XB1.
+var testTree = Database{
+	Prefix: "X",
+	Series: []*Series{{Prefix: "A", Counter: 4}, {Prefix: "B", Counter: 2}},
+	Containers: []*Container{
+		{Series: "A", Number: 1, Description: "Shelf"},
+		{Series: "A", Number: 2, Parent: "XA1"},
+		{Series: "A", Number: 3, Parent: "XA2", Description: "Screws"},
+		{Series: "B", Number: 1},
+		{Series: "B", Number: 2, Parent: "XA2"},
+		{Series: "A", Number: 4, Parent: "XB1"},
+	},
+}
+
+// testTreeDepths is how deep each container of testTree is nested.
+var testTreeDepths = map[string]int{
+	"XA1": 1, "XA2": 2, "XA3": 3, "XB2": 3, "XB1": 1, "XA4": 2,
+}
+
+func TestTree(t *testing.T) {
+	if err := loadTemplates("."); err != nil {
+		t.Fatal(err)
+	}
+	testDatabase(t, testTree)
+
+	w := httptest.NewRecorder()
+	handleTree(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/tree", nil))
+
+	// Track the nesting of lists, and where each container appears.
+	depth, depths := 0, map[string]int{}
+	re := regexp.MustCompile(`<ul>|</ul>|<a href="container\?id=(\w+)">`)
+	for _, m := range re.FindAllStringSubmatch(w.Body.String(), -1) {
+		switch m[0] {
+		case "<ul>":
+			depth++
+		case "</ul>":
+			depth--
+		default:
+			if _, ok := depths[m[1]]; ok {
+				t.Errorf("%s appears repeatedly", m[1])
+			}
+			depths[m[1]] = depth
+		}
+	}
+	if depth != 0 {
+		t.Errorf("unbalanced lists")
+	}
+	if !reflect.DeepEqual(depths, testTreeDepths) {
+		t.Errorf("got %v, want %v", depths, testTreeDepths)
+	}
+}
+
+// testTreeNode is what handleTreeJSON produces.
+type testTreeNode struct {
+	Id          ContainerId
+	Description string
+	Children    []testTreeNode
+}
+
+func TestTreeJSON(t *testing.T) {
+	testDatabase(t, testTree)
+
+	w := httptest.NewRecorder()
+	handleTreeJSON(w, testRequest(t, &Session{LoggedIn: true},
+		"GET", "/tree.json", nil))
+
+	var roots []testTreeNode
+	if err := json.Unmarshal(w.Body.Bytes(), &roots); err != nil {
+		t.Fatal(err)
+	}
+
+	depths := map[string]int{}
+	var walk func(nodes []testTreeNode, depth int)
+	walk = func(nodes []testTreeNode, depth int) {
+		for _, node := range nodes {
+			if _, ok := depths[string(node.Id)]; ok {
+				t.Errorf("%s appears repeatedly", node.Id)
+			}
+			depths[string(node.Id)] = depth
+			if c := indexContainer[node.Id]; c == nil ||
+				c.Description != node.Description {
+				t.Errorf("%s: got description %q", node.Id, node.Description)
+			}
+			walk(node.Children, depth+1)
+		}
+	}
+	walk(roots, 1)
+	if !reflect.DeepEqual(depths, testTreeDepths) {
+		t.Errorf("got %v, want %v", depths, testTreeDepths)
+	}
+
+	// Both roots are there, in their original order.
+	if len(roots) != 2 || roots[0].Id != "XA1" || roots[1].Id != "XB1" {
+		t.Errorf("unexpected roots")
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"image"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"janouch.name/sklad/logutil"
+	"janouch.name/sklad/ql"
+)
+
+// webhookSignatureHeader carries the hex-encoded HMAC-SHA256 of the timestamp,
+// a dot, and the request body, keyed by the shared secret,
+// prefixed with "sha256=".
+const webhookSignatureHeader = "X-Sklad-Signature"
+
+// webhookTimestampHeader carries the time of signing in Unix seconds,
+// so that captured requests can't be replayed later.
+const webhookTimestampHeader = "X-Sklad-Timestamp"
+
+// webhookMaxSkew is how far off the time of signing may be. Signatures are
+// remembered for this long, so that they can't be replayed even meanwhile.
+const webhookMaxSkew = 5 * time.Minute
+
+// webhookSeen maps signatures of accepted requests to their timestamps.
+// It is guarded by the global mutex, like everything else.
+var webhookSeen = map[string]time.Time{}
+
+// webhookPrintRequest asks for either a container label, or an ad-hoc one.
+type webhookPrintRequest struct {
+	Id   ContainerId // container to print the label of
+	Text string      // text of an ad-hoc label, if Id is empty
+	Kind string      // label kind, as in the web interface
+}
+
+// webhookSign computes the signature of a webhook request.
+func webhookSign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(db.WebhookSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookVerify checks the signature of a webhook request, as well as that
+// it is recent, and hasn't been seen yet.
+func webhookVerify(timestamp string, body []byte, signature string) bool {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	signed, now := time.Unix(seconds, 0), time.Now()
+	if signed.Before(now.Add(-webhookMaxSkew)) ||
+		signed.After(now.Add(webhookMaxSkew)) {
+		return false
+	}
+	if !hmac.Equal([]byte(webhookSign(timestamp, body)), []byte(signature)) {
+		return false
+	}
+
+	for seen, t := range webhookSeen {
+		if t.Before(now.Add(-webhookMaxSkew)) {
+			delete(webhookSeen, seen)
+		}
+	}
+	if _, ok := webhookSeen[signature]; ok {
+		return false
+	}
+	webhookSeen[signature] = signed
+	return true
+}
+
+// handleWebhookPrint prints labels on behalf of external systems,
+// which authenticate by signing requests rather than by logging in.
+// The body must not have been read yet, not even by ParseForm.
+func handleWebhookPrint(w http.ResponseWriter, r *http.Request) {
+	if db.WebhookSecret == "" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if errors.As(err, new(*http.MaxBytesError)) {
+		http.Error(w, errRequestTooLarge.Error(),
+			http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !webhookVerify(r.Header.Get(webhookTimestampHeader), body,
+		r.Header.Get(webhookSignatureHeader)) {
+		logutil.Warnf("webhook request from %s has an invalid signature",
+			r.RemoteAddr)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var req webhookPrintRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Id != "" {
+		c := indexContainer[req.Id]
+		if c == nil {
+			http.Error(w, errNoSuchContainer.Error(), http.StatusNotFound)
+			return
+		}
+		err = printLabel(c, req.Kind)
+	} else if text := strings.TrimSpace(req.Text); text != "" {
+		err = printGenerated("webhook",
+			func(mediaInfo *ql.MediaInfo) (image.Image, error) {
+				return genTextLabel(text, req.Kind, "", mediaInfo)
+			})
+	} else {
+		http.Error(w, errEmptyLabel.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
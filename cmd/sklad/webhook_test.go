@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testWebhookRequest makes a webhook request, signed at the given time.
+func testWebhookRequest(contentType, body string, signed time.Time,
+	signature string) *http.Request {
+	timestamp := strconv.FormatInt(signed.Unix(), 10)
+	if signature == "" {
+		signature = webhookSign(timestamp, []byte(body))
+	}
+
+	r := httptest.NewRequest("POST", "/webhook/print", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set(webhookTimestampHeader, timestamp)
+	r.Header.Set(webhookSignatureHeader, signature)
+	return r
+}
+
+func TestWebhookPrint(t *testing.T) {
+	testFont(t)
+	testDatabase(t, Database{
+		Prefix:        "X",
+		BDFScale:      1,
+		WebhookSecret: "secret",
+		Series:        []*Series{{Prefix: "A", Counter: 1}},
+		Containers:    []*Container{{Series: "A", Number: 1}},
+	})
+	*dryRun, recentPrints, webhookSeen = true, nil, map[string]time.Time{}
+	defer func() { *dryRun, recentPrints = false, nil }()
+
+	now := time.Now()
+	earlier := now.Add(-time.Second)
+	signature := webhookSign(
+		strconv.FormatInt(earlier.Unix(), 10), []byte(`{"Id": "XA1"}`))
+	for _, test := range []struct {
+		name    string
+		request *http.Request
+		code    int
+		printed string
+	}{
+		{"container", testWebhookRequest("application/json",
+			`{"Id": "XA1"}`, now, ""), http.StatusNoContent, "XA1"},
+		{"ad-hoc", testWebhookRequest("application/json",
+			`{"Text": "Shelf"}`, now.Add(-time.Minute), ""),
+			http.StatusNoContent, "webhook"},
+		{"form-encoded", testWebhookRequest(
+			"application/x-www-form-urlencoded",
+			`{"Text": "Shelf", "Kind": "text"}`, now, ""),
+			http.StatusNoContent, "webhook"},
+		{"tampered body", testWebhookRequest("application/json",
+			`{"Id": "XA2"}`, earlier, signature),
+			http.StatusUnauthorized, ""},
+		{"tampered timestamp", testWebhookRequest("application/json",
+			`{"Id": "XA1"}`, now, signature),
+			http.StatusUnauthorized, ""},
+		{"stale", testWebhookRequest("application/json",
+			`{"Id": "XA1"}`, now.Add(-time.Hour), ""),
+			http.StatusUnauthorized, ""},
+		{"future", testWebhookRequest("application/json",
+			`{"Id": "XA1"}`, now.Add(time.Hour), ""),
+			http.StatusUnauthorized, ""},
+		{"unknown container", testWebhookRequest("application/json",
+			`{"Id": "XA2"}`, now, ""), http.StatusNotFound, ""},
+		{"original", testWebhookRequest("application/json",
+			`{"Id": "XA1"}`, earlier, signature), http.StatusNoContent, "XA1"},
+		{"replayed", testWebhookRequest("application/json",
+			`{"Id": "XA1"}`, earlier, signature),
+			http.StatusUnauthorized, ""},
+	} {
+		recentPrints = nil
+		w := httptest.NewRecorder()
+		handle(w, test.request)
+		if w.Code != test.code {
+			t.Errorf("%s: got status %d, want %d: %s",
+				test.name, w.Code, test.code, w.Body)
+		}
+
+		printed := ""
+		if len(recentPrints) > 0 {
+			printed = recentPrints[0].Name
+		}
+		if printed != test.printed {
+			t.Errorf("%s: printed %q, want %q",
+				test.name, printed, test.printed)
+		}
+	}
+
+	// Without a secret, the endpoint is disabled.
+	db.WebhookSecret = ""
+	w := httptest.NewRecorder()
+	handle(w, testWebhookRequest("application/json", `{"Id": "XA1"}`, now, ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("disabled: got status %d", w.Code)
+	}
+}
@@ -1,5 +1,5 @@
 module janouch.name/sklad
 
-go 1.17
+go 1.19
 
 require github.com/boombuler/barcode v1.0.1
@@ -1,10 +1,81 @@
 package imgutil
 
 import (
+	"fmt"
 	"image"
 	"image/color"
 )
 
+// BitImage is an image.Image that can directly tell whether a pixel is black,
+// saving a colour conversion for each pixel in hot paths.
+type BitImage interface {
+	image.Image
+	AtBit(x, y int) bool
+}
+
+// IsBlack reports whether the pixel at the given point is mostly black
+// and mostly opaque. This is a fast path for a few common image types.
+func IsBlack(img image.Image, x, y int) bool {
+	switch img := img.(type) {
+	case BitImage:
+		return img.AtBit(x, y)
+	case *image.RGBA:
+		c := img.RGBAAt(x, y)
+		return c.R < 0x40 && c.G < 0x40 && c.B < 0x40 && c.A >= 0x80
+	case *image.Gray:
+		return img.GrayAt(x, y).Y < 0x40
+	}
+
+	r, g, b, a := img.At(x, y).RGBA()
+	return r < 0x4000 && g < 0x4000 && b < 0x4000 && a >= 0x8000
+}
+
+// MaxAmbiguousShare is the share of ambiguous pixels, as computed
+// by AmbiguousShare, over which CheckContrast issues a warning.
+const MaxAmbiguousShare = 0.1
+
+// AmbiguousShare estimates how much of an image is close to the threshold
+// used by IsBlack, and therefore may print unlike how it looks. These are
+// opaque pixels whose lightest channel is within a factor of two of it.
+func AmbiguousShare(img image.Image) float64 {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return 0
+	}
+
+	ambiguous := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r, g, b, a := img.At(x, y).RGBA()
+			if a < 0x8000 {
+				continue
+			}
+			lightest := r
+			if g > lightest {
+				lightest = g
+			}
+			if b > lightest {
+				lightest = b
+			}
+			if lightest >= 0x2000 && lightest < 0x8000 {
+				ambiguous++
+			}
+		}
+	}
+	return float64(ambiguous) / float64(bounds.Dx()*bounds.Dy())
+}
+
+// CheckContrast returns a warning when too much of the image is ambiguous
+// for 1-bit printing, such as with photos or light-coloured logos.
+func CheckContrast(img image.Image) error {
+	if share := AmbiguousShare(img); share > MaxAmbiguousShare {
+		return fmt.Errorf("low contrast: %.0f%% of the image "+
+			"is close to the black threshold, and may print unexpectedly",
+			share*100)
+	}
+	return nil
+}
+
 // Scale is a scaling image.Image wrapper.
 type Scale struct {
 	Image image.Image
@@ -23,15 +94,25 @@ func (s *Scale) Bounds() image.Rectangle {
 		r.Max.X*s.Scale, r.Max.Y*s.Scale)
 }
 
-// At implements image.Image.
-func (s *Scale) At(x, y int) color.Color {
+func (s *Scale) source(x, y int) (int, int) {
 	if x < 0 {
 		x = x - s.Scale + 1
 	}
 	if y < 0 {
 		y = y - s.Scale + 1
 	}
-	return s.Image.At(x/s.Scale, y/s.Scale)
+	return x / s.Scale, y / s.Scale
+}
+
+// At implements image.Image.
+func (s *Scale) At(x, y int) color.Color {
+	return s.Image.At(s.source(x, y))
+}
+
+// AtBit implements BitImage.
+func (s *Scale) AtBit(x, y int) bool {
+	x, y = s.source(x, y)
+	return IsBlack(s.Image, x, y)
 }
 
 // LeftRotate is a 90 degree rotating image.Image wrapper.
@@ -55,3 +136,35 @@ func (lr *LeftRotate) Bounds() image.Rectangle {
 func (lr *LeftRotate) At(x, y int) color.Color {
 	return lr.Image.At(-y, x)
 }
+
+// AtBit implements BitImage.
+func (lr *LeftRotate) AtBit(x, y int) bool {
+	return IsBlack(lr.Image, -y, x)
+}
+
+// RightRotate is a -90 degree rotating image.Image wrapper.
+type RightRotate struct {
+	Image image.Image
+}
+
+// ColorModel implements image.Image.
+func (rr *RightRotate) ColorModel() color.Model {
+	return rr.Image.ColorModel()
+}
+
+// Bounds implements image.Image.
+func (rr *RightRotate) Bounds() image.Rectangle {
+	r := rr.Image.Bounds()
+	// Min is inclusive, Max is exclusive.
+	return image.Rect(-(r.Max.Y - 1), r.Min.X, -(r.Min.Y - 1), r.Max.X)
+}
+
+// At implements image.Image.
+func (rr *RightRotate) At(x, y int) color.Color {
+	return rr.Image.At(y, -x)
+}
+
+// AtBit implements BitImage.
+func (rr *RightRotate) AtBit(x, y int) bool {
+	return IsBlack(rr.Image, y, -x)
+}
@@ -0,0 +1,43 @@
+package imgutil
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestCheckContrast(t *testing.T) {
+	// A gradient spans the threshold, much of it prints at random.
+	gradient := image.NewGray(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			gradient.SetGray(x, y, color.Gray{uint8(x)})
+		}
+	}
+	if err := CheckContrast(gradient); err == nil {
+		t.Errorf("a gradient has passed as high contrast")
+	}
+
+	// Black text on white is what labels normally consist of.
+	text := image.NewGray(image.Rect(0, 0, 256, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 256; x++ {
+			if (x/4+y/4)%2 == 0 {
+				text.SetGray(x, y, color.Gray{0xff})
+			}
+		}
+	}
+	if err := CheckContrast(text); err != nil {
+		t.Errorf("black on white: %s", err)
+	}
+
+	// Transparency is neither, and empty images have nothing to warn about.
+	for _, img := range []image.Image{
+		image.NewNRGBA(image.Rect(0, 0, 16, 16)),
+		image.NewGray(image.Rect(0, 0, 0, 0)),
+	} {
+		if share := AmbiguousShare(img); share != 0 {
+			t.Errorf("%v: got an ambiguous share of %f", img.Bounds(), share)
+		}
+	}
+}
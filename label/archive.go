@@ -0,0 +1,49 @@
+package label
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+func writePNG(f *os.File, img image.Image) error {
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SavePNG writes out a label as a PNG file, replacing any existing one.
+func SavePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return writePNG(f, img)
+}
+
+// Archive saves a copy of a label as a PNG file in the directory, named
+// after the label and the current time. Labels archived within the same second
+// get numbered, so that none is overwritten. It returns the path of the copy.
+func Archive(dir, name string, img image.Image) (string, error) {
+	base := filepath.Join(dir, name+"-"+now().Format("20060102-150405"))
+	for i := 1; ; i++ {
+		path := base + ".png"
+		if i > 1 {
+			path = fmt.Sprintf("%s-%d.png", base, i)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return path, writePNG(f, img)
+	}
+}
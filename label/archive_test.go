@@ -0,0 +1,51 @@
+package label
+
+import (
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	// The clock stands still, so all copies are made within the same second.
+	testClock(t, 0)
+
+	dir := t.TempDir()
+	var paths []string
+	for i := 1; i <= 3; i++ {
+		img := image.NewGray(image.Rect(0, 0, i, 1))
+		path, err := Archive(dir, "XA1", img)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, filepath.Base(path))
+
+		// Every copy must be kept intact.
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archived, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if archived.Bounds() != img.Bounds() {
+			t.Errorf("%s: got bounds %v, want %v",
+				path, archived.Bounds(), img.Bounds())
+		}
+	}
+
+	want := []string{"XA1-00010101-000000.png",
+		"XA1-00010101-000000-2.png", "XA1-00010101-000000-3.png"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Errorf("got %v, want %v", paths, want)
+	}
+
+	if _, err := Archive(filepath.Join(dir, "nonexistent"), "XA1",
+		image.NewGray(image.Rect(0, 0, 1, 1))); err == nil {
+		t.Error("archiving into a nonexistent directory has succeeded")
+	}
+}
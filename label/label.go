@@ -1,55 +1,274 @@
 package label
 
 import (
+	"encoding/xml"
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
+	"io"
+	"math"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
 	"janouch.name/sklad/bdf"
 	"janouch.name/sklad/imgutil"
+	"janouch.name/sklad/logutil"
+	"janouch.name/sklad/ql"
 
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/qr"
 )
 
+// MaxScale is the largest integer scaling permitted by ClampScale.
+var MaxScale = 16
+
+// ClampScale limits integer scaling of labels to the range from 1 to MaxScale,
+// so that user input can't produce empty or enormous images.
+func ClampScale(scale int) int {
+	return max(1, min(MaxScale, scale))
+}
+
+// QRLabelLayout describes the geometry of a label with a QR code on top
+// and the encoded text right below it, as made by GenLabelForHeight.
+type QRLabelLayout struct {
+	Bounds image.Rectangle // the whole label
+	QR     image.Rectangle // the QR code, including any padding
+	Text   image.Rectangle // the scaled text
+
+	textBounds image.Rectangle // unscaled text bounds, relative to the origin
+	scale      int
+}
+
+// QRLabelOptions adjusts the layout of QR labels.
+type QRLabelOptions struct {
+	// Gap is the space between the QR code and the text, in output pixels.
+	// It is reduced as necessary when the label is too small.
+	Gap int
+	// QRRatio, when non-zero, is the share of the height that the QR code
+	// should get at least, between MinQRRatio and MaxQRRatio. The text is
+	// then scaled to fill the rest, regardless of the requested scale.
+	QRRatio float64
+}
+
+// Limits of QRLabelOptions.QRRatio, to keep both parts legible.
+const (
+	MinQRRatio = 0.2
+	MaxQRRatio = 0.9
+)
+
+// DefaultQRLabelOptions are used when no options are given.
+var DefaultQRLabelOptions = QRLabelOptions{
+	Gap: 20,
+}
+
+// LayoutQRLabel computes the layout of a QR label of the given height,
+// using DefaultQRLabelOptions if opts is nil. When there is no space left
+// for the QR code, its rectangle is empty.
+func LayoutQRLabel(font *bdf.Font,
+	text string, height, scale int, opts *QRLabelOptions) QRLabelLayout {
+	if opts == nil {
+		opts = &DefaultQRLabelOptions
+	}
+
+	textRect, _ := font.BoundString(text)
+	if opts.QRRatio != 0 && textRect.Dy() > 0 {
+		ratio := math.Max(MinQRRatio, math.Min(MaxQRRatio, opts.QRRatio))
+		space := height - int(ratio*float64(height)) - opts.Gap
+		scale = ClampScale(space / textRect.Dy())
+	}
+	scaledTextRect := (&imgutil.Scale{Image: textRect, Scale: scale}).Bounds()
+
+	gap := max(0, min(opts.Gap, height-scaledTextRect.Dy()))
+	remains := max(0, height-scaledTextRect.Dy()-gap)
+
+	width := scaledTextRect.Dx()
+	if remains > width {
+		width = remains
+	}
+
+	qrX := (width - remains) / 2
+	textX := (width - scaledTextRect.Dx()) / 2
+	return QRLabelLayout{
+		Bounds: image.Rect(0, 0, width, height),
+		QR:     image.Rect(qrX, 0, qrX+remains, remains),
+		Text: image.Rect(textX, remains+gap,
+			textX+scaledTextRect.Dx(), remains+gap+scaledTextRect.Dy()),
+		textBounds: textRect,
+		scale:      scale,
+	}
+}
+
+var errEmptyText = errors.New("empty text")
+var errControlCharacters = errors.New("text contains control characters")
+
+// normalizeQRText trims surrounding whitespace, which tends to come from
+// copying and pasting, so that it doesn't end up encoded in QR codes.
+// Control characters would be just as invisible, so they are refused.
+func normalizeQRText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errEmptyText
+	}
+	if strings.IndexFunc(text, unicode.IsControl) >= 0 {
+		return "", errControlCharacters
+	}
+	return text, nil
+}
+
+// CheckGlyphs returns an error listing runes of the text that the font
+// has no glyphs for, and which would therefore be drawn as the font's fallback
+// glyph, if any, making the text different from what has been requested.
+func CheckGlyphs(font *bdf.Font, text string) error {
+	var missing []string
+	seen := map[rune]bool{}
+	for _, r := range text {
+		if _, ok := font.FindGlyph(r); !ok && !seen[r] &&
+			!unicode.IsControl(r) {
+			missing = append(missing, strconv.QuoteRune(r))
+			seen[r] = true
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the font lacks glyphs for %s",
+			strings.Join(missing, ", "))
+	}
+	return nil
+}
+
 // TODO: Rename to GenQRLabelForHeight.
-func GenLabelForHeight(font *bdf.Font,
-	text string, height, scale int) image.Image {
+func GenLabelForHeight(font *bdf.Font, text string, height, scale int,
+	opts *QRLabelOptions) (image.Image, error) {
+	start := now()
+	text, err := normalizeQRText(text)
+	if err != nil {
+		return nil, err
+	}
+
+	// The text must match what the QR code says.
+	if err := CheckGlyphs(font, text); err != nil {
+		return nil, err
+	}
+
+	layout := LayoutQRLabel(font, text, height, scale, opts)
+
 	// Create a scaled bitmap of the text label.
-	textRect, _ := font.BoundString(text)
-	textImg := image.NewRGBA(textRect)
-	draw.Draw(textImg, textRect, image.White, image.ZP, draw.Src)
+	textImg := image.NewRGBA(layout.textBounds)
+	draw.Draw(textImg, layout.textBounds, image.White, image.ZP, draw.Src)
 	font.DrawString(textImg, image.ZP, color.Black, text)
 
-	scaledTextImg := imgutil.Scale{Image: textImg, Scale: scale}
+	scaledTextImg := imgutil.Scale{Image: textImg, Scale: layout.scale}
 	scaledTextRect := scaledTextImg.Bounds()
 
-	remains := height - scaledTextRect.Dy() - 20
+	// Combine, leaving out the QR code if there is no space left for it.
+	combinedImg := image.NewRGBA(layout.Bounds)
+	draw.Draw(combinedImg, layout.Bounds, image.White, image.ZP, draw.Src)
 
-	width := scaledTextRect.Dx()
-	if remains > width {
-		width = remains
+	// Create a scaled bitmap of the QR code. A label that is merely missing
+	// it would easily get printed unnoticed, so failures are errors.
+	if !layout.QR.Empty() {
+		qrImg, err := qr.Encode(text, qr.H, qr.Auto)
+		if err != nil {
+			return nil, err
+		}
+		if qrImg, err = barcode.Scale(
+			qrImg, layout.QR.Dx(), layout.QR.Dy()); err != nil {
+			return nil, err
+		}
+		draw.Draw(combinedImg, layout.QR, qrImg, image.ZP, draw.Src)
 	}
+	draw.Draw(combinedImg, layout.Text, &scaledTextImg, scaledTextRect.Min,
+		draw.Src)
+	logGenerated(start, combinedImg, layout.scale)
+	return combinedImg, nil
+}
 
-	// Create a scaled bitmap of the QR code.
-	qrImg, _ := qr.Encode(text, qr.H, qr.Auto)
-	qrImg, _ = barcode.Scale(qrImg, remains, remains)
-	qrRect := qrImg.Bounds()
+// now is the clock used to time label generation, replaceable by tests.
+var now = time.Now
 
-	// Combine.
-	combinedRect := image.Rect(0, 0, width, height)
-	combinedImg := image.NewRGBA(combinedRect)
-	draw.Draw(combinedImg, combinedRect, image.White, image.ZP, draw.Src)
-	draw.Draw(combinedImg,
-		combinedRect.Add(image.Point{X: (width - qrRect.Dx()) / 2, Y: 0}),
-		qrImg, image.ZP, draw.Src)
+// logGenerated logs how long it took to generate a label, so that slow cases,
+// such as with huge scales or media, are visible in debug output.
+func logGenerated(start time.Time, img image.Image, scale int) {
+	bounds := img.Bounds()
+	logutil.Debugf("generated a %dx%d label at scale %d in %s",
+		bounds.Dx(), bounds.Dy(), scale, now().Sub(start))
+}
 
-	target := image.Rect(
-		(width-scaledTextRect.Dx())/2, qrRect.Dy()+20,
-		combinedRect.Max.X, combinedRect.Max.Y)
-	draw.Draw(combinedImg, target, &scaledTextImg, scaledTextRect.Min, draw.Src)
-	return combinedImg
+// qrQuietZoneModules is how wide the empty margin around QR codes should be.
+const qrQuietZoneModules = 4
+
+// QRQuietZone returns how much empty space the QR code on a label made by
+// GenLabelForHeight with the same arguments needs around it to stay readable.
+// This is also enough for any smaller label with the same text.
+func QRQuietZone(font *bdf.Font, text string, height, scale int,
+	opts *QRLabelOptions) int {
+	text, err := normalizeQRText(text)
+	if err != nil {
+		return 0
+	}
+	qrImg, err := qr.Encode(text, qr.H, qr.Auto)
+	if err != nil {
+		return 0
+	}
+
+	layout := LayoutQRLabel(font, text, height, scale, opts)
+	return layout.QR.Dx() / qrImg.Bounds().Dx() * qrQuietZoneModules
+}
+
+// WriteQRLabelSVG writes out the label made by GenLabelForHeight as an SVG
+// image of the same dimensions. The text refers to the font by its name.
+func WriteQRLabelSVG(w io.Writer, font *bdf.Font,
+	text string, height, scale int, opts *QRLabelOptions) error {
+	text, err := normalizeQRText(text)
+	if err != nil {
+		return err
+	}
+
+	layout := LayoutQRLabel(font, text, height, scale, opts)
+	code, err := qr.Encode(text, qr.H, qr.Auto)
+	if err != nil {
+		return err
+	}
+
+	// barcode.Scale only scales by integer factors, centering the result.
+	codeRect := code.Bounds()
+	module := layout.QR.Dx() / codeRect.Dx()
+	offset := layout.QR.Min.Add(image.Pt(
+		(layout.QR.Dx()-codeRect.Dx()*module)/2,
+		(layout.QR.Dy()-codeRect.Dy()*module)/2))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg"`+
+		` width="%d" height="%d" viewBox="0 0 %d %d">`+"\n",
+		layout.Bounds.Dx(), layout.Bounds.Dy(),
+		layout.Bounds.Dx(), layout.Bounds.Dy())
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="white"/>`+"\n")
+	for y := codeRect.Min.Y; module > 0 && y < codeRect.Max.Y; y++ {
+		for x := codeRect.Min.X; x < codeRect.Max.X; x++ {
+			if r, _, _, _ := code.At(x, y).RGBA(); r >= 0x8000 {
+				continue
+			}
+			fmt.Fprintf(&b, `<rect x="%d" y="%d" width="%d" height="%d"/>`+
+				"\n", offset.X+(x-codeRect.Min.X)*module,
+				offset.Y+(y-codeRect.Min.Y)*module, module, module)
+		}
+	}
+
+	baseline := layout.Text.Min.Y - layout.textBounds.Min.Y*layout.scale
+	fmt.Fprintf(&b, `<text x="%d" y="%d" font-family="`,
+		layout.Text.Min.X-layout.textBounds.Min.X*layout.scale, baseline)
+	xml.EscapeText(&b, []byte(font.Name))
+	fmt.Fprintf(&b, `" font-size="%d" textLength="%d"`+
+		` lengthAdjust="spacingAndGlyphs">`,
+		(font.Ascent+font.Descent)*layout.scale, layout.Text.Dx())
+	xml.EscapeText(&b, []byte(text))
+	b.WriteString("</text>\n</svg>\n")
+
+	_, err = io.WriteString(w, b.String())
+	return err
 }
 
 func max(a, b int) int {
@@ -59,12 +278,21 @@ func max(a, b int) int {
 	return b
 }
 
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 func GenLabelForWidth(font *bdf.Font,
 	text string, width, scale int) image.Image {
-	var lines []string
-	for _, line := range strings.Split(text, "\n") {
-		lines = append(lines, strings.TrimSuffix(line, "\r"))
-	}
+	start := now()
+
+	// Accept any mixture of CR LF, CR and LF line endings,
+	// and don't pad the label with trailing empty lines.
+	text = strings.NewReplacer("\r\n", "\n", "\r", "\n").Replace(text)
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
 
 	// Respect font ascent and descent so that there are gaps between lines.
 	rects := make([]image.Rectangle, len(lines))
@@ -104,5 +332,350 @@ func GenLabelForWidth(font *bdf.Font,
 		draw.Draw(img, target, &scaledImg, scaledRect.Min, draw.Src)
 		y += rects[i].Dy()
 	}
+	logGenerated(start, img, scale)
+	return img
+}
+
+// GenGlyphSheet renders every printable rune the font has a glyph for,
+// in order, wrapped to fit the width. It serves to verify coverage
+// and rendering of newly installed fonts.
+func GenGlyphSheet(font *bdf.Font, width, scale int) image.Image {
+	var runes []rune
+	for _, r := range font.Runes() {
+		if unicode.IsPrint(r) {
+			runes = append(runes, r)
+		}
+	}
+	return GenLabelForWidth(font, wrap(font, string(runes), width, scale),
+		width, scale)
+}
+
+// wrap breaks text into lines that fit the width, at any rune.
+// Lines only overflow when even a single rune doesn't fit.
+func wrap(font *bdf.Font, text string, width, scale int) string {
+	var b strings.Builder
+	line := ""
+	for _, r := range text {
+		if r == '\n' {
+			b.WriteString(line + "\n")
+			line = ""
+			continue
+		}
+		if rect, _ := font.BoundString(line + string(r)); line != "" &&
+			rect.Dx()*scale > width {
+			b.WriteString(line + "\n")
+			line = ""
+		}
+		line += string(r)
+	}
+	b.WriteString(line)
+	return b.String()
+}
+
+// AddFooter extends a label downwards with a line of right-aligned text,
+// so that it can't overlap anything that is already on the label.
+// Text that is too long for the label's width is wrapped.
+func AddFooter(font *bdf.Font, img image.Image, text string,
+	scale int) image.Image {
+	bounds := img.Bounds()
+	text = wrap(font, text, bounds.Dx(), scale)
+	footerWidth := 0
+	for _, line := range strings.Split(text, "\n") {
+		textRect, _ := font.BoundString(line)
+		footerWidth = max(footerWidth, textRect.Dx()*scale)
+	}
+	footerImg := GenLabelForWidth(font, text,
+		min(footerWidth, bounds.Dx()), scale)
+	footerRect := footerImg.Bounds()
+
+	gap := font.Descent * scale
+	width := bounds.Dx()
+	imgRect := image.Rect(0, 0, width, bounds.Dy()+gap+footerRect.Dy())
+	combinedImg := image.NewRGBA(imgRect)
+	draw.Draw(combinedImg, imgRect, image.White, image.ZP, draw.Src)
+	draw.Draw(combinedImg, image.Rect(0, 0, bounds.Dx(), bounds.Dy()),
+		img, bounds.Min, draw.Src)
+	draw.Draw(combinedImg, footerRect.Add(image.Pt(
+		width-footerRect.Dx(), bounds.Dy()+gap)), footerImg, image.ZP, draw.Src)
+	return combinedImg
+}
+
+// AddFrame surrounds a label with a black frame of the given thickness,
+// separated from its contents by padding, such as the quiet zone of QR codes.
+func AddFrame(img image.Image, thickness, padding int) image.Image {
+	bounds := img.Bounds()
+	margin := thickness + padding
+	imgRect := image.Rect(0, 0, bounds.Dx()+2*margin, bounds.Dy()+2*margin)
+	framedImg := image.NewRGBA(imgRect)
+	draw.Draw(framedImg, imgRect, image.Black, image.ZP, draw.Src)
+	draw.Draw(framedImg, imgRect.Inset(thickness), image.White, image.ZP,
+		draw.Src)
+	draw.Draw(framedImg, imgRect.Inset(margin), img, bounds.Min, draw.Src)
+	return framedImg
+}
+
+var (
+	errNotDieCut      = errors.New("the media isn't die-cut")
+	errCaptionTooLong = errors.New("the caption doesn't fit on the media")
+)
+
+// shrink scales an image down, if needed, to fit within the given size,
+// keeping its aspect ratio. It samples the nearest pixels.
+func shrink(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width && bounds.Dy() <= height {
+		return img
+	}
+
+	ratio := math.Min(float64(width)/float64(bounds.Dx()),
+		float64(height)/float64(bounds.Dy()))
+	dx := max(1, int(float64(bounds.Dx())*ratio))
+	dy := max(1, int(float64(bounds.Dy())*ratio))
+
+	shrunkImg := image.NewRGBA(image.Rect(0, 0, dx, dy))
+	for y := 0; y < dy; y++ {
+		for x := 0; x < dx; x++ {
+			shrunkImg.Set(x, y, img.At(bounds.Min.X+x*bounds.Dx()/dx,
+				bounds.Min.Y+y*bounds.Dy()/dy))
+		}
+	}
+	return shrunkImg
+}
+
+// GenCaptionedLabel fills the whole print area of die-cut media with a header
+// line at the top, a footer line at the bottom, and an image centered
+// in between. Either caption may be empty. Captions are scaled as large
+// as they fit across, taking at most a quarter of the length each,
+// and the image is shrunk to the remaining space if it doesn't fit.
+func GenCaptionedLabel(font *bdf.Font, header, footer string,
+	center image.Image, mi *ql.MediaInfo) (image.Image, error) {
+	if mi.PrintAreaLength == 0 {
+		return nil, errNotDieCut
+	}
+
+	// Round labels would clip anything outside of the inscribed square.
+	canvas := mi.Canvas()
+	area := canvas
+	if mi.Round {
+		side := InscribedPins(mi)
+		area = image.Rect(0, 0, side, side).Add(image.Pt(
+			(canvas.Dx()-side)/2, (canvas.Dy()-side)/2))
+	}
+
+	// Both captions share the largest scale that suits them both.
+	captions := []string{
+		strings.Join(strings.Fields(header), " "),
+		strings.Join(strings.Fields(footer), " "),
+	}
+	scale := MaxScale
+	for i, caption := range captions {
+		if r, _ := font.BoundString(caption); r.Empty() {
+			captions[i] = ""
+		} else {
+			scale = min(scale, min(area.Dx()/r.Dx(), area.Dy()/4/r.Dy()))
+		}
+	}
+	if scale < 1 {
+		return nil, errCaptionTooLong
+	}
+
+	img := image.NewRGBA(canvas)
+	draw.Draw(img, canvas, image.White, image.ZP, draw.Src)
+
+	gap := font.Descent * scale
+	for i, caption := range captions {
+		if caption == "" {
+			continue
+		}
+
+		r, _ := font.BoundString(caption)
+		captionImg := GenLabelForWidth(font, caption, r.Dx()*scale, scale)
+		captionRect := captionImg.Bounds()
+		x := area.Min.X + (area.Dx()-captionRect.Dx())/2
+		if i == 0 {
+			draw.Draw(img, captionRect.Add(image.Pt(x, area.Min.Y)),
+				captionImg, image.ZP, draw.Src)
+			area.Min.Y += captionRect.Dy() + gap
+		} else {
+			area.Max.Y -= captionRect.Dy()
+			draw.Draw(img, captionRect.Add(image.Pt(x, area.Max.Y)),
+				captionImg, image.ZP, draw.Src)
+			area.Max.Y -= gap
+		}
+	}
+
+	center = shrink(center, area.Dx(), area.Dy())
+	bounds := center.Bounds()
+	offset := area.Min.Add(image.Pt(
+		(area.Dx()-bounds.Dx())/2, (area.Dy()-bounds.Dy())/2))
+	draw.Draw(img, image.Rect(0, 0, bounds.Dx(), bounds.Dy()).Add(offset),
+		center, bounds.Min, draw.Src)
+	return img, nil
+}
+
+// ContentsItem is a single entry of a contents sheet.
+type ContentsItem struct {
+	Id          string
+	Description string
+	Depth       int // nesting level, used for indentation
+}
+
+// GenContentsSheet renders a full-page overview of items, meant for regular
+// office printers rather than label printers. The page is extended downwards
+// as needed to fit all items in.
+func GenContentsSheet(font *bdf.Font, title string, items []ContentsItem,
+	width, height, scale int) image.Image {
+	var b strings.Builder
+	b.WriteString(title)
+	b.WriteString("\n")
+	for _, item := range items {
+		indent := strings.Repeat("    ", item.Depth)
+		b.WriteString("\n" + indent + item.Id)
+		for i, line := range strings.Split(item.Description, "\n") {
+			if line = strings.TrimSpace(line); line == "" {
+				continue
+			}
+			if i == 0 {
+				b.WriteString("  " + line)
+			} else {
+				b.WriteString("\n" + indent + "    " + line)
+			}
+		}
+	}
+
+	margin := width / 20
+	textImg := GenLabelForWidth(font, b.String(), width-2*margin, scale)
+	textRect := textImg.Bounds()
+
+	pageRect := image.Rect(0, 0, width, max(height, textRect.Dy()+2*margin))
+	pageImg := image.NewRGBA(pageRect)
+	draw.Draw(pageImg, pageRect, image.White, image.ZP, draw.Src)
+	draw.Draw(pageImg, textRect.Add(image.Pt(margin, margin)),
+		textImg, textRect.Min, draw.Src)
+	return pageImg
+}
+
+var (
+	previewEdgeColor = color.RGBA{0x00, 0x80, 0xff, 0xff}
+	previewCutColor  = color.RGBA{0xff, 0x00, 0x00, 0xff}
+)
+
+// InscribedPins returns the side of the largest square that fits within
+// the print area of the media, so that QR codes and text can be generated
+// to fit round labels without being clipped.
+func InscribedPins(mi *ql.MediaInfo) int {
+	if mi.Round {
+		return int(float64(mi.PrintAreaPins) / math.Sqrt2)
+	}
+	return mi.PrintAreaPins
+}
+
+// Orientation specifies which way labels are to be read on the media.
+type Orientation int
+
+const (
+	// OrientAuto only turns labels along the media if they don't fit across.
+	OrientAuto Orientation = iota
+	// OrientAcross keeps labels as they are, reading across the media.
+	OrientAcross
+	// OrientAlong turns labels left, so that they read along the media.
+	OrientAlong
+	// OrientAlongFlipped turns labels right, for the opposite direction.
+	OrientAlongFlipped
+)
+
+// Orient rotates a label, if needed, so that it reads the preferred way
+// on the given media.
+func Orient(img image.Image, mi *ql.MediaInfo, o Orientation) image.Image {
+	if o == OrientAuto {
+		bounds, canvas := img.Bounds(), mi.Canvas()
+		if bounds.Dx() <= InscribedPins(mi) &&
+			(canvas.Dy() == 0 || bounds.Dy() <= canvas.Dy()) {
+			o = OrientAcross
+		} else {
+			o = OrientAlong
+		}
+	}
+
+	switch o {
+	case OrientAlong:
+		return &imgutil.LeftRotate{Image: img}
+	case OrientAlongFlipped:
+		return &imgutil.RightRotate{Image: img}
+	default:
+		return img
+	}
+}
+
+// GenPreview places a label on a canvas representing the whole width
+// of the media, the way it is going to be printed with the given options,
+// or DefaultPrintOptions if nil. The edges of the printable area are marked
+// with blue lines, the cut with a red line.
+//
+// The result is only meant for display, it mustn't be sent to the printer.
+func GenPreview(img image.Image, mi *ql.MediaInfo,
+	opts *ql.PrintOptions) image.Image {
+	placement, length := ql.Placement(img, mi, opts)
+
+	// Leave one pixel on each side for the edge markers.
+	left := mi.SideMarginPins + 1
+	right := left + mi.PrintAreaPins
+	previewRect := image.Rect(0, 0, right+mi.SideMarginPins+1, length+1)
+	previewImg := image.NewRGBA(previewRect)
+	draw.Draw(previewImg, previewRect, image.White, image.ZP, draw.Src)
+
+	// Anything beyond the length doesn't get printed.
+	placement = placement.Add(image.Pt(left, 0))
+	target := placement.Intersect(image.Rect(0, 0, previewRect.Dx(), length))
+	draw.Draw(previewImg, target, img,
+		img.Bounds().Min.Add(target.Min.Sub(placement.Min)), draw.Src)
+
+	for y := 0; y < length; y++ {
+		previewImg.Set(left-1, y, previewEdgeColor)
+		previewImg.Set(right, y, previewEdgeColor)
+	}
+	if mi.Round {
+		// Mark the edge of the label, one point per row is enough.
+		r := float64(mi.PrintAreaPins) / 2
+		for y := 0; y < length; y++ {
+			dy := float64(y) + .5 - r
+			dx := int(math.Sqrt(math.Max(0, r*r-dy*dy)))
+			previewImg.Set(left+int(r)-dx, y, previewEdgeColor)
+			previewImg.Set(left+int(r)+dx-1, y, previewEdgeColor)
+		}
+	}
+	for x := 0; x < previewRect.Dx(); x++ {
+		previewImg.Set(x, length, previewCutColor)
+	}
+	return previewImg
+}
+
+// GenCalibrationGrid renders vertical lines across the whole print area
+// of the media, every ten pins, with every fifth one being longer and labelled
+// with its offset in pins from the left edge. Printed out, it shows where
+// the printable area of a particular printer really begins and ends.
+func GenCalibrationGrid(font *bdf.Font, mi *ql.MediaInfo) image.Image {
+	imgRect := mi.Canvas()
+	if imgRect.Dy() == 0 {
+		imgRect.Max.Y = 100
+	}
+	height := imgRect.Dy()
+
+	img := image.NewRGBA(imgRect)
+	draw.Draw(img, imgRect, image.White, image.ZP, draw.Src)
+
+	for x := 0; x < imgRect.Dx(); x += 10 {
+		length := height / 4
+		if x%50 == 0 {
+			length = height
+
+			number := strconv.Itoa(x)
+			r, _ := font.BoundString(number)
+			font.DrawString(img, image.Pt(x+2, -r.Min.Y+2), color.Black, number)
+		}
+		for y := height - length; y < height; y++ {
+			img.Set(x, y, color.Black)
+		}
+	}
 	return img
 }
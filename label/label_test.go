@@ -0,0 +1,796 @@
+package label
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/imgutil"
+	"janouch.name/sklad/logutil"
+	"janouch.name/sklad/ql"
+
+	"github.com/boombuler/barcode/qr"
+)
+
+// testFont loads the font shared by tests, made of solid boxes.
+func testFont(t *testing.T) *bdf.Font {
+	f, err := os.Open("../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	font, err := bdf.NewFromBDF(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return font
+}
+
+func sameImages(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			if color.GrayModel.Convert(a.At(x, y)) !=
+				color.GrayModel.Convert(b.At(x, y)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestGenLabelForWidthLineEndings(t *testing.T) {
+	font := testFont(t)
+	line := GenLabelForWidth(font, "A", 100, 2).Bounds().Dy()
+	want := GenLabelForWidth(font, "AB\nC", 100, 2)
+	if dy := want.Bounds().Dy(); dy != 2*line {
+		t.Fatalf("two lines are %d pixels high, one line %d", dy, line)
+	}
+
+	for _, text := range []string{
+		"AB\r\nC", "AB\rC", "AB\nC\n", "AB\r\nC\r\n\r\n", "AB\rC\r",
+	} {
+		if got := GenLabelForWidth(font, text, 100, 2); !sameImages(got, want) {
+			t.Errorf("%q: rendered differently from %q", text, "AB\nC")
+		}
+	}
+
+	got := GenLabelForWidth(font, "AB\n\nC", 100, 2)
+	if dy := got.Bounds().Dy(); dy != 3*line {
+		t.Errorf("inner empty lines got dropped")
+	}
+}
+
+func TestGenCalibrationGrid(t *testing.T) {
+	font := testFont(t)
+	for _, mi := range []*ql.MediaInfo{
+		ql.GetMediaInfo(62, 0), ql.GetMediaInfo(62, 29),
+	} {
+		img := GenCalibrationGrid(font, mi)
+		if dx := img.Bounds().Dx(); dx != mi.PrintAreaPins {
+			t.Errorf("%+v: the grid is %d pins wide", mi, dx)
+		}
+
+		// The bottom row only contains the lines.
+		y := img.Bounds().Max.Y - 1
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			black := color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128
+			if black != (x%10 == 0) {
+				t.Errorf("%+v: unexpected pixel at pin %d", mi, x)
+			}
+		}
+	}
+}
+
+func TestAddFooterWidth(t *testing.T) {
+	font := testFont(t)
+	img := image.NewRGBA(image.Rect(0, 0, 50, 20))
+	for _, text := range []string{"x", strings.Repeat("long footer ", 10)} {
+		if dx := AddFooter(font, img, text, 2).Bounds().Dx(); dx != 50 {
+			t.Errorf("%q: footer changed the width to %d", text, dx)
+		}
+	}
+}
+
+// testClock replaces the clock with one that advances by step whenever
+// it is read, and returns debug log output.
+func testClock(t *testing.T, step time.Duration) *bytes.Buffer {
+	b, logger := &bytes.Buffer{}, logutil.Default
+	logutil.Default = logutil.New(b, logutil.LevelDebug)
+
+	var clock time.Time
+	now = func() time.Time {
+		clock = clock.Add(step)
+		return clock
+	}
+	t.Cleanup(func() {
+		logutil.Default, now = logger, time.Now
+	})
+	return b
+}
+
+func TestGenLabelTiming(t *testing.T) {
+	font := testFont(t)
+	for _, test := range []struct {
+		name string
+		gen  func() (image.Image, error)
+	}{
+		{"width", func() (image.Image, error) {
+			return GenLabelForWidth(font, "Hello\nworld", 200, 2), nil
+		}},
+		{"height", func() (image.Image, error) {
+			return GenLabelForHeight(font, "X123", 100, 1, nil)
+		}},
+	} {
+		expected, err := test.gen()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		b := testClock(t, 250*time.Millisecond)
+		img, err := test.gen()
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !sameImages(img, expected) {
+			t.Errorf("%s: timing has changed the label", test.name)
+		}
+
+		prefix := fmt.Sprintf("generated a %dx%d label at scale ",
+			img.Bounds().Dx(), img.Bounds().Dy())
+		if log := b.String(); !strings.Contains(log, prefix) ||
+			!strings.HasSuffix(log, " in 250ms\n") {
+			t.Errorf("%s: unexpected log output: %q", test.name, log)
+		}
+	}
+}
+
+// inkBounds returns the bounding box of black pixels within r of an image.
+func inkBounds(img image.Image, r image.Rectangle) (ink image.Rectangle) {
+	r = r.Intersect(img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			if color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y < 128 {
+				ink = ink.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return
+}
+
+func TestGenContentsSheet(t *testing.T) {
+	font := testFont(t)
+	img := GenContentsSheet(font, "Shelf", []ContentsItem{
+		{Id: "XA1", Description: "Screws"},
+		{Id: "XA2", Description: "Nuts\nand bolts", Depth: 1},
+		{Id: "XA3", Depth: 1},
+	}, 600, 100, 1)
+
+	// The page gets extended to fit all six lines of text within margins.
+	const margin, lineHeight = 30, 7
+	if bounds := img.Bounds(); bounds != image.Rect(
+		0, 0, 600, 2*margin+6*lineHeight) {
+		t.Fatalf("unexpected page bounds: %v", bounds)
+	}
+
+	for i, test := range []struct {
+		text   string
+		indent int // in spaces
+	}{
+		{"Shelf", 0},
+		{"", 0},
+		{"XA1  Screws", 0},
+		{"XA2  Nuts", 4},
+		{"and bolts", 8},
+		{"XA3", 4},
+	} {
+		y := margin + i*lineHeight
+		ink := inkBounds(img, image.Rect(0, y, 600, y+lineHeight))
+		if test.text == "" {
+			if !ink.Empty() {
+				t.Errorf("line %d: expected to be blank", i)
+			}
+			continue
+		}
+
+		// Each glyph is a box, five pixels wide, spaced by one pixel.
+		width := len(test.text)*6 - 1
+		if x := margin + test.indent*6; ink != image.Rect(
+			x, y, x+width, y+lineHeight) {
+			t.Errorf("line %d: %q is drawn at %v", i, test.text, ink)
+		}
+	}
+}
+
+func TestWriteQRLabelSVG(t *testing.T) {
+	font := testFont(t)
+	module := regexp.MustCompile(
+		`<rect x="(\d+)" y="(\d+)" width="(\d+)" height="(\d+)"/>`)
+	for _, test := range []struct {
+		text          string
+		height, scale int
+	}{
+		{"X1", 100, 1},
+		{"XAB123", 200, 2},
+		{"Box 42: screws, nuts & bolts", 300, 1},
+	} {
+		code, err := qr.Encode(test.text, qr.H, qr.Auto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dark := 0
+		for y := 0; y < code.Bounds().Dy(); y++ {
+			for x := 0; x < code.Bounds().Dx(); x++ {
+				if r, _, _, _ := code.At(x, y).RGBA(); r < 0x8000 {
+					dark++
+				}
+			}
+		}
+
+		var b strings.Builder
+		if err := WriteQRLabelSVG(&b, font,
+			test.text, test.height, test.scale, nil); err != nil {
+			t.Fatalf("%q: %s", test.text, err)
+		}
+		img, err := GenLabelForHeight(font,
+			test.text, test.height, test.scale, nil)
+		if err != nil {
+			t.Fatalf("%q: %s", test.text, err)
+		}
+
+		svg := b.String()
+		if !strings.Contains(svg, fmt.Sprintf(`width="%d" height="%d"`,
+			img.Bounds().Dx(), img.Bounds().Dy())) {
+			t.Errorf("%q: the dimensions don't match %v",
+				test.text, img.Bounds())
+		}
+
+		rects := module.FindAllStringSubmatch(svg, -1)
+		if len(rects) != dark {
+			t.Errorf("%q: got %d module rects, want %d",
+				test.text, len(rects), dark)
+		}
+		for _, rect := range rects {
+			var r [4]int
+			for i := range r {
+				r[i], _ = strconv.Atoi(rect[i+1])
+			}
+			x, y := r[0]+r[2]/2, r[1]+r[3]/2
+			if inkBounds(img, image.Rect(x, y, x+1, y+1)).Empty() {
+				t.Errorf("%q: module at %d, %d is white in the raster",
+					test.text, x, y)
+				break
+			}
+		}
+	}
+}
+
+func TestGenPreview(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		dx, dy            int
+		opts              ql.PrintOptions
+		offset            image.Point // where the label should be placed
+		length            int
+	}{
+		{62, 0, 696, 50, ql.PrintOptions{}, image.Pt(13, 0), 50},
+		{62, 0, 300, 50, ql.PrintOptions{}, image.Pt(409, 0), 50},
+		{62, 0, 300, 50, ql.PrintOptions{Center: true}, image.Pt(211, 0), 50},
+		{62, 0, 696, 50, ql.PrintOptions{MarginAdjust: 5},
+			image.Pt(8, 0), 50},
+		{62, 0, 696, 50, ql.PrintOptions{TearOffFeedDots: 30},
+			image.Pt(13, 0), 80},
+		{62, 29, 696, 271, ql.PrintOptions{}, image.Pt(13, 0), 271},
+		{62, 29, 296, 100, ql.PrintOptions{}, image.Pt(213, 0), 271},
+		{62, 29, 296, 100, ql.PrintOptions{MarginAdjust: -3},
+			image.Pt(216, 0), 271},
+	} {
+		mi := ql.GetMediaInfo(test.widthMM, test.lengthMM)
+		img := image.NewGray(image.Rect(0, 0, test.dx, test.dy))
+		for i := range img.Pix {
+			img.Pix[i] = uint8(i * 7 % 256)
+		}
+
+		preview := GenPreview(img, mi, &test.opts)
+		length := test.length
+		if bounds := preview.Bounds(); bounds != image.Rect(
+			0, 0, 2*mi.SideMarginPins+mi.PrintAreaPins+2, length+1) {
+			t.Errorf("%+v: unexpected bounds: %v", test, bounds)
+			continue
+		}
+
+		// Overlays may only be found at the printable edges and the cut.
+		left, right := mi.SideMarginPins, mi.SideMarginPins+mi.PrintAreaPins+1
+		bounds := preview.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				var c color.Color = color.White
+				switch {
+				case y == length:
+					c = previewCutColor
+				case x == left || x == right:
+					c = previewEdgeColor
+				case image.Pt(x, y).In(img.Rect.Add(test.offset)):
+					c = img.At(x-test.offset.X, y-test.offset.Y)
+				}
+				if color.RGBA64Model.Convert(preview.At(x, y)) !=
+					color.RGBA64Model.Convert(c) {
+					t.Fatalf("%+v: unexpected pixel at %d, %d", test, x, y)
+				}
+			}
+		}
+	}
+}
+
+// TestGenPreviewRaster checks that previews place labels exactly where
+// the printer would print them.
+func TestGenPreviewRaster(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		dx, dy            int
+		opts              ql.PrintOptions
+	}{
+		{62, 0, 300, 50, ql.PrintOptions{}},
+		{62, 0, 301, 50, ql.PrintOptions{Center: true}},
+		{62, 0, 300, 50, ql.PrintOptions{Center: true, MarginAdjust: 7}},
+		{29, 0, 100, 20, ql.PrintOptions{MarginAdjust: -4}},
+		{62, 29, 295, 100, ql.PrintOptions{}},
+		{24, 24, 101, 99, ql.PrintOptions{MarginAdjust: 2}},
+	} {
+		mi := ql.GetMediaInfo(test.widthMM, test.lengthMM)
+		img := image.NewGray(image.Rect(0, 0, test.dx, test.dy))
+
+		// The print area starts after the side margin, counting from the right
+		// of the print head, and after the edge marker in previews.
+		raster := ql.RasterPreview(img, mi, &test.opts)
+		rasterInk := inkBounds(raster, raster.Bounds())
+		rasterLeft := raster.Bounds().Dx() - mi.SideMarginPins -
+			mi.PrintAreaPins
+		want := rasterInk.Add(image.Pt(mi.SideMarginPins+1-rasterLeft, 0))
+
+		preview := GenPreview(img, mi, &test.opts)
+		if ink := blackBounds(preview); ink != want {
+			t.Errorf("%+v: the label is at %v, not %v", test, ink, want)
+		}
+		if dy := preview.Bounds().Dy() - 1; dy != raster.Bounds().Dy() {
+			t.Errorf("%+v: the preview is %d long, not %d",
+				test, dy, raster.Bounds().Dy())
+		}
+	}
+}
+
+// blackBounds returns the bounds of purely black pixels, unlike inkBounds,
+// which would also include coloured markers in previews.
+func blackBounds(img image.Image) (ink image.Rectangle) {
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if r, g, b, _ := img.At(x, y).RGBA(); r|g|b == 0 {
+				ink = ink.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return
+}
+
+func TestQRLabelGap(t *testing.T) {
+	font := testFont(t)
+	for _, test := range []struct {
+		height, gap int
+		spacing     int // the actual space between the QR code and the text
+	}{
+		{200, 0, 0},
+		{200, 10, 10},
+		{200, 20, 20},
+		{200, 45, 45},
+		{30, 20, 16},
+		{14, 20, 0},
+		{10, 20, 0},
+	} {
+		opts := &QRLabelOptions{Gap: test.gap}
+		layout := LayoutQRLabel(font, "XA1", test.height, 2, opts)
+		if spacing := layout.Text.Min.Y - layout.QR.Max.Y; spacing !=
+			test.spacing {
+			t.Errorf("%+v: got spacing %d", test, spacing)
+		}
+		if layout.QR.Dy() < 0 || layout.Bounds.Dy() != test.height {
+			t.Errorf("%+v: invalid layout %+v", test, layout)
+		}
+
+		// The text must be rendered right where the layout says it is.
+		img, err := GenLabelForHeight(font, "XA1", test.height, 2, opts)
+		if err != nil {
+			t.Errorf("%+v: %s", test, err)
+		} else if ink := inkBounds(img, layout.Text); layout.Text.Max.Y <=
+			test.height && ink != layout.Text {
+			t.Errorf("%+v: text rendered at %v, not %v",
+				test, ink, layout.Text)
+		}
+	}
+}
+
+func TestRoundCentering(t *testing.T) {
+	for _, size := range []int{12, 24, 58} {
+		mi := ql.GetMediaInfo(size, size)
+		side := InscribedPins(mi)
+		if r := float64(mi.PrintAreaPins) / 2; float64(side)/2*math.Sqrt2 > r {
+			t.Errorf("%d mm: %d pins don't fit in the circle", size, side)
+		}
+
+		img := image.NewGray(image.Rect(0, 0, side, side))
+		preview := GenPreview(img, mi, nil)
+
+		// Only the label itself is purely black, markers are coloured.
+		ink := blackBounds(preview)
+
+		left, top := mi.SideMarginPins+1, 0
+		right, bottom := left+mi.PrintAreaPins, mi.PrintAreaLength
+		if ink.Dx() != side || ink.Dy() != side {
+			t.Errorf("%d mm: the label is drawn as %v", size, ink)
+		} else if dx := (ink.Min.X - left) - (right - ink.Max.X); dx < -1 ||
+			dx > 1 {
+			t.Errorf("%d mm: not centered horizontally: %v", size, ink)
+		} else if dy := (ink.Min.Y - top) - (bottom - ink.Max.Y); dy < -1 ||
+			dy > 1 {
+			t.Errorf("%d mm: not centered vertically: %v", size, ink)
+		}
+	}
+}
+
+func TestClampScale(t *testing.T) {
+	for _, test := range []struct {
+		scale, clamped int
+	}{
+		{0, 1},
+		{-5, 1},
+		{99999, MaxScale},
+		{1, 1},
+		{3, 3},
+		{MaxScale, MaxScale},
+		{MaxScale + 1, MaxScale},
+	} {
+		if clamped := ClampScale(test.scale); clamped != test.clamped {
+			t.Errorf("%d: got %d, want %d", test.scale, clamped, test.clamped)
+		}
+	}
+}
+
+func TestGenLabelForHeightErrors(t *testing.T) {
+	font := testFont(t)
+	want, err := GenLabelForHeight(font, "XA1", 100, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img, err := GenLabelForHeight(
+		font, " XA1\t\n", 100, 1, nil); err != nil {
+		t.Errorf("padded text: %s", err)
+	} else if !sameImages(img, want) {
+		t.Error("padded text doesn't encode the trimmed text")
+	}
+
+	// Leave space for a QR code, but too little for all of its modules.
+	opts := &QRLabelOptions{}
+	textHeight := LayoutQRLabel(font, "XA1", 100, 1, opts).Text.Dy()
+	for _, test := range []struct {
+		name   string
+		text   string
+		height int
+		opts   *QRLabelOptions
+		err    error
+	}{
+		{"empty", "", 100, nil, errEmptyText},
+		{"whitespace", " \t\r\n", 100, nil, errEmptyText},
+		{"control characters", "XA\x001", 100, nil, errControlCharacters},
+		{"too long", strings.Repeat("A", 2000), 100, nil, nil},
+		{"too small", "XA1", textHeight + 10, opts, nil},
+	} {
+		img, err := GenLabelForHeight(font, test.text, test.height, 1,
+			test.opts)
+		if err == nil || test.err != nil && err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if img != nil {
+			t.Errorf("%s: an image has been returned", test.name)
+		}
+	}
+}
+
+func TestCheckGlyphs(t *testing.T) {
+	font := testFont(t)
+	for _, test := range []struct {
+		text    string
+		missing string
+	}{
+		{"XA1", ""},
+		{"XA1\nScrews", ""},
+		{"XČ1", `'Č'`},
+		{"ČŘČ 1ř", `'Č', 'Ř', 'ř'`},
+	} {
+		err := CheckGlyphs(font, test.text)
+		if test.missing == "" {
+			if err != nil {
+				t.Errorf("%q: %s", test.text, err)
+			}
+		} else if err == nil || !strings.HasSuffix(err.Error(), test.missing) {
+			t.Errorf("%q: got %v, want %s missing",
+				test.text, err, test.missing)
+		}
+	}
+
+	// QR labels must not silently differ from their code.
+	if img, err := GenLabelForHeight(font, "XČ1", 100, 1, nil); err == nil {
+		t.Errorf("an unrenderable rune has been accepted")
+	} else if img != nil {
+		t.Errorf("an image has been returned")
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// Marking the top left corner, to check the direction of rotation.
+	mark := func(w, h int) image.Image {
+		img := image.NewGray(image.Rect(0, 0, w, h))
+		for i := range img.Pix {
+			img.Pix[i] = 0xff
+		}
+		img.SetGray(0, 0, color.Gray{})
+		return img
+	}
+
+	tape, dieCut := ql.GetMediaInfo(62, 0), ql.GetMediaInfo(62, 29)
+	for _, test := range []struct {
+		name        string
+		img         image.Image
+		mi          *ql.MediaInfo
+		orientation Orientation
+		corner      image.Point // where the mark ends up, or -1 unturned
+	}{
+		{"fits", mark(100, 20), tape, OrientAuto, image.Pt(-1, -1)},
+		{"too wide", mark(1000, 20), tape, OrientAuto, image.Pt(0, 999)},
+		{"too tall", mark(100, 500), dieCut, OrientAuto, image.Pt(0, 99)},
+		{"across", mark(1000, 20), tape, OrientAcross, image.Pt(-1, -1)},
+		{"along", mark(100, 20), tape, OrientAlong, image.Pt(0, 99)},
+		{"flipped", mark(100, 20), tape, OrientAlongFlipped,
+			image.Pt(19, 0)},
+	} {
+		img := Orient(test.img, test.mi, test.orientation)
+		if test.corner.X < 0 {
+			if img != test.img {
+				t.Errorf("%s: the label has been turned", test.name)
+			}
+			continue
+		}
+
+		switch img.(type) {
+		case *imgutil.LeftRotate:
+			if test.orientation == OrientAlongFlipped {
+				t.Errorf("%s: turned left", test.name)
+			}
+		case *imgutil.RightRotate:
+			if test.orientation != OrientAlongFlipped {
+				t.Errorf("%s: turned right", test.name)
+			}
+		default:
+			t.Errorf("%s: the label hasn't been turned", test.name)
+			continue
+		}
+
+		size := test.img.Bounds().Size()
+		if img.Bounds().Size() != image.Pt(size.Y, size.X) {
+			t.Errorf("%s: got bounds %v", test.name, img.Bounds())
+		}
+		ink := blackBounds(img)
+		if corner := ink.Min.Sub(img.Bounds().Min); ink.Dx() != 1 ||
+			ink.Dy() != 1 || corner != test.corner {
+			t.Errorf("%s: the corner is at %v, want %v",
+				test.name, corner, test.corner)
+		}
+	}
+}
+
+func TestAddFrame(t *testing.T) {
+	// The label has a black dot in each of its corners, and is offset.
+	img := image.NewGray(image.Rect(10, 20, 30, 30))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for _, p := range []image.Point{{10, 20}, {29, 20}, {10, 29}, {29, 29}} {
+		img.SetGray(p.X, p.Y, color.Gray{})
+	}
+
+	const thickness, padding = 2, 3
+	framed := AddFrame(img, thickness, padding)
+	bounds := framed.Bounds()
+	if bounds != image.Rect(0, 0, 20+10, 10+10) {
+		t.Fatalf("got bounds %v", bounds)
+	}
+
+	inner := bounds.Inset(thickness)
+	contents := bounds.Inset(thickness + padding)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			p := image.Pt(x, y)
+			black := imgutil.IsBlack(framed, x, y)
+			switch {
+			case !p.In(inner):
+				if !black {
+					t.Fatalf("%v: the frame is interrupted", p)
+				}
+			case !p.In(contents):
+				if black {
+					t.Fatalf("%v: the padding isn't clear", p)
+				}
+			default:
+				q := p.Sub(contents.Min).Add(img.Bounds().Min)
+				if black != imgutil.IsBlack(img, q.X, q.Y) {
+					t.Fatalf("%v: the label has changed", p)
+				}
+			}
+		}
+	}
+}
+
+func TestQRRatio(t *testing.T) {
+	font := testFont(t)
+	const height = 150
+	layoutFor := func(height int, ratio float64) QRLabelLayout {
+		opts := QRLabelOptions{Gap: 10, QRRatio: ratio}
+		return LayoutQRLabel(font, "XA1", height, 1, &opts)
+	}
+	layout := func(ratio float64) QRLabelLayout {
+		return layoutFor(height, ratio)
+	}
+
+	var last QRLabelLayout
+	for i, ratio := range []float64{0.2, 0.4, 0.6, 0.8} {
+		l := layout(ratio)
+		if float64(l.QR.Dy()) < ratio*height {
+			t.Errorf("%v: the QR code is only %d high", ratio, l.QR.Dy())
+		}
+		if l.Text.Max.Y > height || l.Text.Empty() {
+			t.Errorf("%v: the text doesn't fit: %v", ratio, l.Text)
+		}
+		if i > 0 && (l.QR.Dy() <= last.QR.Dy() ||
+			l.Text.Dy() >= last.Text.Dy()) {
+			t.Errorf("%v: QR code %d, text %d, before %d and %d", ratio,
+				l.QR.Dy(), l.Text.Dy(), last.QR.Dy(), last.Text.Dy())
+		}
+		last = l
+	}
+
+	// Extreme ratios get clamped.
+	if layout(0.01) != layout(MinQRRatio) {
+		t.Errorf("low ratios aren't clamped")
+	}
+	if layoutFor(1000, 1) != layoutFor(1000, MaxQRRatio) {
+		t.Errorf("high ratios aren't clamped")
+	}
+}
+
+// countBlobs returns the number of 4-connected areas of black pixels.
+func countBlobs(img image.Image) (count int) {
+	bounds := img.Bounds()
+	seen := map[image.Point]bool{}
+	var fill func(p image.Point)
+	fill = func(p image.Point) {
+		if seen[p] || !p.In(bounds) {
+			return
+		}
+		if r, g, b, _ := img.At(p.X, p.Y).RGBA(); r|g|b != 0 {
+			return
+		}
+		seen[p] = true
+		fill(p.Add(image.Pt(1, 0)))
+		fill(p.Add(image.Pt(-1, 0)))
+		fill(p.Add(image.Pt(0, 1)))
+		fill(p.Add(image.Pt(0, -1)))
+	}
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if p := image.Pt(x, y); !seen[p] {
+				fill(p)
+				if seen[p] {
+					count++
+				}
+			}
+		}
+	}
+	return
+}
+
+func TestGlyphSheet(t *testing.T) {
+	// Ten printable glyphs, each a separate box, and a tab to be skipped.
+	bdfFile := "STARTFONT 2.1\nFONT test\nSIZE 7 75 75\n" +
+		"FONTBOUNDINGBOX 3 4 0 0\nSTARTPROPERTIES 2\n" +
+		"FONT_ASCENT 6\nFONT_DESCENT 1\nENDPROPERTIES\n"
+	for _, r := range "\t0123456789" {
+		bdfFile += fmt.Sprintf("STARTCHAR x\nENCODING %d\nDWIDTH 4 0\n"+
+			"BBX 3 4 0 0\nBITMAP\nE0\nE0\nE0\nE0\nENDCHAR\n", r)
+	}
+	font, err := bdf.NewFromBDF(strings.NewReader(bdfFile + "ENDFONT\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, scale := range []int{1, 2} {
+		// Five glyphs fit on a line, so the sheet must wrap.
+		img := GenGlyphSheet(font, 20*scale, scale)
+		if n := countBlobs(img); n != 10 {
+			t.Errorf("scale %d: got %d glyphs, want 10", scale, n)
+		}
+		if ink := blackBounds(img); ink.Dy() <= 4*scale {
+			t.Errorf("scale %d: the glyphs occupy %v", scale, ink)
+		}
+	}
+}
+
+func TestCaptionedLabel(t *testing.T) {
+	font := testFont(t)
+	if _, err := GenCaptionedLabel(font, "A", "B",
+		image.NewGray(image.Rect(0, 0, 10, 10)),
+		ql.GetMediaInfo(62, 0)); err == nil {
+		t.Errorf("continuous tape has been accepted")
+	}
+
+	// The center is grey so that it can be told apart from the captions.
+	mi := ql.GetMediaInfo(62, 29)
+	for _, size := range []int{50, 5000} {
+		center := image.NewGray(image.Rect(10, 10, 10+size, 10+size))
+		for i := range center.Pix {
+			center.Pix[i] = 0x80
+		}
+
+		img, err := GenCaptionedLabel(font, "XA1", "Shelf", center, mi)
+		if err != nil {
+			t.Fatalf("%d: %s", size, err)
+		}
+		if img.Bounds() != mi.Canvas() {
+			t.Fatalf("%d: got bounds %v, want %v",
+				size, img.Bounds(), mi.Canvas())
+		}
+
+		var above, below, grey image.Rectangle
+		bounds := img.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				pixel := image.Rect(x, y, x+1, y+1)
+				switch color.GrayModel.Convert(img.At(x, y)) {
+				case color.Gray{0x80}:
+					grey = grey.Union(pixel)
+				case color.Gray{0}:
+					if y < bounds.Dy()/2 {
+						above = above.Union(pixel)
+					} else {
+						below = below.Union(pixel)
+					}
+				}
+			}
+		}
+		if grey.Empty() || above.Empty() || below.Empty() {
+			t.Fatalf("%d: something is missing", size)
+		}
+		if above.Max.Y > grey.Min.Y || below.Min.Y < grey.Max.Y {
+			t.Errorf("%d: captions at %v and %v overlap the center at %v",
+				size, above, below, grey)
+		}
+		if size <= bounds.Dx() && grey.Size() != center.Bounds().Size() {
+			t.Errorf("%d: the center has been resized to %v",
+				size, grey.Size())
+		}
+		if left, right := grey.Min.X, bounds.Max.X-grey.Max.X; left-right > 1 ||
+			right-left > 1 {
+			t.Errorf("%d: the center isn't centered: %v", size, grey)
+		}
+	}
+}
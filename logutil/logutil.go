@@ -0,0 +1,138 @@
+// Package logutil provides a minimal leveled logger on top of package log.
+package logutil
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// String implements flag.Value.
+func (l *Level) String() string {
+	if *l < 0 || int(*l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(*l))
+	}
+	return levelNames[*l]
+}
+
+// Set implements flag.Value.
+func (l *Level) Set(s string) error {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			*l = Level(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown log level: %s", s)
+}
+
+// IsTerminal returns whether w is likely to be an interactive terminal,
+// and thus whether it makes sense to output ANSI escape sequences to it.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// WantsColor returns whether ANSI escape sequences should be written to w,
+// which is when it is a terminal, and the user hasn't set NO_COLOR.
+func WantsColor(w io.Writer) bool {
+	return IsTerminal(w) && os.Getenv("NO_COLOR") == ""
+}
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+// StripANSI removes ANSI SGR and similar escape sequences from s.
+func StripANSI(s string) string { return ansiEscape.ReplaceAllString(s, "") }
+
+// -----------------------------------------------------------------------------
+
+// Logger filters messages by their level. Messages may contain ANSI escape
+// sequences, which are stripped unless the output is a terminal.
+type Logger struct {
+	Level  Level
+	Color  bool
+	logger *log.Logger
+}
+
+// New creates a logger writing to w, which only lets through messages
+// of the given level or higher.
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		Level:  level,
+		Color:  WantsColor(w),
+		logger: log.New(w, "", log.LstdFlags),
+	}
+}
+
+var levelColors = []string{"\x1b[2m", "", "\x1b[33m", "\x1b[31m"}
+
+func (l *Logger) output(level Level, msg string) {
+	if level < l.Level {
+		return
+	}
+	if level != LevelInfo {
+		msg = strings.ToUpper(level.String()) + ": " + msg
+	}
+	if !l.Color {
+		msg = StripANSI(msg)
+	} else if color := levelColors[level]; color != "" {
+		msg = color + msg + "\x1b[m"
+	}
+	l.logger.Output(3, strings.TrimSuffix(msg, "\n"))
+}
+
+func (l *Logger) Debugf(format string, v ...interface{}) {
+	l.output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Infof(format string, v ...interface{}) {
+	l.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Warnf(format string, v ...interface{}) {
+	l.output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func (l *Logger) Errorf(format string, v ...interface{}) {
+	l.output(LevelError, fmt.Sprintf(format, v...))
+}
+
+// -----------------------------------------------------------------------------
+
+// Default is the logger used by package-level functions, writing to stderr.
+var Default = New(os.Stderr, LevelInfo)
+
+func Debugf(format string, v ...interface{}) {
+	Default.output(LevelDebug, fmt.Sprintf(format, v...))
+}
+
+func Infof(format string, v ...interface{}) {
+	Default.output(LevelInfo, fmt.Sprintf(format, v...))
+}
+
+func Warnf(format string, v ...interface{}) {
+	Default.output(LevelWarn, fmt.Sprintf(format, v...))
+}
+
+func Errorf(format string, v ...interface{}) {
+	Default.output(LevelError, fmt.Sprintf(format, v...))
+}
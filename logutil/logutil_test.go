@@ -0,0 +1,112 @@
+package logutil
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	for _, test := range []struct {
+		level  Level
+		output []string
+	}{
+		{LevelDebug, []string{"DEBUG: d", "i", "WARN: w", "ERROR: e"}},
+		{LevelInfo, []string{"i", "WARN: w", "ERROR: e"}},
+		{LevelError, []string{"ERROR: e"}},
+	} {
+		var b bytes.Buffer
+		l := New(&b, test.level)
+		l.logger.SetFlags(0)
+		l.Debugf("d")
+		l.Infof("i")
+		l.Warnf("w")
+		l.Errorf("e")
+
+		output := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+		if strings.Join(output, "|") != strings.Join(test.output, "|") {
+			t.Errorf("%s: got %q", &test.level, output)
+		}
+	}
+}
+
+func TestLevelFlag(t *testing.T) {
+	var l Level
+	for _, name := range []string{"debug", "INFO", "Warn", "error"} {
+		if err := l.Set(name); err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if l.String() != strings.ToLower(name) {
+			t.Errorf("%s: got %s", name, &l)
+		}
+	}
+	if err := l.Set("verbose"); err == nil {
+		t.Errorf("an unknown level has been accepted")
+	}
+}
+
+func TestLoggerColor(t *testing.T) {
+	for _, color := range []bool{false, true} {
+		// Buffers aren't terminals, so escapes get stripped by default.
+		var b bytes.Buffer
+		l := New(&b, LevelInfo)
+		if l.Color {
+			t.Fatalf("a buffer is considered to be a terminal")
+		}
+		l.logger.SetFlags(0)
+		l.Color = color
+
+		l.Infof("\x1b[1mbold\x1b[m text")
+		l.Warnf("warning")
+		want := "bold text\nWARN: warning\n"
+		if color {
+			want = "\x1b[1mbold\x1b[m text\n\x1b[33mWARN: warning\x1b[m\n"
+		}
+		if b.String() != want {
+			t.Errorf("color %t: got %q, want %q", color, b.String(), want)
+		}
+	}
+}
+
+func TestWantsColor(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "status.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Redirected output must stay clean, whatever the environment says.
+	for _, noColor := range []string{"", "1"} {
+		t.Setenv("NO_COLOR", noColor)
+		if WantsColor(f) {
+			t.Errorf("NO_COLOR=%s: files want color", noColor)
+		}
+		if WantsColor(&bytes.Buffer{}) {
+			t.Errorf("NO_COLOR=%s: buffers want color", noColor)
+		}
+	}
+
+	// Character devices pass for terminals, NO_COLOR must still win.
+	if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		defer null.Close()
+		if IsTerminal(null) {
+			t.Setenv("NO_COLOR", "1")
+			if WantsColor(null) {
+				t.Errorf("NO_COLOR has been ignored")
+			}
+		}
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	for input, want := range map[string]string{
+		"plain":                          "plain",
+		"\x1b[1mBrother QL-800\x1b[m":    "Brother QL-800",
+		"\x1b[1;31mred\x1b[0m, \x1b[2Kx": "red, x",
+	} {
+		if got := StripANSI(input); got != want {
+			t.Errorf("%q: got %q, want %q", input, got, want)
+		}
+	}
+}
@@ -8,9 +8,19 @@ package ql
 //  http://www.undocprint.org/formats/communication_protocols/ieee_1284
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"image"
+	"image/color"
 	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+
+	"janouch.name/sklad/imgutil"
+	"janouch.name/sklad/logutil"
 )
 
 // -----------------------------------------------------------------------------
@@ -64,20 +74,65 @@ func compatible(id deviceID) bool {
 
 // -----------------------------------------------------------------------------
 
-type mediaSize struct {
+// MediaSize identifies media by their dimensions in millimetres,
+// with zero length for continuous tape.
+type MediaSize struct {
 	WidthMM  int
 	LengthMM int
 }
 
 type MediaInfo struct {
+	// The dimensions of the media this information is about.
+	MediaSize
 	// Note that these are approximates, many pins within the margins will work.
 	SideMarginPins int
 	PrintAreaPins  int
 	// If non-zero, length of the die-cut label print area in 300dpi pins.
 	PrintAreaLength int
+	// Whether these are round die-cut labels, with PrintAreaPins diameter.
+	Round bool
+	// Whether this size is made in a red-black variant. It says nothing
+	// about what is actually loaded, the printer refuses mismatches.
+	RedBlackCapable bool
+}
+
+// String returns a human-friendly name of the media.
+func (mi *MediaInfo) String() string {
+	switch {
+	case mi.LengthMM == 0:
+		return fmt.Sprintf("%d mm continuous tape", mi.WidthMM)
+	case mi.Round:
+		return fmt.Sprintf("%d mm round labels", mi.WidthMM)
+	default:
+		return fmt.Sprintf("%dx%d mm die-cut labels", mi.WidthMM, mi.LengthMM)
+	}
 }
 
-var media = map[mediaSize]MediaInfo{
+// MarshalJSON implements json.Marshaler, adding the name from String
+// to the other fields.
+func (mi MediaInfo) MarshalJSON() ([]byte, error) {
+	type plain MediaInfo
+	return json.Marshal(struct {
+		Name string
+		*plain
+	}{mi.String(), (*plain)(&mi)})
+}
+
+// Canvas returns the printable area as a rectangle at the origin,
+// of zero height for continuous tape, where images may be of any length.
+func (mi *MediaInfo) Canvas() image.Rectangle {
+	return image.Rect(0, 0, mi.PrintAreaPins, mi.PrintAreaLength)
+}
+
+// mediaPins contains, in order, SideMarginPins, PrintAreaPins
+// and PrintAreaLength of MediaInfo, so that the table below stays concise.
+type mediaPins [3]int
+
+// mediaMutex guards media, roundMedia, and redBlackMedia, which can be
+// extended by RegisterMedia at any time.
+var mediaMutex sync.RWMutex
+
+var media = map[MediaSize]mediaPins{
 	// Continuous length tape
 	{12, 0}: {29, 106, 0},
 	{29, 0}: {6, 306, 0},
@@ -106,9 +161,79 @@ var media = map[mediaSize]MediaInfo{
 	{58, 58}: {51, 618, 618},
 }
 
+var roundMedia = map[MediaSize]bool{
+	{12, 12}: true,
+	{24, 24}: true,
+	{58, 58}: true,
+}
+
+var redBlackMedia = map[MediaSize]bool{
+	{62, 0}: true,
+}
+
 func GetMediaInfo(widthMM, lengthMM int) *MediaInfo {
-	if mi, ok := media[mediaSize{widthMM, lengthMM}]; ok {
-		return &mi
+	mediaMutex.RLock()
+	defer mediaMutex.RUnlock()
+
+	size := MediaSize{widthMM, lengthMM}
+	if pins, ok := media[size]; ok {
+		return &MediaInfo{
+			MediaSize:       size,
+			SideMarginPins:  pins[0],
+			PrintAreaPins:   pins[1],
+			PrintAreaLength: pins[2],
+			Round:           roundMedia[size],
+			RedBlackCapable: redBlackMedia[size],
+		}
+	}
+	return nil
+}
+
+// ListMedia returns the sizes of all known media, ordered by width,
+// with continuous tape first.
+func ListMedia() (result []MediaSize) {
+	mediaMutex.RLock()
+	defer mediaMutex.RUnlock()
+
+	for size := range media {
+		result = append(result, size)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].WidthMM != result[j].WidthMM {
+			return result[i].WidthMM < result[j].WidthMM
+		}
+		return result[i].LengthMM < result[j].LengthMM
+	})
+	return
+}
+
+var errInvalidMedia = errors.New("invalid media")
+
+// RegisterMedia adds information about media missing from the built-in table,
+// or replaces it. Lengths are zero for continuous tape. The size within
+// the information is ignored in favour of the arguments.
+func RegisterMedia(widthMM, lengthMM int, mi MediaInfo) error {
+	if widthMM <= 0 || lengthMM < 0 || mi.SideMarginPins < 0 ||
+		mi.PrintAreaPins <= 0 || mi.PrintAreaLength < 0 ||
+		mi.SideMarginPins+mi.PrintAreaPins > printPins {
+		return errInvalidMedia
+	}
+
+	mediaMutex.Lock()
+	defer mediaMutex.Unlock()
+
+	size := MediaSize{widthMM, lengthMM}
+	media[size] = mediaPins{
+		mi.SideMarginPins, mi.PrintAreaPins, mi.PrintAreaLength}
+	if mi.Round {
+		roundMedia[size] = true
+	} else {
+		delete(roundMedia, size)
+	}
+	if mi.RedBlackCapable {
+		redBlackMedia[size] = true
+	} else {
+		delete(redBlackMedia, size)
 	}
 	return nil
 }
@@ -134,14 +259,47 @@ func pack(data [printPins]bool, out *[]byte) {
 	}
 }
 
+// Plane is where red-black printing puts a pixel.
+type Plane int
+
+const (
+	PlaneWhite Plane = iota // nothing gets printed
+	PlaneBlack              // the black plane
+	PlaneRed                // the red plane
+)
+
+// ClassifyRedBlack is the default mapping of colours to planes
+// in red-black printing. Only mostly opaque, mostly pure red
+// or black colours get printed.
+func ClassifyRedBlack(c color.Color) Plane {
+	r, g, b, a := c.RGBA()
+	switch {
+	case a < 0x8000 || g >= 0x4000 || b >= 0x4000:
+		return PlaneWhite
+	case r >= 0xc000:
+		return PlaneRed
+	case r < 0x4000:
+		return PlaneBlack
+	}
+	return PlaneWhite
+}
+
 // makeBitmapDataRB converts an image to the printer's red-black raster format.
-func makeBitmapDataRB(src image.Image, margin, length int) []byte {
+func makeBitmapDataRB(src image.Image, classify func(color.Color) Plane,
+	margin, top, length int) []byte {
 	data, bounds := []byte{}, src.Bounds()
+	for ; top > 0 && length > 0; top-- {
+		length--
+		data = append(data, 'w', 0x01, printBytes)
+		data = append(data, make([]byte, printBytes)...)
+		data = append(data, 'w', 0x02, printBytes)
+		data = append(data, make([]byte, printBytes)...)
+	}
 	if bounds.Dy() > length {
 		bounds.Max.Y = bounds.Min.Y + length
 	}
 	if bounds.Dx() > printPins-margin {
-		bounds.Max.X = bounds.Min.X + printPins
+		bounds.Max.X = bounds.Min.X + printPins - margin
 	}
 
 	redcells, blackcells := [printPins]bool{}, [printPins]bool{}
@@ -151,11 +309,9 @@ func makeBitmapDataRB(src image.Image, margin, length int) []byte {
 		// The graphics needs to be inverted horizontally, iterating backwards.
 		offset := margin
 		for x := bounds.Max.X - 1; x >= bounds.Min.X; x-- {
-			r, g, b, a := src.At(x, y).RGBA()
-			redcells[offset] = r >= 0xc000 && g < 0x4000 && b < 0x4000 &&
-				a >= 0x8000
-			blackcells[offset] = r < 0x4000 && g < 0x4000 && b < 0x4000 &&
-				a >= 0x8000
+			plane := classify(src.At(x, y))
+			redcells[offset] = plane == PlaneRed
+			blackcells[offset] = plane == PlaneBlack
 			offset++
 		}
 
@@ -174,18 +330,29 @@ func makeBitmapDataRB(src image.Image, margin, length int) []byte {
 }
 
 // makeBitmapData converts an image to the printer's raster format.
-func makeBitmapData(src image.Image, rb bool, margin, length int) []byte {
+// The image is offset by margin pins from the side, and top pins from the top.
+func makeBitmapData(src image.Image, opts *PrintOptions,
+	margin, top, length int) []byte {
 	// It's a necessary nuisance, so just copy and paste.
-	if rb {
-		return makeBitmapDataRB(src, margin, length)
+	if opts.RedBlack {
+		classify := opts.Classify
+		if classify == nil {
+			classify = ClassifyRedBlack
+		}
+		return makeBitmapDataRB(src, classify, margin, top, length)
 	}
 
 	data, bounds := []byte{}, src.Bounds()
+	for ; top > 0 && length > 0; top-- {
+		length--
+		data = append(data, 'g', 0x00, printBytes)
+		data = append(data, make([]byte, printBytes)...)
+	}
 	if bounds.Dy() > length {
 		bounds.Max.Y = bounds.Min.Y + length
 	}
 	if bounds.Dx() > printPins-margin {
-		bounds.Max.X = bounds.Min.X + printPins
+		bounds.Max.X = bounds.Min.X + printPins - margin
 	}
 
 	pixels := [printPins]bool{}
@@ -195,9 +362,7 @@ func makeBitmapData(src image.Image, rb bool, margin, length int) []byte {
 		// The graphics needs to be inverted horizontally, iterating backwards.
 		offset := margin
 		for x := bounds.Max.X - 1; x >= bounds.Min.X; x-- {
-			r, g, b, a := src.At(x, y).RGBA()
-			pixels[offset] = r < 0x4000 && g < 0x4000 && b < 0x4000 &&
-				a >= 0x8000
+			pixels[offset] = imgutil.IsBlack(src, x, y)
 			offset++
 		}
 
@@ -211,13 +376,178 @@ func makeBitmapData(src image.Image, rb bool, margin, length int) []byte {
 	return data
 }
 
+// rasterLayout determines how an image is placed on media: its offset in pins
+// from the side and from the top, and the number of raster lines to send.
+func rasterLayout(img image.Image, mediaInfo *MediaInfo,
+	opts *PrintOptions, last bool) (margin, top, length int) {
+	length = img.Bounds().Dy()
+	if mediaInfo.PrintAreaLength != 0 {
+		length = mediaInfo.PrintAreaLength
+	} else if last {
+		// The bitmap gets padded with blank lines.
+		length += opts.TearOffFeedDots
+	}
+
+	// Distribute any spare pins evenly on both sides of the image.
+	margin = mediaInfo.SideMarginPins
+	if dx := img.Bounds().Dx(); dx < mediaInfo.PrintAreaPins &&
+		(mediaInfo.PrintAreaLength != 0 || opts.Center) {
+		margin += (mediaInfo.PrintAreaPins - dx) / 2
+	}
+	margin += opts.MarginAdjust
+	if margin < 0 {
+		margin = 0
+	} else if margin > printPins {
+		margin = printPins
+	}
+
+	// Round labels also need to be centered vertically.
+	if mediaInfo.Round && img.Bounds().Dy() < length {
+		top = (length - img.Bounds().Dy()) / 2
+	}
+	return
+}
+
+// Placement returns where an image ends up when printed on the given media,
+// as the last image of a job, and how long the printed label is, all in pins.
+// The rectangle is relative to the left edge of the print area, the way
+// the label reads, and it may extend beyond the print area.
+// DefaultPrintOptions are used if opts is nil.
+func Placement(img image.Image, mediaInfo *MediaInfo,
+	opts *PrintOptions) (placement image.Rectangle, length int) {
+	if opts == nil {
+		opts = &DefaultPrintOptions
+	}
+
+	// The margin counts from the right, because of the horizontal inversion.
+	margin, top, length := rasterLayout(img, mediaInfo, opts, true)
+	bounds := img.Bounds()
+	right := mediaInfo.SideMarginPins + mediaInfo.PrintAreaPins - margin
+	return image.Rect(right-bounds.Dx(), top, right, top+bounds.Dy()), length
+}
+
+// RasterPreview reconstructs exactly what the printer would receive
+// for a single image on the given media, after thresholding, as a black
+// and white image spanning the whole print head. Red-black printing
+// is shown in red. DefaultPrintOptions are used if opts is nil.
+func RasterPreview(img image.Image, mediaInfo *MediaInfo,
+	opts *PrintOptions) image.Image {
+	if opts == nil {
+		opts = &DefaultPrintOptions
+	}
+
+	margin, top, length := rasterLayout(img, mediaInfo, opts, true)
+	data := makeBitmapData(img, opts, margin, top, length)
+	preview := image.NewPaletted(image.Rect(0, 0, printPins, length),
+		color.Palette{color.White, color.Black, color.RGBA{0xff, 0, 0, 0xff}})
+
+	// Each plane of a line consists of a three byte command and the data.
+	// The image has been inverted horizontally, so invert it back.
+	planes, stride := 1, 3+printBytes
+	if opts.RedBlack {
+		planes = 2
+	}
+	for y := 0; y < length; y++ {
+		for plane := 0; plane < planes; plane++ {
+			line := data[(y*planes+plane)*stride+3:][:printBytes]
+			for pin := 0; pin < printPins; pin++ {
+				if line[pin/8]&(0x80>>uint(pin%8)) != 0 {
+					preview.SetColorIndex(printPins-1-pin, y, uint8(1+plane))
+				}
+			}
+		}
+	}
+	return preview
+}
+
+// PrintOptions adjusts how images get printed.
+type PrintOptions struct {
+	// RedBlack selects red-black printing. Red pixels go to the red plane.
+	RedBlack bool
+	// Classify maps colours to planes in red-black printing,
+	// ClassifyRedBlack is used when it is nil.
+	Classify func(c color.Color) Plane
+	// Center horizontally centers narrow images even on continuous tape.
+	// Die-cut labels are always centered.
+	Center bool
+	// Fast gives priority to print speed over quality.
+	Fast bool
+	// MarginAdjust compensates for printers that are a few pins off,
+	// positive values move images towards their left side.
+	MarginAdjust int
+	// TearOffFeedDots extends the last image of a job on continuous tape
+	// with this many blank lines, so that it clears the tear bar
+	// on printers without a cutter. At most MaxTearOffFeedDots.
+	TearOffFeedDots int
+	// Retries is how many more times Print may try after transient errors.
+	Retries int
+	// Media, when non-zero, overrides the media reported by the printer,
+	// which may not recognize third-party tape.
+	Media MediaSize
+	// MaxLengthMM rejects longer images on continuous tape, so that
+	// a mistake can't waste a whole roll. Zero stands for DefaultMaxLengthMM,
+	// negative values disable the limit.
+	MaxLengthMM int
+}
+
+// MaxTearOffFeedDots limits TearOffFeedDots to about 10 cm.
+const MaxTearOffFeedDots = 1181
+
+// DefaultMaxLengthMM is the limit used when MaxLengthMM is zero.
+const DefaultMaxLengthMM = 500
+
+// DefaultPrintOptions are used when no options are given.
+var DefaultPrintOptions = PrintOptions{}
+
+// now is the clock used to time rasterization, replaceable by tests.
+var now = time.Now
+
+// dotsPerMM is the resolution of the printers along the direction of feed.
+const dotsPerMM = 300 / 25.4
+
+var errTooLong = errors.New("the image is too long for the configured limit")
+
+// checkLength verifies that an image is within MaxLengthMM on the given media.
+func checkLength(size MediaSize, img image.Image, opts *PrintOptions) error {
+	limit := opts.MaxLengthMM
+	if limit == 0 {
+		limit = DefaultMaxLengthMM
+	}
+	if size.LengthMM != 0 || limit < 0 {
+		return nil
+	}
+	if float64(img.Bounds().Dy()) > float64(limit)*dotsPerMM {
+		return fmt.Errorf("%w: %.0f > %d mm", errTooLong,
+			float64(img.Bounds().Dy())/dotsPerMM, limit)
+	}
+	return nil
+}
+
+// printMedia returns the media to print on, as given by options or status.
+func printMedia(status *Status, opts *PrintOptions) MediaSize {
+	if opts.Media != (MediaSize{}) {
+		return opts.Media
+	}
+	return MediaSize{status.MediaWidthMM(), status.MediaLengthMM()}
+}
+
+// Flags of the print information command.
+const (
+	printInfoKind    = 0x02 // the media type field is valid
+	printInfoWidth   = 0x04 // the media width field is valid
+	printInfoQuality = 0x40 // give priority to print quality
+	printInfoRecover = 0x80 // printer recovery, always on
+)
+
 // XXX: It would be preferrable to know for certain if this is a red-black tape,
 // because the printer refuses to print on a mismatch.
-func makePrintData(status *Status, image image.Image, rb bool) (data []byte) {
-	mediaInfo := GetMediaInfo(
-		status.MediaWidthMM(),
-		status.MediaLengthMM(),
-	)
+//
+// Pages are counted from zero. Only the last page of a job gets cut and fed
+// out, so that there is no waste between the pages of continuous tape.
+func makePrintData(status *Status, image image.Image,
+	opts *PrintOptions, page int, last bool) (data []byte) {
+	size := printMedia(status, opts)
+	mediaInfo := GetMediaInfo(size.WidthMM, size.LengthMM)
 	if mediaInfo == nil {
 		return nil
 	}
@@ -230,33 +560,45 @@ func makePrintData(status *Status, image image.Image, rb bool) (data []byte) {
 	data = append(data, 0x1b, 0x69, 0x21, 0x00)
 
 	// Print information command.
-	dy := image.Bounds().Dy()
-	if mediaInfo.PrintAreaLength != 0 {
-		dy = mediaInfo.PrintAreaLength
-	}
+	margin, top, dy := rasterLayout(image, mediaInfo, opts, last)
 
 	mediaType := byte(0x0a)
-	if status.MediaLengthMM() != 0 {
+	if size.LengthMM != 0 {
 		mediaType = byte(0x0b)
 	}
 
-	data = append(data, 0x1b, 0x69, 0x7a, 0x02|0x04|0x40|0x80, mediaType,
-		byte(status.MediaWidthMM()), byte(status.MediaLengthMM()),
-		byte(dy), byte(dy>>8), byte(dy>>16), byte(dy>>24), 0, 0x00)
+	startingPage := byte(0)
+	if page > 0 {
+		startingPage = 1
+	}
+
+	flags := byte(printInfoKind | printInfoWidth | printInfoRecover)
+	if !opts.Fast {
+		flags |= printInfoQuality
+	}
+
+	data = append(data, 0x1b, 0x69, 0x7a, flags, mediaType,
+		byte(size.WidthMM), byte(size.LengthMM),
+		byte(dy), byte(dy>>8), byte(dy>>16), byte(dy>>24), startingPage, 0x00)
 
-	// Auto cut, each 1 label.
-	data = append(data, 0x1b, 0x69, 0x4d, 0x40)
-	data = append(data, 0x1b, 0x69, 0x41, 0x01)
+	if last {
+		// Auto cut, each 1 label.
+		data = append(data, 0x1b, 0x69, 0x4d, 0x40)
+		data = append(data, 0x1b, 0x69, 0x41, 0x01)
+	} else {
+		// No cutting in the middle of a chain.
+		data = append(data, 0x1b, 0x69, 0x4d, 0x00)
+	}
 
 	// Cut at end (though it's the default).
 	// Not sure what it means, doesn't seem to have any effect to turn it off.
-	if rb {
+	if opts.RedBlack {
 		data = append(data, 0x1b, 0x69, 0x4b, 0x08|0x01)
 	} else {
 		data = append(data, 0x1b, 0x69, 0x4b, 0x08)
 	}
 
-	if status.MediaLengthMM() != 0 {
+	if size.LengthMM != 0 {
 		// 3mm margins along the direction of feed. 0x23 = 35 dots, the minimum.
 		data = append(data, 0x1b, 0x69, 0x64, 0x23, 0x00)
 	} else {
@@ -269,9 +611,17 @@ func makePrintData(status *Status, image image.Image, rb bool) (data []byte) {
 	data = append(data, 0x4d, 0x00)
 
 	// The graphics data itself.
-	bitmapData := makeBitmapData(image, rb, mediaInfo.SideMarginPins, dy)
+	start := now()
+	bitmapData := makeBitmapData(image, opts, margin, top, dy)
+	logutil.Debugf("built %d raster lines for %dx%d mm media in %s",
+		dy, size.WidthMM, size.LengthMM, now().Sub(start))
 	data = append(data, bitmapData...)
 
+	if !last {
+		// Print command without feeding.
+		return append(data, 0x0c)
+	}
+
 	// Print command with feeding.
 	return append(data, 0x1a)
 }
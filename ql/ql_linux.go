@@ -2,13 +2,18 @@ package ql
 
 import (
 	"errors"
+	"fmt"
 	"image"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 	"unsafe"
+
+	"janouch.name/sklad/logutil"
 )
 
 // #include <linux/ioctl.h>
@@ -48,61 +53,177 @@ func lpiocGetDeviceID(fd uintptr) ([]byte, error) {
 // -----------------------------------------------------------------------------
 
 type Printer struct {
-	File         *os.File
+	// File is the device file of the printer, or anything else that returns
+	// io.EOF from Read when no data is pending, as the usblp driver does.
+	File         io.ReadWriteCloser
 	Manufacturer string
 	Model        string
 
+	// LastStatus is guarded by readMutex, use Status to read it
+	// while a StatusChannel goroutine may be running.
 	LastStatus *Status
 	MediaInfo  *MediaInfo
 
-	// StatusNotify is called whenever we receive a status packet.
+	// StatusNotify is called whenever we receive a status packet
+	// that differs from the last one, or any packet if NotifyAll is set.
 	StatusNotify func(*Status)
+	NotifyAll    bool
+
+	// SkipDrain stops Initialize from discarding any pending responses,
+	// which can take up to drainTimeout. Only set it when nothing can be
+	// pending, such as between jobs on a handle kept open, or else stale
+	// status packets may be taken for replies to later requests.
+	SkipDrain bool
+
+	initialized bool // whether Initialize has succeeded before
+
+	jobOpts    *PrintOptions // options of the current job, if any
+	jobPending image.Image   // the last image of the job, not yet sent
+	jobPage    int           // number of pages already sent
+
+	counters      Counters   // communication statistics
+	countersMutex sync.Mutex // guards counters
+
+	readMutex   sync.Mutex     // serializes reading from the printer
+	statusMutex sync.Mutex     // guards starting and stopping the reader
+	statusChan  chan *Status   // receives statuses, see StatusChannel
+	statusDone  chan struct{}  // closing stops the status reader
+	statusWG    sync.WaitGroup // waits for the status reader to stop
+	closed      bool           // whether Close has been called
+}
+
+// Counters are cumulative statistics of communication with a printer,
+// useful for diagnosing unreliable connections.
+type Counters struct {
+	BytesWritten  uint64 // all data sent to the printer
+	BytesRead     uint64 // all data received from the printer
+	StatusPackets uint64 // complete status packets received
+}
+
+// Counters returns communication statistics since the printer was opened.
+func (p *Printer) Counters() Counters {
+	p.countersMutex.Lock()
+	defer p.countersMutex.Unlock()
+	return p.counters
 }
 
+func (p *Printer) write(data []byte) (int, error) {
+	n, err := p.File.Write(data)
+	p.countersMutex.Lock()
+	p.counters.BytesWritten += uint64(n)
+	p.countersMutex.Unlock()
+	return n, err
+}
+
+func (p *Printer) read(buf []byte) (int, error) {
+	n, err := p.File.Read(buf)
+	p.countersMutex.Lock()
+	p.counters.BytesRead += uint64(n)
+	p.countersMutex.Unlock()
+	return n, err
+}
+
+var errNotPrinter = errors.New("not a printer")
+var errIncompatibleDevice = errors.New("incompatible device")
+
+// openDevice opens a device file and reads its IEEE 1284 Device ID.
+// It is a variable, so that tests can substitute fake devices.
+var openDevice = func(path string) (io.ReadWriteCloser, []byte, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Filter out obvious non-printers.
+	deviceID, err := lpiocGetDeviceID(f.Fd())
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("%s: %w: %s", path, errNotPrinter, err)
+	}
+	return f, deviceID, nil
+}
+
+// OpenPath opens a particular printer device, such as one given a stable name
+// by udev rules, making sure that it supports the appropriate protocol.
+func OpenPath(path string) (*Printer, error) {
+	f, deviceID, err := openDevice(path)
+	if os.IsPermission(err) {
+		return nil, fmt.Errorf("found %s but permission was denied"+
+			" (check udev rules or group membership)", path)
+	} else if err != nil {
+		return nil, err
+	}
+	parsedID := parseIEEE1284DeviceID(deviceID)
+	// Filter out printers that wouldn't understand the protocol.
+	if !compatible(parsedID) {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w: %s",
+			path, errIncompatibleDevice, deviceID)
+	}
+	return &Printer{
+		File:         f,
+		Manufacturer: parsedID.FindFirst("MANUFACTURER", "MFG"),
+		Model:        parsedID.FindFirst("MODEL", "MDL"),
+	}, nil
+}
+
+// devicePattern matches device files of the Linux usblp module,
+// located in /drivers/usb/class/usblp.c
+var devicePattern = "/dev/usb/lp[0-9]*"
+
 // Open finds and initializes the first USB printer found supporting
 // the appropriate protocol. Returns nil if no printer could be found.
+// If some candidate devices couldn't be opened, an error describing
+// the reasons is returned instead.
 func Open() (*Printer, error) {
-	// Linux usblp module, located in /drivers/usb/class/usblp.c
-	paths, err := filepath.Glob("/dev/usb/lp[0-9]*")
+	paths, err := filepath.Glob(devicePattern)
 	if err != nil {
 		return nil, err
 	}
+
+	var problems []string
 	for _, candidate := range paths {
-		f, err := os.OpenFile(candidate, os.O_RDWR, 0)
-		if err != nil {
+		p, err := OpenPath(candidate)
+		if errors.Is(err, errNotPrinter) ||
+			errors.Is(err, errIncompatibleDevice) {
+			logutil.Debugf("skipping %s", err)
 			continue
-		}
-		// Filter out obvious non-printers.
-		deviceID, err := lpiocGetDeviceID(f.Fd())
-		if err != nil {
-			f.Close()
-			continue
-		}
-		parsedID := parseIEEE1284DeviceID(deviceID)
-		// Filter out printers that wouldn't understand the protocol.
-		if !compatible(parsedID) {
-			f.Close()
+		} else if err != nil {
+			problems = append(problems, err.Error())
 			continue
 		}
-		return &Printer{
-			File:         f,
-			Manufacturer: parsedID.FindFirst("MANUFACTURER", "MFG"),
-			Model:        parsedID.FindFirst("MODEL", "MDL"),
-		}, nil
+		return p, nil
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
 	}
 	return nil, nil
 }
 
+// drainTimeout bounds how long Initialize may keep discarding responses.
+const drainTimeout = time.Second
+
 // Initialize initializes the printer for further operations.
+// It may be called repeatedly, though not in the middle of a print job.
 func (p *Printer) Initialize() error {
+	// Clearing the print buffer only makes sense the first time around.
+	return p.initialize(!p.initialized, !p.SkipDrain)
+}
+
+func (p *Printer) initialize(invalidate, drain bool) error {
+	if p.jobOpts != nil {
+		return errJobInProgress
+	}
+
 	// Clear the print buffer.
-	invalidate := make([]byte, 400)
-	if _, err := p.File.Write(invalidate); err != nil {
-		return err
+	if invalidate {
+		invalidate := make([]byte, 400)
+		if _, err := p.write(invalidate); err != nil {
+			return err
+		}
 	}
 
 	// Initialize.
-	if _, err := p.File.WriteString("\x1b\x40"); err != nil {
+	if _, err := p.write([]byte("\x1b\x40")); err != nil {
 		return err
 	}
 
@@ -110,53 +231,159 @@ func (p *Printer) Initialize() error {
 	//
 	// I haven't checked if this is the kernel driver or the printer doing
 	// the buffering that causes data to be returned at this point.
+	if !drain {
+		p.initialized = true
+		return nil
+	}
+
+	p.readMutex.Lock()
+	defer p.readMutex.Unlock()
+
 	var dummy [32]byte
-	for {
-		if _, err := p.File.Read(dummy[:]); err == io.EOF {
+	for start := time.Now(); ; {
+		if _, err := p.read(dummy[:]); err == io.EOF {
 			break
+		} else if err != nil {
+			return err
+		} else if time.Since(start) > drainTimeout {
+			return errTimeout
 		}
 	}
 
+	p.initialized = true
 	return nil
 }
 
 var errTimeout = errors.New("timeout")
-var errInvalidRead = errors.New("invalid read")
 
 func (p *Printer) updateStatus(status Status) {
+	p.countersMutex.Lock()
+	p.counters.StatusPackets++
+	p.countersMutex.Unlock()
+
+	changed := !status.Equal(p.LastStatus)
 	p.LastStatus = &status
-	if p.StatusNotify != nil {
+	if p.StatusNotify != nil && (changed || p.NotifyAll) {
 		p.StatusNotify(p.LastStatus)
 	}
+	if p.statusChan == nil {
+		return
+	}
+
+	// Coalesce with any status that hasn't been picked up yet.
+	copied := status
+	for {
+		select {
+		case p.statusChan <- &copied:
+			return
+		default:
+		}
+		select {
+		case <-p.statusChan:
+		default:
+		}
+	}
+}
+
+// StatusChannel returns a channel that receives all status packets from now
+// on, including those read by other methods. A background goroutine keeps
+// reading from the printer while it's otherwise idle. When the receiver
+// can't keep up, it will only get the most recent status.
+//
+// The channel is closed by Close. While the goroutine is running, LastStatus
+// should only be accessed through Status, or from StatusNotify.
+// It is safe to call concurrently, all callers share the same channel.
+// After Close, it only returns a closed channel.
+func (p *Printer) StatusChannel() <-chan *Status {
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+	if p.closed {
+		ch := make(chan *Status)
+		close(ch)
+		return ch
+	}
+
+	// updateStatus sends to the channel while holding readMutex.
+	p.readMutex.Lock()
+	defer p.readMutex.Unlock()
+	if p.statusChan == nil {
+		p.statusChan = make(chan *Status, 1)
+		p.statusDone = make(chan struct{})
+		p.statusWG.Add(1)
+		go p.readStatuses(p.statusDone)
+	}
+	return p.statusChan
+}
+
+func (p *Printer) readStatuses(done <-chan struct{}) {
+	defer p.statusWG.Done()
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		p.readMutex.Lock()
+		var status Status
+		if n, err := p.read(status[:]); err == nil && n > 0 {
+			// The rest of the packet should follow shortly, if needed.
+			p.finishStatus(status, n, time.Second)
+		}
+		p.readMutex.Unlock()
+	}
 }
 
 // pollStatusBytes waits for the printer to send a status packet and returns
-// it as raw data.
+// it as raw data. The caller must hold readMutex.
 func (p *Printer) pollStatusBytes(
 	timeout time.Duration) (*Status, error) {
-	start, buf := time.Now(), [32]byte{}
-	for {
-		if n, err := p.File.Read(buf[:]); err == io.EOF {
-			time.Sleep(10 * time.Millisecond)
-		} else if err != nil {
+	return p.finishStatus(Status{}, 0, timeout)
+}
+
+// finishStatus reads the rest of a status packet, of which the first
+// few bytes are already known. Some USB stacks deliver packets in pieces.
+// The caller must hold readMutex.
+func (p *Printer) finishStatus(status Status, have int,
+	timeout time.Duration) (*Status, error) {
+	for start := time.Now(); have < len(status); {
+		if n, err := p.read(status[have:]); err != nil && err != io.EOF {
 			return nil, err
-		} else if n < 32 {
-			return nil, errInvalidRead
-		} else {
-			p.updateStatus(Status(buf))
-			return p.LastStatus, nil
+		} else if n > 0 {
+			have += n
+			continue
 		}
-		if time.Now().Sub(start) > timeout {
+		if time.Since(start) > timeout {
 			return nil, errTimeout
 		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p.updateStatus(status)
+	return p.LastStatus, nil
+}
+
+// Status returns a copy of the last received status, or nil if unknown.
+// It must not be called from StatusNotify, which has the status at hand.
+func (p *Printer) Status() *Status {
+	p.readMutex.Lock()
+	defer p.readMutex.Unlock()
+
+	if p.LastStatus == nil {
+		return nil
 	}
+	status := *p.LastStatus
+	return &status
 }
 
 // Request new status information from the printer. The printer
 // must be in an appropriate mode, i.e. on-line and not currently printing.
 func (p *Printer) UpdateStatus() error {
+	p.readMutex.Lock()
+	defer p.readMutex.Unlock()
+
 	// Request status information.
-	if _, err := p.File.WriteString("\x1b\x69\x53"); err != nil {
+	if _, err := p.write([]byte("\x1b\x69\x53")); err != nil {
 		return err
 	}
 
@@ -172,15 +399,8 @@ var errErrorOccurred = errors.New("error occurred")
 var errUnexpectedStatus = errors.New("unexpected status")
 var errUnknownMedia = errors.New("unknown media")
 
-func (p *Printer) Print(image image.Image, rb bool) error {
-	data := makePrintData(p.LastStatus, image, rb)
-	if data == nil {
-		return errUnknownMedia
-	}
-	if _, err := p.File.Write(data); err != nil {
-		return err
-	}
-
+// waitForPrinting waits until the printer finishes printing a page.
+func (p *Printer) waitForPrinting() error {
 	// See diagrams: we may receive an error status instead of the transition
 	// to the printing state. Or even after it.
 	//
@@ -204,7 +424,150 @@ func (p *Printer) Print(image image.Image, rb bool) error {
 	}
 }
 
-// Close closes the underlying file.
+var errNoJob = errors.New("no print job has been started")
+var errJobInProgress = errors.New("a print job is already in progress")
+var errInvalidTearOffFeed = errors.New("tear-off feed out of range")
+
+// BeginJob starts a print job, in which all images get printed in a chain,
+// without feeding or cutting the media in between. DefaultPrintOptions
+// are used if opts is nil.
+func (p *Printer) BeginJob(opts *PrintOptions) error {
+	if p.jobOpts != nil {
+		return errJobInProgress
+	}
+	if opts == nil {
+		opts = &DefaultPrintOptions
+	}
+	if opts.TearOffFeedDots < 0 || opts.TearOffFeedDots > MaxTearOffFeedDots {
+		return errInvalidTearOffFeed
+	}
+	p.jobOpts, p.jobPending, p.jobPage = opts, nil, 0
+	return nil
+}
+
+func (p *Printer) printPage(image image.Image, last bool) error {
+	p.readMutex.Lock()
+	defer p.readMutex.Unlock()
+
+	data := makePrintData(p.LastStatus, image, p.jobOpts, p.jobPage, last)
+	if data == nil {
+		return errUnknownMedia
+	}
+	logutil.Debugf("sending page %d, %d bytes", p.jobPage+1, len(data))
+	if _, err := p.write(data); err != nil {
+		return err
+	}
+
+	p.jobPage++
+	return p.waitForPrinting()
+}
+
+// AppendImage adds an image to the current print job. Because only the last
+// image may feed the media out, each image is only sent once another one
+// follows it, or the job ends.
+func (p *Printer) AppendImage(image image.Image) error {
+	if p.jobOpts == nil {
+		return errNoJob
+	}
+	if err := p.checkLength(image, p.jobOpts); err != nil {
+		p.jobOpts, p.jobPending = nil, nil
+		return err
+	}
+
+	pending := p.jobPending
+	p.jobPending = image
+	if pending == nil {
+		return nil
+	}
+	if err := p.printPage(pending, false); err != nil {
+		p.jobOpts, p.jobPending = nil, nil
+		return err
+	}
+	return nil
+}
+
+// EndJob prints out the last image of the current print job, and feeds
+// the media out.
+func (p *Printer) EndJob() error {
+	if p.jobOpts == nil {
+		return errNoJob
+	}
+
+	pending := p.jobPending
+	defer func() { p.jobOpts, p.jobPending = nil, nil }()
+	if pending == nil {
+		return nil
+	}
+	return p.printPage(pending, true)
+}
+
+// checkLength verifies the image against the media in use, if known.
+func (p *Printer) checkLength(image image.Image, opts *PrintOptions) error {
+	status := p.Status()
+	if status == nil && opts.Media == (MediaSize{}) {
+		return nil
+	}
+	return checkLength(printMedia(status, opts), image, opts)
+}
+
+func (p *Printer) printOnce(image image.Image, opts *PrintOptions) error {
+	// Rather not start a job that can't be finished.
+	if err := p.checkLength(image, opts); err != nil {
+		return err
+	}
+	if err := p.BeginJob(opts); err != nil {
+		return err
+	}
+	if err := p.AppendImage(image); err != nil {
+		return err
+	}
+	return p.EndJob()
+}
+
+// Print prints the image, using DefaultPrintOptions if opts is nil.
+// After transient errors, the printer is reinitialized and the image is sent
+// again, as many times as the options allow.
+func (p *Printer) Print(image image.Image, opts *PrintOptions) error {
+	if opts == nil {
+		opts = &DefaultPrintOptions
+	}
+	for attempt := 0; ; attempt++ {
+		err := p.printOnce(image, opts)
+		if err != errErrorOccurred || attempt >= opts.Retries {
+			return err
+		}
+		if status := p.Status(); status == nil || !status.TransientError() {
+			return err
+		}
+
+		// The printer may still hold a part of the failed job, and errors
+		// leave status packets behind, so always clear and drain everything.
+		logutil.Debugf("retrying after a transient error")
+		if err := p.initialize(true, true); err != nil {
+			return err
+		}
+		if err := p.UpdateStatus(); err != nil {
+			return err
+		}
+	}
+}
+
+// Close stops reading statuses and closes the underlying file.
+// It is safe to call concurrently with StatusChannel.
 func (p *Printer) Close() error {
+	p.statusMutex.Lock()
+	defer p.statusMutex.Unlock()
+	p.closed = true
+
+	// The reader needs readMutex to finish, so it mustn't be held here.
+	if p.statusChan != nil {
+		close(p.statusDone)
+		p.statusWG.Wait()
+
+		p.readMutex.Lock()
+		close(p.statusChan)
+		p.statusChan = nil
+		p.readMutex.Unlock()
+	}
 	return p.File.Close()
 }
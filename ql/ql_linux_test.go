@@ -0,0 +1,614 @@
+package ql
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeDevice stands in for the device file of a printer.
+type fakeDevice struct {
+	mutex   sync.Mutex
+	writes  [][]byte // all data written, as separate writes
+	pending [][]byte // responses to be read, in chunks
+	endless []byte   // read over and over when nothing else is pending
+	reads   int      // number of calls to Read
+	closed  bool
+
+	// respond produces responses to data written to the device.
+	respond func(data []byte) [][]byte
+}
+
+func (d *fakeDevice) Write(data []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.writes = append(d.writes, append([]byte(nil), data...))
+	if d.respond != nil {
+		d.pending = append(d.pending, d.respond(data)...)
+	}
+	return len(data), nil
+}
+
+func (d *fakeDevice) Read(buf []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.reads++
+	if len(d.pending) == 0 && d.endless != nil {
+		return copy(buf, d.endless), nil
+	}
+	if len(d.pending) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(buf, d.pending[0])
+	if d.pending[0] = d.pending[0][n:]; len(d.pending[0]) == 0 {
+		d.pending = d.pending[1:]
+	}
+	return n, nil
+}
+
+func (d *fakeDevice) Close() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.closed = true
+	return nil
+}
+
+// push makes the device respond with the given chunks of data.
+func (d *fakeDevice) push(chunks ...[]byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.pending = append(d.pending, chunks...)
+}
+
+// pages returns print data written to the device, one page per item.
+func (d *fakeDevice) pages() (pages [][]byte) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, data := range d.writes {
+		if isPrintData(data) {
+			pages = append(pages, data)
+		}
+	}
+	return
+}
+
+func isPrintData(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x1b, 0x69, 0x61})
+}
+
+// statusPacket fakes a status packet of the given type.
+func statusPacket(widthMM, lengthMM int, typ StatusType) []byte {
+	s := *testStatus(widthMM, lengthMM)
+	s[18] = byte(typ)
+	if typ == StatusTypePhaseChange {
+		s[19] = byte(StatusPhasePrinting)
+	}
+	return s[:]
+}
+
+// printerResponder behaves like a printer with the given media loaded,
+// which answers status requests and successfully prints everything.
+func printerResponder(widthMM, lengthMM int) func([]byte) [][]byte {
+	return func(data []byte) [][]byte {
+		switch {
+		case bytes.Equal(data, []byte{0x1b, 0x69, 0x53}):
+			return [][]byte{
+				statusPacket(widthMM, lengthMM, StatusTypeReplyToRequest)}
+		case isPrintData(data):
+			return [][]byte{
+				statusPacket(widthMM, lengthMM, StatusTypePhaseChange),
+				statusPacket(widthMM, lengthMM, StatusTypePrintingCompleted)}
+		}
+		return nil
+	}
+}
+
+// testPrinter returns an initialized printer with a fake device behind it.
+func testPrinter(t *testing.T, widthMM, lengthMM int) (*Printer, *fakeDevice) {
+	d := &fakeDevice{respond: printerResponder(widthMM, lengthMM)}
+	p := &Printer{File: d}
+	if err := p.Initialize(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	return p, d
+}
+
+func TestJobChaining(t *testing.T) {
+	p, d := testPrinter(t, 62, 0)
+	img := image.NewGray(image.Rect(0, 0, 100, 10))
+
+	if err := p.BeginJob(nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := p.AppendImage(img); err != nil {
+			t.Fatal(err)
+		}
+		if pages := len(d.pages()); pages != i {
+			t.Errorf("%d pages sent after %d images", pages, i+1)
+		}
+	}
+	if err := p.EndJob(); err != nil {
+		t.Fatal(err)
+	}
+
+	pages := d.pages()
+	if len(pages) != 3 {
+		t.Fatalf("%d pages sent, want 3", len(pages))
+	}
+	for i, page := range pages {
+		last, want := page[len(page)-1], byte(0x0c)
+		if i == len(pages)-1 {
+			want = 0x1a
+		}
+		if last != want {
+			t.Errorf("page %d ends with %#02x, want %#02x", i, last, want)
+		}
+	}
+	if err := p.EndJob(); err != errNoJob {
+		t.Errorf("ending a job twice: got %v, want %v", err, errNoJob)
+	}
+}
+
+// testDevice describes a fake device file: either the error that opening
+// it fails with, or its IEEE 1284 Device ID.
+type testDevice struct {
+	err error
+	id  string
+}
+
+// testDevices makes Open and OpenPath find the given fake devices.
+func testDevices(t *testing.T, devices map[string]testDevice) {
+	dir := t.TempDir()
+	for name := range devices {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pattern, open := devicePattern, openDevice
+	t.Cleanup(func() { devicePattern, openDevice = pattern, open })
+
+	devicePattern = filepath.Join(dir, "lp[0-9]*")
+	openDevice = func(path string) (io.ReadWriteCloser, []byte, error) {
+		device := devices[filepath.Base(path)]
+		if device.err != nil {
+			return nil, nil, device.err
+		}
+		return &fakeDevice{}, []byte(device.id), nil
+	}
+}
+
+const (
+	testCompatibleID   = "MFG:Brother;CMD:PT-CBP;MDL:QL-800;CLS:PRINTER;"
+	testIncompatibleID = "MFG:Brother;CMD:PJL,PCL;MDL:HL-L2350DW;"
+)
+
+func TestOpenProblems(t *testing.T) {
+	denied := &os.PathError{Op: "open", Err: syscall.EACCES}
+	notPrinter := fmt.Errorf("%w: inappropriate ioctl", errNotPrinter)
+	for _, test := range []struct {
+		name    string
+		devices map[string]testDevice
+		found   bool
+		problem string
+	}{
+		{"nothing", nil, false, ""},
+		{"permission denied", map[string]testDevice{
+			"lp0": {err: denied},
+		}, false, "permission was denied"},
+		{"not printers", map[string]testDevice{
+			"lp0": {err: notPrinter},
+			"lp1": {id: testIncompatibleID},
+		}, false, ""},
+		{"permission denied and a printer", map[string]testDevice{
+			"lp0": {err: denied},
+			"lp1": {id: testCompatibleID},
+		}, true, ""},
+	} {
+		testDevices(t, test.devices)
+		p, err := Open()
+		if found := p != nil; found != test.found {
+			t.Errorf("%s: found a printer: %t", test.name, found)
+		}
+		if test.problem == "" && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if test.problem != "" &&
+			(err == nil || !strings.Contains(err.Error(), test.problem)) {
+			t.Errorf("%s: got %v, want a mention of %q",
+				test.name, err, test.problem)
+		}
+	}
+}
+
+// receiveStatus waits for a status from the channel, or its closing.
+func receiveStatus(t *testing.T, ch <-chan *Status) (*Status, bool) {
+	select {
+	case status, ok := <-ch:
+		return status, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a status")
+	}
+	return nil, false
+}
+
+func TestStatusChannel(t *testing.T) {
+	d := &fakeDevice{}
+	p := &Printer{File: d}
+	ch := p.StatusChannel()
+
+	for _, widthMM := range []int{62, 29, 12} {
+		d.push(statusPacket(widthMM, 0, StatusTypeNotification))
+		status, ok := receiveStatus(t, ch)
+		if !ok {
+			t.Fatal("the channel got closed")
+		}
+		if status.MediaWidthMM() != widthMM {
+			t.Errorf("got a status for %d mm media, want %d mm",
+				status.MediaWidthMM(), widthMM)
+		}
+	}
+
+	// Statuses that aren't picked up in time should only leave the latest.
+	p.readMutex.Lock()
+	for _, widthMM := range []int{62, 29} {
+		var status Status
+		copy(status[:], statusPacket(widthMM, 0, StatusTypeNotification))
+		p.updateStatus(status)
+	}
+	p.readMutex.Unlock()
+	if status, _ := receiveStatus(t, ch); status.MediaWidthMM() != 29 {
+		t.Errorf("got a stale status for %d mm media", status.MediaWidthMM())
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := receiveStatus(t, ch); ok {
+		t.Error("the channel is still open after Close")
+	}
+	if !d.closed {
+		t.Error("the device is still open after Close")
+	}
+}
+
+func TestStatusChannelConcurrent(t *testing.T) {
+	p := &Printer{File: &fakeDevice{}}
+
+	// All callers must share a single channel, and so a single reader.
+	var wg sync.WaitGroup
+	channels := make([]<-chan *Status, 10)
+	for i := range channels {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			channels[i] = p.StatusChannel()
+		}(i)
+	}
+	wg.Wait()
+	for _, ch := range channels[1:] {
+		if ch != channels[0] {
+			t.Fatal("concurrent calls have created separate channels")
+		}
+	}
+
+	// Closing while the channel is being requested mustn't close it twice.
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		p.StatusChannel()
+	}()
+	go func() {
+		defer wg.Done()
+		p.Close()
+	}()
+	wg.Wait()
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := receiveStatus(t, channels[0]); ok {
+		t.Error("the channel is still open after Close")
+	}
+	if _, ok := receiveStatus(t, p.StatusChannel()); ok {
+		t.Error("a status reader has been started after Close")
+	}
+}
+
+func TestInitializeDrain(t *testing.T) {
+	// Only initializing successfully stops the print buffer from being
+	// cleared again, which takes 400 bytes, and initialization takes 2.
+	status := statusPacket(62, 0, StatusTypeReplyToRequest)
+	for _, test := range []struct {
+		name    string
+		device  *fakeDevice
+		err     error
+		written uint64
+	}{
+		{"nothing pending", &fakeDevice{}, nil, 402 + 2},
+		{"stale responses", &fakeDevice{
+			pending: [][]byte{status, status, status}}, nil, 402 + 2},
+		{"endless responses", &fakeDevice{endless: status},
+			errTimeout, 402 + 402},
+	} {
+		p := &Printer{File: test.device}
+		for attempt := 0; attempt < 2; attempt++ {
+			if err := p.Initialize(); err != test.err {
+				t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+			}
+		}
+		if written := p.Counters().BytesWritten; written != test.written {
+			t.Errorf("%s: %d bytes written, want %d",
+				test.name, written, test.written)
+		}
+	}
+}
+
+func TestPrintRetries(t *testing.T) {
+	img := image.NewGray(image.Rect(0, 0, 100, 10))
+	for _, test := range []struct {
+		name           string
+		error1, error2 byte
+		retries        int
+		err            error
+		pages          int
+		invalidations  int
+	}{
+		{"communication error", 0x00, 0x04, 1, nil, 2, 2},
+		{"communication error without retries", 0x00, 0x04, 0,
+			errErrorOccurred, 1, 1},
+		{"no media", 0x01, 0x00, 3, errErrorOccurred, 1, 1},
+	} {
+		p, d := testPrinter(t, 62, 0)
+
+		// Fail printing the first page with the given error.
+		succeed, failed := d.respond, false
+		d.respond = func(data []byte) [][]byte {
+			if !isPrintData(data) || failed {
+				return succeed(data)
+			}
+			failed = true
+			packet := statusPacket(62, 0, StatusTypeErrorOccurred)
+			packet[8], packet[9] = test.error1, test.error2
+			return [][]byte{packet}
+		}
+
+		err := p.Print(img, &PrintOptions{Retries: test.retries})
+		if err != test.err {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+		if pages := len(d.pages()); pages != test.pages {
+			t.Errorf("%s: %d pages sent, want %d",
+				test.name, pages, test.pages)
+		}
+
+		// Retries must clear whatever remains of the failed job.
+		invalidations := 0
+		for _, data := range d.writes {
+			if len(data) == 400 && bytes.Count(data, []byte{0}) == 400 {
+				invalidations++
+			}
+		}
+		if invalidations != test.invalidations {
+			t.Errorf("%s: print buffer cleared %d times, want %d",
+				test.name, invalidations, test.invalidations)
+		}
+	}
+}
+
+func TestOpenPath(t *testing.T) {
+	testDevices(t, map[string]testDevice{
+		"lp0": {id: testCompatibleID},
+		"lp1": {id: testIncompatibleID},
+	})
+	dir := filepath.Dir(devicePattern)
+	for _, test := range []struct {
+		name  string
+		model string
+		err   error
+	}{
+		{"lp0", "QL-800", nil},
+		{"lp1", "", errIncompatibleDevice},
+	} {
+		p, err := OpenPath(filepath.Join(dir, test.name))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		} else if p != nil && p.Model != test.model {
+			t.Errorf("%s: got model %q, want %q", test.name, p.Model, test.model)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		images            int
+	}{
+		{62, 0, 1},
+		{62, 0, 3},
+		{62, 29, 2},
+	} {
+		p, d := testPrinter(t, test.widthMM, test.lengthMM)
+		img := image.NewGray(image.Rect(0, 0, 100, 10))
+		if err := p.BeginJob(nil); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < test.images; i++ {
+			if err := p.AppendImage(img); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := p.EndJob(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Initialization, a status request, and print data.
+		want := Counters{
+			BytesWritten:  402 + 3,
+			StatusPackets: 1 + 2*uint64(test.images),
+		}
+		for _, page := range d.pages() {
+			want.BytesWritten += uint64(len(page))
+		}
+		want.BytesRead = want.StatusPackets * uint64(len(Status{}))
+		if counters := p.Counters(); counters != want {
+			t.Errorf("%+v: got %+v, want %+v", test, counters, want)
+		}
+	}
+}
+
+func TestSkipDrain(t *testing.T) {
+	for _, test := range []struct {
+		skipDrain bool
+		reads     int
+	}{
+		{false, 2},
+		{true, 0},
+	} {
+		status := statusPacket(62, 0, StatusTypeReplyToRequest)
+		d := &fakeDevice{pending: [][]byte{status}}
+		p := &Printer{File: d, SkipDrain: test.skipDrain}
+		if err := p.Initialize(); err != nil {
+			t.Fatal(err)
+		}
+		if d.reads != test.reads {
+			t.Errorf("skip drain %t: %d reads, want %d",
+				test.skipDrain, d.reads, test.reads)
+		}
+	}
+}
+
+func TestFragmentedStatus(t *testing.T) {
+	status := statusPacket(62, 29, StatusTypeReplyToRequest)
+	for _, test := range []struct {
+		chunks []int
+		err    error
+	}{
+		{[]int{32}, nil},
+		{[]int{20, 12}, nil},
+		{[]int{1, 30, 1}, nil},
+		{[]int{20}, errTimeout},
+	} {
+		d := &fakeDevice{respond: func(data []byte) (chunks [][]byte) {
+			rest := status
+			for _, n := range test.chunks {
+				chunks, rest = append(chunks, rest[:n]), rest[n:]
+			}
+			return
+		}}
+		p := &Printer{File: d}
+		if err := p.UpdateStatus(); err != test.err {
+			t.Errorf("%v: got %v, want %v", test.chunks, err, test.err)
+		} else if err == nil && (p.LastStatus.MediaWidthMM() != 62 ||
+			p.LastStatus.MediaLengthMM() != 29) {
+			t.Errorf("%v: the status was assembled wrong", test.chunks)
+		}
+	}
+}
+
+func TestTooLongImage(t *testing.T) {
+	p, d := testPrinter(t, 62, 0)
+	short := image.NewGray(image.Rect(0, 0, 100, 10))
+	long := image.NewGray(image.Rect(0, 0, 100, 1000))
+	opts := &PrintOptions{MaxLengthMM: 10}
+
+	if err := p.BeginJob(opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(short); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AppendImage(long); !errors.Is(err, errTooLong) {
+		t.Errorf("got %v, want %v", err, errTooLong)
+	}
+	if err := p.Print(long, opts); !errors.Is(err, errTooLong) {
+		t.Errorf("got %v, want %v", err, errTooLong)
+	}
+
+	// Neither should have left a job open, nor sent anything.
+	if pages := len(d.pages()); pages != 0 {
+		t.Errorf("%d pages sent", pages)
+	}
+	if err := p.Print(short, opts); err != nil {
+		t.Errorf("printing after a rejected image: %s", err)
+	}
+}
+
+func TestStatusNotify(t *testing.T) {
+	phase := *testStatus(62, 0)
+	phase[21] = 0x01
+	changed := *testStatus(62, 0)
+	changed[9] = 0x01
+
+	for _, test := range []struct {
+		notifyAll bool
+		notified  int
+	}{
+		{false, 2},
+		{true, 4},
+	} {
+		notified := 0
+		p := &Printer{
+			StatusNotify: func(*Status) { notified++ },
+			NotifyAll:    test.notifyAll,
+		}
+		for _, s := range []Status{*testStatus(62, 0), *testStatus(62, 0),
+			phase, changed} {
+			p.updateStatus(s)
+		}
+		if notified != test.notified {
+			t.Errorf("%+v: notified %d times", test, notified)
+		}
+	}
+}
+
+func TestMediaOverride(t *testing.T) {
+	// The printer doesn't recognize the tape, reporting a bogus width.
+	p, d := testPrinter(t, 99, 0)
+	img := image.NewGray(image.Rect(0, 0, 100, 10))
+	if err := p.Print(img, &DefaultPrintOptions); err != errUnknownMedia {
+		t.Fatalf("detected media: got %v, want %v", err, errUnknownMedia)
+	}
+
+	opts := DefaultPrintOptions
+	opts.Media = MediaSize{WidthMM: 62, LengthMM: 29}
+	if err := p.Print(img, &opts); err != nil {
+		t.Fatalf("chosen media: %s", err)
+	}
+
+	pages := d.pages()
+	if len(pages) != 1 {
+		t.Fatalf("%d pages sent, want 1", len(pages))
+	}
+	info := printInfo(t, pages[0])
+	if info[1] != 0x0b || info[2] != 62 || info[3] != 29 {
+		t.Errorf("got print information % x", info)
+	}
+	if n, mi := rasterLines(pages[0]), GetMediaInfo(62, 29); n !=
+		mi.PrintAreaLength {
+		t.Errorf("%d raster lines, want %d", n, mi.PrintAreaLength)
+	}
+
+	// Length limits apply to the chosen media, too.
+	opts.Media, opts.MaxLengthMM = MediaSize{WidthMM: 62}, 10
+	tall := image.NewGray(image.Rect(0, 0, 100, 200))
+	if err := p.Print(tall, &opts); !errors.Is(err, errTooLong) {
+		t.Errorf("too long for the chosen media: got %v", err)
+	}
+}
@@ -0,0 +1,603 @@
+package ql
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"janouch.name/sklad/bdf"
+	"janouch.name/sklad/imgutil"
+	"janouch.name/sklad/logutil"
+)
+
+// testStatus fakes a status packet reporting the given media.
+func testStatus(widthMM, lengthMM int) *Status {
+	var s Status
+	s[10], s[17] = byte(widthMM), byte(lengthMM)
+	return &s
+}
+
+// rasterPins decodes the first raster line of print data.
+func rasterPins(t *testing.T, data []byte) (pins [printPins]bool) {
+	i := bytes.Index(data, []byte{'g', 0x00, printBytes})
+	if i < 0 || len(data) < i+3+printBytes {
+		t.Fatal("no raster data found")
+	}
+	for n, b := range data[i+3 : i+3+printBytes] {
+		for j := 0; j < 8; j++ {
+			pins[n*8+j] = b&(0x80>>j) != 0
+		}
+	}
+	return
+}
+
+// blankPins counts unset pins on both sides of a raster line,
+// within the print area of the media.
+func blankPins(mi *MediaInfo, pins [printPins]bool) (left, right int) {
+	start, end := mi.SideMarginPins, mi.SideMarginPins+mi.PrintAreaPins
+	for i := start; i < end && !pins[i]; i++ {
+		left++
+	}
+	for i := end - 1; i >= start && !pins[i]; i-- {
+		right++
+	}
+	return
+}
+
+func TestCentering(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		center            bool
+		centered          bool
+	}{
+		{62, 29, false, true},
+		{62, 29, true, true},
+		{62, 0, false, false},
+		{62, 0, true, true},
+	} {
+		mi := GetMediaInfo(test.widthMM, test.lengthMM)
+		img := image.NewGray(image.Rect(0, 0, mi.PrintAreaPins/2, 10))
+		pins := rasterPins(t, makePrintData(
+			testStatus(test.widthMM, test.lengthMM), img,
+			&PrintOptions{Center: test.center}, 0, true))
+
+		left, right := blankPins(mi, pins)
+		if left+right != mi.PrintAreaPins-img.Bounds().Dx() {
+			t.Errorf("%+v: the image got clipped", test)
+		} else if centered := left == right; centered != test.centered {
+			t.Errorf("%+v: %d blank pins on one side, %d on the other",
+				test, left, right)
+		}
+	}
+}
+
+func TestMarginAdjust(t *testing.T) {
+	mi := GetMediaInfo(62, 0)
+	for _, test := range []struct {
+		adjust      int
+		first, last int
+	}{
+		{0, mi.SideMarginPins, mi.SideMarginPins + 99},
+		{3, mi.SideMarginPins + 3, mi.SideMarginPins + 102},
+		{-3, mi.SideMarginPins - 3, mi.SideMarginPins + 96},
+		{-100, 0, 99},
+		{printPins - 50 - mi.SideMarginPins, printPins - 50, printPins - 1},
+		{1000, -1, -1},
+	} {
+		img := image.NewGray(image.Rect(0, 0, 100, 10))
+		pins := rasterPins(t, makePrintData(testStatus(62, 0), img,
+			&PrintOptions{MarginAdjust: test.adjust}, 0, true))
+
+		first, last := -1, -1
+		for i, set := range pins {
+			if set && first < 0 {
+				first = i
+			}
+			if set {
+				last = i
+			}
+		}
+		if first != test.first || last != test.last {
+			t.Errorf("%d: pins %d to %d are set, want %d to %d",
+				test.adjust, first, last, test.first, test.last)
+		}
+	}
+}
+
+// printInfo extracts parameters of the print information command.
+func printInfo(t *testing.T, data []byte) []byte {
+	i := bytes.Index(data, []byte{0x1b, 0x69, 0x7a})
+	if i < 0 || len(data) < i+13 {
+		t.Fatal("no print information found")
+	}
+	return data[i+3 : i+13]
+}
+
+// rasterLines counts raster lines in print data.
+func rasterLines(data []byte) (n int) {
+	i := bytes.Index(data, []byte{'g', 0x00, printBytes})
+	for ; i >= 0 && i+3+printBytes <= len(data) && data[i] == 'g'; n++ {
+		i += 3 + printBytes
+	}
+	return
+}
+
+func TestTearOffFeed(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		last              bool
+		lines             int
+	}{
+		{62, 0, true, 150},
+		{62, 0, false, 100},
+		{62, 29, true, 271},
+	} {
+		img := image.NewGray(image.Rect(0, 0, 100, 100))
+		data := makePrintData(testStatus(test.widthMM, test.lengthMM), img,
+			&PrintOptions{TearOffFeedDots: 50}, 0, test.last)
+
+		info := printInfo(t, data)
+		announced := int(info[4]) | int(info[5])<<8 |
+			int(info[6])<<16 | int(info[7])<<24
+		if lines := rasterLines(data); lines != test.lines ||
+			announced != test.lines {
+			t.Errorf("%+v: %d lines announced, %d sent, want %d",
+				test, announced, lines, test.lines)
+		}
+	}
+}
+
+func TestMediaInfoJSON(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		fields            map[string]interface{}
+	}{
+		{62, 0, map[string]interface{}{
+			"Name": "62 mm continuous tape", "WidthMM": 62.,
+			"LengthMM": 0., "SideMarginPins": 12., "PrintAreaPins": 696.,
+			"PrintAreaLength": 0., "Round": false, "RedBlackCapable": true,
+		}},
+		{62, 29, map[string]interface{}{
+			"Name": "62x29 mm die-cut labels", "WidthMM": 62.,
+			"LengthMM": 29., "SideMarginPins": 12., "PrintAreaPins": 696.,
+			"PrintAreaLength": 271., "Round": false, "RedBlackCapable": false,
+		}},
+		{24, 24, map[string]interface{}{
+			"Name": "24 mm round labels", "WidthMM": 24.,
+			"LengthMM": 24., "SideMarginPins": 42., "PrintAreaPins": 236.,
+			"PrintAreaLength": 236., "Round": true, "RedBlackCapable": false,
+		}},
+	} {
+		data, err := json.Marshal(GetMediaInfo(test.widthMM, test.lengthMM))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(data, &fields); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%dx%d: got %v, want %v",
+				test.widthMM, test.lengthMM, fields, test.fields)
+		}
+	}
+}
+
+func TestPrintInfoFlags(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		opts  *PrintOptions
+		flags byte
+	}{
+		{"zero options", &PrintOptions{}, 0xc6},
+		{"default options", &DefaultPrintOptions, 0xc6},
+		{"fast", &PrintOptions{Fast: true}, 0x86},
+	} {
+		img := image.NewGray(image.Rect(0, 0, 100, 10))
+		data := makePrintData(testStatus(62, 0), img, test.opts, 0, true)
+		if flags := printInfo(t, data)[0]; flags != test.flags {
+			t.Errorf("%s: got flags %#02x, want %#02x",
+				test.name, flags, test.flags)
+		}
+	}
+}
+
+func TestCheckLength(t *testing.T) {
+	for _, test := range []struct {
+		size        MediaSize
+		dy          int
+		maxLengthMM int
+		err         error
+	}{
+		{MediaSize{62, 0}, 5905, 0, nil},
+		{MediaSize{62, 0}, 5906, 0, errTooLong},
+		{MediaSize{62, 0}, 6000, -1, nil},
+		{MediaSize{62, 0}, 118, 10, nil},
+		{MediaSize{62, 0}, 119, 10, errTooLong},
+		{MediaSize{62, 29}, 6000, 10, nil},
+	} {
+		img := image.NewGray(image.Rect(0, 0, 100, test.dy))
+		err := checkLength(test.size, img,
+			&PrintOptions{MaxLengthMM: test.maxLengthMM})
+		if !errors.Is(err, test.err) {
+			t.Errorf("%+v: got %v, want %v", test, err, test.err)
+		}
+	}
+}
+
+func TestFeedMargin(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		margin            []byte
+	}{
+		{62, 0, []byte{0x00, 0x00}},
+		{29, 0, []byte{0x00, 0x00}},
+		{62, 29, []byte{0x23, 0x00}},
+	} {
+		img := image.NewGray(image.Rect(0, 0, 100, 10))
+		data := makePrintData(testStatus(test.widthMM, test.lengthMM), img,
+			&DefaultPrintOptions, 0, true)
+		i := bytes.Index(data, []byte{0x1b, 0x69, 0x64})
+		if i < 0 || !bytes.Equal(data[i+3:i+5], test.margin) {
+			t.Errorf("%dx%d: no margin of %v found",
+				test.widthMM, test.lengthMM, test.margin)
+		}
+	}
+}
+
+func TestRasterTiming(t *testing.T) {
+	b, logger := &bytes.Buffer{}, logutil.Default
+	logutil.Default = logutil.New(b, logutil.LevelDebug)
+
+	var clock time.Time
+	now = func() time.Time {
+		clock = clock.Add(time.Second)
+		return clock
+	}
+	defer func() {
+		logutil.Default, now = logger, time.Now
+	}()
+
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		lines             int
+		log               string
+	}{
+		{62, 0, 150, "built 150 raster lines for 62x0 mm media in 1s\n"},
+		{62, 29, 271, "built 271 raster lines for 62x29 mm media in 1s\n"},
+	} {
+		b.Reset()
+		img := image.NewGray(image.Rect(0, 0, 100, 100))
+		data := makePrintData(testStatus(test.widthMM, test.lengthMM), img,
+			&PrintOptions{TearOffFeedDots: 50}, 0, true)
+		if lines := rasterLines(data); lines != test.lines {
+			t.Errorf("%+v: %d lines sent", test, lines)
+		}
+		if log := b.String(); !strings.HasSuffix(log, test.log) {
+			t.Errorf("%+v: unexpected log output: %q", test, log)
+		}
+	}
+}
+
+// forgetMedia removes registered media from the table once a test finishes.
+func forgetMedia(t *testing.T, sizes ...MediaSize) {
+	t.Cleanup(func() {
+		mediaMutex.Lock()
+		defer mediaMutex.Unlock()
+		for _, size := range sizes {
+			delete(media, size)
+			delete(roundMedia, size)
+			delete(redBlackMedia, size)
+		}
+	})
+}
+
+func TestRegisterMedia(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		mi                MediaInfo
+		valid             bool
+	}{
+		{90, 0, MediaInfo{SideMarginPins: 10, PrintAreaPins: 700}, true},
+		{90, 40, MediaInfo{SideMarginPins: 10, PrintAreaPins: 700,
+			PrintAreaLength: 450, RedBlackCapable: true}, true},
+		{90, 90, MediaInfo{SideMarginPins: 10, PrintAreaPins: 700,
+			PrintAreaLength: 700, Round: true}, true},
+		{0, 0, MediaInfo{SideMarginPins: 10, PrintAreaPins: 700}, false},
+		{92, -1, MediaInfo{SideMarginPins: 10, PrintAreaPins: 700}, false},
+		{92, 0, MediaInfo{SideMarginPins: -1, PrintAreaPins: 700}, false},
+		{92, 0, MediaInfo{SideMarginPins: 10, PrintAreaPins: 0}, false},
+		{92, 0, MediaInfo{SideMarginPins: 30, PrintAreaPins: 700}, false},
+		{92, 40, MediaInfo{SideMarginPins: 10, PrintAreaPins: 700,
+			PrintAreaLength: -1}, false},
+	} {
+		size := MediaSize{test.widthMM, test.lengthMM}
+		forgetMedia(t, size)
+
+		err := RegisterMedia(test.widthMM, test.lengthMM, test.mi)
+		if valid := err == nil; valid != test.valid {
+			t.Errorf("%v: registered: %t", size, valid)
+			continue
+		}
+
+		mi := GetMediaInfo(test.widthMM, test.lengthMM)
+		if !test.valid {
+			if mi != nil {
+				t.Errorf("%v: invalid media have been registered", size)
+			}
+			continue
+		}
+
+		expected := test.mi
+		expected.MediaSize = size
+		if mi == nil || *mi != expected {
+			t.Errorf("%v: got %+v, want %+v", size, mi, expected)
+		}
+	}
+}
+
+// TestRegisterMediaConcurrently is meant to be run with the race detector.
+func TestRegisterMediaConcurrently(t *testing.T) {
+	var sizes []MediaSize
+	for length := 1; length <= 50; length++ {
+		sizes = append(sizes, MediaSize{91, length})
+	}
+	forgetMedia(t, sizes...)
+
+	var wg sync.WaitGroup
+	for _, size := range sizes {
+		wg.Add(2)
+		go func(size MediaSize) {
+			defer wg.Done()
+			if err := RegisterMedia(size.WidthMM, size.LengthMM, MediaInfo{
+				PrintAreaPins: 100, PrintAreaLength: 100}); err != nil {
+				t.Error(err)
+			}
+		}(size)
+		go func() {
+			defer wg.Done()
+			GetMediaInfo(62, 0)
+			ListMedia()
+		}()
+	}
+	wg.Wait()
+
+	for _, size := range sizes {
+		if GetMediaInfo(size.WidthMM, size.LengthMM) == nil {
+			t.Errorf("%v has not been registered", size)
+		}
+	}
+}
+
+func TestRedBlackCapable(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		redBlack          bool
+	}{
+		{62, 0, true},
+		{62, 29, false},
+		{62, 100, false},
+		{29, 0, false},
+		{58, 58, false},
+	} {
+		mi := GetMediaInfo(test.widthMM, test.lengthMM)
+		if mi == nil {
+			t.Errorf("%+v: unknown media", test)
+		} else if mi.RedBlackCapable != test.redBlack {
+			t.Errorf("%+v: got %t", test, mi.RedBlackCapable)
+		}
+	}
+}
+
+func TestCanvas(t *testing.T) {
+	for _, test := range []struct {
+		widthMM, lengthMM int
+		canvas            image.Rectangle
+	}{
+		{62, 0, image.Rect(0, 0, 696, 0)},
+		{12, 0, image.Rect(0, 0, 106, 0)},
+		{62, 29, image.Rect(0, 0, 696, 271)},
+		{17, 87, image.Rect(0, 0, 165, 956)},
+		{24, 24, image.Rect(0, 0, 236, 236)},
+	} {
+		mi := GetMediaInfo(test.widthMM, test.lengthMM)
+		if mi == nil {
+			t.Errorf("%+v: unknown media", test)
+		} else if canvas := mi.Canvas(); canvas != test.canvas {
+			t.Errorf("%+v: got %v", test, canvas)
+		}
+	}
+}
+
+// opaqueImage hides the type of an image, so that it can't take fast paths.
+type opaqueImage struct{ image.Image }
+
+// testGlyph returns a white image with a glyph of the font shared by tests
+// drawn on it in black, the way labels are made.
+func testGlyph(t testing.TB, r rune) image.Image {
+	f, err := os.Open("../testdata/test.bdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	font, err := bdf.NewFromBDF(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _ := font.FindGlyph(r)
+	img := image.NewGray(g.Bounds().Inset(-1))
+	draw.Draw(img, img.Rect, image.White, image.Point{}, draw.Src)
+	draw.DrawMask(img, img.Rect, image.Black, image.Point{},
+		&g, img.Rect.Min, draw.Over)
+	return img
+}
+
+func TestBitmapFastPaths(t *testing.T) {
+	gray := image.NewGray(image.Rect(0, 0, 256, 4))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 4; y++ {
+			gray.Pix[y*gray.Stride+x] = uint8(x)
+		}
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, 256, 16))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 16; y++ {
+			rgba.SetRGBA(x, y, color.RGBA{
+				uint8(x), uint8(x), uint8(y * 16), uint8(255 - y*8)})
+		}
+	}
+	nrgba := image.NewNRGBA(rgba.Rect)
+	copy(nrgba.Pix, rgba.Pix)
+	glyph := testGlyph(t, 'A')
+
+	for _, test := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"gray", gray},
+		{"RGBA", rgba},
+		{"NRGBA", nrgba},
+		{"scaled NRGBA", &imgutil.Scale{Image: nrgba, Scale: 3}},
+		{"glyph", glyph},
+		{"scaled glyph", &imgutil.Scale{Image: glyph, Scale: 5}},
+		{"rotated glyph", &imgutil.LeftRotate{Image: glyph}},
+		{"rotated gray", &imgutil.RightRotate{Image: gray}},
+	} {
+		length := test.img.Bounds().Dy()
+		data := makeBitmapData(test.img, &PrintOptions{}, 0, 0, length)
+		expected := makeBitmapData(
+			opaqueImage{test.img}, &PrintOptions{}, 0, 0, length)
+		if !bytes.Equal(data, expected) {
+			t.Errorf("%s: the fast path gives different results", test.name)
+		}
+		if blank := makeBitmapData(image.NewUniform(color.White),
+			&PrintOptions{}, 0, 0, length); bytes.Equal(data, blank) {
+			t.Errorf("%s: nothing has been rasterized", test.name)
+		}
+	}
+}
+
+func BenchmarkBitmapGlyph(b *testing.B) {
+	img := &imgutil.Scale{Image: testGlyph(b, 'A'), Scale: 50}
+	for _, bench := range []struct {
+		name string
+		img  image.Image
+	}{
+		{"fast", img},
+		{"opaque", opaqueImage{img}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				makeBitmapData(bench.img, &PrintOptions{},
+					0, 0, img.Bounds().Dy())
+			}
+		})
+	}
+}
+
+func TestRasterPreview(t *testing.T) {
+	mi := GetMediaInfo(62, 0)
+	for _, test := range []struct {
+		color    color.Color
+		redBlack bool
+		preview  color.Color
+	}{
+		{color.Gray{0x00}, false, color.Black},
+		{color.Gray{0x3f}, false, color.Black},
+		{color.Gray{0x40}, false, color.White},
+		{color.Gray{0xff}, false, color.White},
+		{color.RGBA{0, 0, 0, 0x7f}, false, color.White},
+		{color.RGBA{0xff, 0, 0, 0xff}, false, color.White},
+		{color.RGBA{0xff, 0, 0, 0xff}, true, color.RGBA{0xff, 0, 0, 0xff}},
+		{color.Gray{0x3f}, true, color.Black},
+		{color.Gray{0x40}, true, color.White},
+	} {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.Set(0, 0, test.color)
+		preview := RasterPreview(img, mi, &PrintOptions{
+			RedBlack: test.redBlack})
+		if bounds := preview.Bounds(); bounds != image.Rect(
+			0, 0, printPins, 1) {
+			t.Errorf("%+v: unexpected bounds: %v", test, bounds)
+			continue
+		}
+
+		// The image is placed after the side margin, counting from the right.
+		x := printPins - mi.SideMarginPins - 1
+		if c := preview.At(x, 0); color.RGBA64Model.Convert(c) !=
+			color.RGBA64Model.Convert(test.preview) {
+			t.Errorf("%+v: got %v", test, c)
+		}
+		for x2 := 0; x2 < printPins; x2++ {
+			if x2 != x && preview.At(x2, 0) != color.White {
+				t.Errorf("%+v: stray pixel at %d", test, x2)
+				break
+			}
+		}
+	}
+}
+
+func TestClassifyRedBlack(t *testing.T) {
+	orange := color.RGBA{0xff, 0x80, 0x00, 0xff}
+	warm := func(c color.Color) Plane {
+		if r, g, b, _ := c.RGBA(); r >= 0xc000 && g < 0xc000 && b < 0x4000 {
+			return PlaneRed
+		}
+		return ClassifyRedBlack(c)
+	}
+
+	mi := GetMediaInfo(62, 0)
+	for _, test := range []struct {
+		name     string
+		color    color.Color
+		classify func(color.Color) Plane
+		plane    Plane
+	}{
+		{"black", color.Black, nil, PlaneBlack},
+		{"red", color.RGBA{0xff, 0, 0, 0xff}, nil, PlaneRed},
+		{"white", color.White, nil, PlaneWhite},
+		{"orange", orange, nil, PlaneWhite},
+		{"transparent red", color.RGBA{0x7f, 0, 0, 0x7f}, nil, PlaneWhite},
+		{"orange, custom", orange, warm, PlaneRed},
+		{"black, custom", color.Black, warm, PlaneBlack},
+		{"yellow, custom", color.RGBA{0xff, 0xff, 0, 0xff}, warm, PlaneWhite},
+	} {
+		img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+		img.Set(0, 0, test.color)
+		preview := RasterPreview(img, mi, &PrintOptions{
+			RedBlack: true, Classify: test.classify}).(*image.Paletted)
+
+		// The preview palette is ordered the same way as planes.
+		x := printPins - mi.SideMarginPins - 1
+		if plane := Plane(preview.ColorIndexAt(x, 0)); plane != test.plane {
+			t.Errorf("%s: got plane %d, want %d", test.name, plane, test.plane)
+		}
+	}
+}
+
+func TestListMedia(t *testing.T) {
+	list := ListMedia()
+	if len(list) != len(media) {
+		t.Errorf("%d media listed, want %d", len(list), len(media))
+	}
+	for i, size := range list {
+		if GetMediaInfo(size.WidthMM, size.LengthMM) == nil {
+			t.Errorf("%+v: unknown media listed", size)
+		}
+		if i > 0 && (list[i-1].WidthMM > size.WidthMM ||
+			list[i-1].WidthMM == size.WidthMM &&
+				list[i-1].LengthMM >= size.LengthMM) {
+			t.Errorf("%+v: listed out of order", size)
+		}
+	}
+}
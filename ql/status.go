@@ -44,6 +44,32 @@ func decodeBitfieldErrors(b byte, errors [8]string) []string {
 	return result
 }
 
+// MediaEmpty reports whether there is no media left to print on.
+func (s *Status) MediaEmpty() bool { return s[8]&(0x01|0x02) != 0 }
+
+// MediaLow reports whether the media should be replaced soon.
+func (s *Status) MediaLow() bool { return s[9]&0x01 != 0 || s.MediaEmpty() }
+
+// Equal reports whether two statuses carry the same information.
+// The phase number is ignored, as it changes while nothing else does.
+func (s *Status) Equal(other *Status) bool {
+	if s == nil || other == nil {
+		return s == other
+	}
+	a, b := *s, *other
+	a[20], a[21], b[20], b[21] = 0, 0, 0, 0
+	return a == b
+}
+
+// TransientError reports whether the status indicates an error that
+// may well go away on its own, such as a communication error,
+// and there are no other errors requiring intervention.
+func (s *Status) TransientError() bool {
+	transient := s[8]&0x10 != 0 || s[9]&(0x02|0x04|0x08) != 0
+	permanent := s[8]&^0x10 != 0 || s[9]&^(0x02|0x04|0x08) != 0
+	return transient && !permanent
+}
+
 func (s *Status) Errors() (errors []string) {
 	errors = append(errors, decodeBitfieldErrors(s[8], [8]string{
 		"no media", "end of media", "cutter jam", "?", "printer in use",
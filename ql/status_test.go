@@ -0,0 +1,90 @@
+package ql
+
+import "testing"
+
+func TestTransientError(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		error1    byte
+		error2    byte
+		transient bool
+	}{
+		{"no error", 0x00, 0x00, false},
+		{"printer in use", 0x10, 0x00, true},
+		{"expansion buffer full", 0x00, 0x02, true},
+		{"communication error", 0x00, 0x04, true},
+		{"communication buffer full", 0x00, 0x08, true},
+		{"several transient errors", 0x10, 0x0c, true},
+		{"no media", 0x01, 0x00, false},
+		{"cutter jam with a transient error", 0x04, 0x04, false},
+		{"replace media", 0x00, 0x01, false},
+		{"replace media with a transient error", 0x00, 0x05, false},
+		{"cover open with a transient error", 0x10, 0x10, false},
+		{"system error with a transient error", 0x00, 0x84, false},
+	} {
+		var s Status
+		s[8], s[9] = test.error1, test.error2
+		if transient := s.TransientError(); transient != test.transient {
+			t.Errorf("%s: got %t, want %t",
+				test.name, transient, test.transient)
+		}
+	}
+}
+
+func TestMediaLow(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		error1 byte
+		error2 byte
+		low    bool
+		empty  bool
+	}{
+		{"no error", 0x00, 0x00, false, false},
+		{"replace media", 0x00, 0x01, true, false},
+		{"no media", 0x01, 0x00, true, true},
+		{"end of media", 0x02, 0x00, true, true},
+		{"end of media, replace media", 0x02, 0x01, true, true},
+		{"cutter jam", 0x04, 0x00, false, false},
+		{"cover open", 0x00, 0x10, false, false},
+	} {
+		var s Status
+		s[8], s[9] = test.error1, test.error2
+		if low := s.MediaLow(); low != test.low {
+			t.Errorf("%s: media low: got %t, want %t", test.name, low, test.low)
+		}
+		if empty := s.MediaEmpty(); empty != test.empty {
+			t.Errorf("%s: media empty: got %t, want %t",
+				test.name, empty, test.empty)
+		}
+	}
+}
+
+func TestStatusEqual(t *testing.T) {
+	base := testStatus(62, 0)
+	for _, test := range []struct {
+		name   string
+		modify func(s *Status)
+		equal  bool
+	}{
+		{"identical", func(s *Status) {}, true},
+		{"phase number", func(s *Status) { s[20], s[21] = 0x12, 0x34 }, true},
+		{"phase", func(s *Status) { s[19] = byte(StatusPhasePrinting) }, false},
+		{"error", func(s *Status) { s[9] = 0x01 }, false},
+		{"media width", func(s *Status) { s[10] = 29 }, false},
+		{"status type", func(s *Status) { s[18] = 0x05 }, false},
+	} {
+		other := *base
+		test.modify(&other)
+		if equal := base.Equal(&other); equal != test.equal {
+			t.Errorf("%s: got %t, want %t", test.name, equal, test.equal)
+		}
+		if equal := other.Equal(base); equal != test.equal {
+			t.Errorf("%s: not symmetric", test.name)
+		}
+	}
+
+	var none *Status
+	if !none.Equal(nil) || none.Equal(base) || base.Equal(nil) {
+		t.Error("nil statuses are handled incorrectly")
+	}
+}